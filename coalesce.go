@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errFlightAborted is returned to waiters when the leader panicked before
+// producing a result.
+var errFlightAborted = errors.New("in-flight render aborted")
+
+// flightGroup coalesces concurrent renders of the same result path, or
+// fetches of the same source, so that only the first request (the leader)
+// does the work and the rest wait for its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// Do runs fn for key unless a call for key is already in flight, in which
+// case it waits up to timeout for that call's result instead. A timeout of
+// zero waits indefinitely.
+func (g *flightGroup) Do(key string, timeout time.Duration, fn func() (*result, error)) (*result, error) {
+	v, err := g.do(key, timeout, func() (interface{}, error) { return fn() })
+	res, _ := v.(*result)
+	return res, err
+}
+
+// DoSource runs fn for key like Do, for fetches of a source image. Waiters
+// wait as long as the leader's fetch takes, which its own timeout bounds.
+func (g *flightGroup) DoSource(key string, fn func() (*sourceImage, error)) (*sourceImage, error) {
+	v, err := g.do(key, 0, func() (interface{}, error) { return fn() })
+	src, _ := v.(*sourceImage)
+	return src, err
+}
+
+func (g *flightGroup) do(key string, timeout time.Duration, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		return c.wait(timeout)
+	}
+	c := &flightCall{done: make(chan struct{}), err: errFlightAborted}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err
+}
+
+func (c *flightCall) wait(timeout time.Duration) (interface{}, error) {
+	if timeout <= 0 {
+		<-c.done
+		return c.val, c.err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-timer.C:
+		return nil, &statusError{Code: 504, Message: "timed out waiting for in-flight render"}
+	}
+}
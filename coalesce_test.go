@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startFlight starts a call for key that blocks until release is closed,
+// and returns once the call is in flight.
+func startFlight(g *flightGroup, key string, release chan struct{}, res *result, err error) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recover() != nil {
+				done <- errFlightAborted
+			}
+		}()
+		_, err := g.Do(key, 0, func() (*result, error) {
+			<-release
+			if res == nil && err == nil {
+				panic("render failed")
+			}
+			return res, err
+		})
+		done <- err
+	}()
+	for {
+		g.mu.Lock()
+		_, ok := g.calls[key]
+		g.mu.Unlock()
+		if ok {
+			return done
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlightGroupShares(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	want := &result{Path: "/a.jpg"}
+	leader := startFlight(g, "/a.jpg", release, want, nil)
+
+	var wg sync.WaitGroup
+	results := make([]*result, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.Do("/a.jpg", 0, func() (*result, error) {
+				return nil, errors.New("a waiter rendered")
+			})
+		}(i)
+	}
+	// Another key isn't held up by the first.
+	if res, err := g.Do("/b.jpg", time.Second, func() (*result, error) { return &result{Path: "/b.jpg"}, nil }); err != nil || res.Path != "/b.jpg" {
+		t.Errorf("Do of another key = %+v, %v", res, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if err := <-leader; err != nil {
+		t.Fatal(err)
+	}
+	for i, res := range results {
+		if res != want {
+			t.Errorf("waiter %d got %+v, want the leader's result", i, res)
+		}
+	}
+
+	// Once the call is done the next one renders again.
+	calls := 0
+	g.Do("/a.jpg", 0, func() (*result, error) { calls++; return nil, nil })
+	if calls != 1 {
+		t.Errorf("Do after the flight finished ran its function %d times, want 1", calls)
+	}
+}
+
+func TestFlightGroupErrors(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	failure := &statusError{Code: 502, Message: "origin down"}
+	leader := startFlight(g, "/a.jpg", release, nil, failure)
+
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := g.Do("/a.jpg", 0, func() (*result, error) { return nil, nil })
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if err := <-leader; err != failure {
+		t.Errorf("leader got %v, want %v", err, failure)
+	}
+	if err := <-waiter; err != failure {
+		t.Errorf("waiter got %v, want the leader's error %v", err, failure)
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	leader := startFlight(g, "/a.jpg", release, nil, nil)
+
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := g.Do("/a.jpg", 0, func() (*result, error) { return nil, nil })
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	<-leader
+	if err := <-waiter; err != errFlightAborted {
+		t.Errorf("waiter of a panicked render got %v, want errFlightAborted", err)
+	}
+}
+
+func TestFlightGroupTimeout(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	defer close(release)
+	startFlight(g, "/a.jpg", release, &result{}, nil)
+
+	ran := false
+	_, err := g.Do("/a.jpg", 10*time.Millisecond, func() (*result, error) { ran = true; return nil, nil })
+	if serr, ok := err.(*statusError); !ok || serr.Code != 504 {
+		t.Errorf("waiting past the timeout = %v, want a 504", err)
+	}
+	if ran {
+		t.Error("a waiter rendered while the leader was in flight")
+	}
+}
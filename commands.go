@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opendoor-labs/gothumb/urlbuilder"
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// commands are the subcommands run by "gothumb <command>". Without one,
+// gothumb runs the server.
+var commands = map[string]func(args []string){
+	"config":  runConfigCommand,
+	"sign":    runSignCommand,
+	"verify":  runVerifyCommand,
+	"render":  runRenderCommand,
+	"purge":   runPurgeCommand,
+	"migrate": runMigrateCommand,
+}
+
+// commandFlags returns the flag set for a command. The configuration flags
+// are added to it by loadConfigFlags.
+func commandFlags(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet("gothumb "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gothumb %s %s\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func exitWithError(err interface{}) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// runSignCommand implements "gothumb sign", which signs a path with the
+// primary security key and signing algorithm. The path may be given with or
+// without percent-encoding.
+func runSignCommand(args []string) {
+	fs := commandFlags("sign", "[flags] <options>/<source>")
+	base := fs.String("base", "", "print a full URL on this server, e.g. https://thumbs.example.com")
+	c, err := loadConfigFlags(fs, args)
+	if err != nil {
+		exitWithError(err)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err = c.applyURLSettings(); err != nil {
+		exitWithError(err)
+	}
+	if len(securityKeys) == 0 {
+		exitWithError("no security key is configured")
+	}
+
+	p, err := url.PathUnescape(strings.TrimPrefix(fs.Arg(0), "/"))
+	if err != nil {
+		exitWithError(fmt.Errorf("invalid path: %s", err))
+	}
+	opts, err := parseImageOptions(p)
+	if err != nil {
+		exitWithError(fmt.Errorf("invalid path: %s", err))
+	}
+	if err = checkPresetsOnly(opts); err != nil {
+		exitWithError(err)
+	}
+	p = urlbuilder.EscapePath(p)
+
+	key := securityKeys[0]
+	sig := key.sign(signingAlgorithm, p)
+	if key.id != "" {
+		sig = key.id + "." + sig
+	}
+	fmt.Printf("%s/%s/%s\n", strings.TrimSuffix(*base, "/"), sig, p)
+}
+
+// runVerifyCommand implements "gothumb verify", which checks a URL's
+// signature the way the server does and explains why it fails.
+func runVerifyCommand(args []string) {
+	fs := commandFlags("verify", "[flags] <url or path>")
+	c, err := loadConfigFlags(fs, args)
+	if err != nil {
+		exitWithError(err)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err = c.applyURLSettings(); err != nil {
+		exitWithError(err)
+	}
+
+	u, err := url.Parse(fs.Arg(0))
+	if err != nil {
+		exitWithError(fmt.Errorf("invalid URL: %s", err))
+	}
+	report := verifyURL(u, time.Now())
+	fmt.Print(strings.Join(report.lines, "\n") + "\n")
+	if !report.valid {
+		os.Exit(1)
+	}
+}
+
+type verifyReport struct {
+	valid bool
+	lines []string
+}
+
+func (r *verifyReport) add(format string, args ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+}
+
+// verifyURL checks u as handleResize would, reporting what it finds.
+func verifyURL(u *url.URL, now time.Time) *verifyReport {
+	r := &verifyReport{}
+	if u.RawQuery != "" {
+		r.add("note: the query string ?%s is not part of the path and is ignored; a ? in the source must be escaped as %%3F", u.RawQuery)
+	}
+
+	escaped := strings.SplitN(strings.TrimPrefix(u.EscapedPath(), "/"), "/", 2)
+	decoded := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(escaped) != 2 || len(decoded) != 2 {
+		r.add("invalid: expected a path of the form /<signature>/<options>/<source>")
+		return r
+	}
+	sig, pathPart := escaped[0], escaped[1]
+	r.add("signature:   %s", sig)
+	r.add("signed path: %s", pathPart)
+
+	opts, err := parseImageOptions(decoded[1])
+	if err != nil {
+		r.add("invalid: the path doesn't parse: %s", err)
+		return r
+	}
+	if opts.Preset != "" {
+		r.add("preset:      %s", opts.Preset)
+	}
+	r.add("result key:  %s", opts.String())
+	if err = checkPresetsOnly(opts); err != nil {
+		r.add("invalid: %s", err)
+		return r
+	}
+
+	key, algorithm, err := validateSignature(sig, pathPart)
+	if err != nil {
+		r.add("invalid: %s", err)
+		for _, hint := range explainSignature(sig, pathPart, decoded[1], u, opts) {
+			r.add("  - %s", hint)
+		}
+		return r
+	}
+	if key == nil {
+		r.add("unsafe URL, not signed")
+	} else {
+		r.add("signature matches key %s using %s", key.name(), algorithm)
+	}
+	if err = opts.checkValidity(now); err != nil {
+		r.add("invalid: %s (valid from %s until %s)", err, formatValidity(opts.NotBefore), formatValidity(opts.Expires))
+		return r
+	}
+	r.add("valid")
+	r.valid = true
+	return r
+}
+
+func formatValidity(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// explainSignature suggests why sig doesn't match pathPart, by checking the
+// signature against the mistakes that are commonly made when signing.
+func explainSignature(sig, pathPart, decoded string, u *url.URL, opts *imageOptions) []string {
+	if sig == "unsafe" {
+		return []string{"unsafe URLs are only accepted when the server runs with -unsafe"}
+	}
+	var hints []string
+	id := ""
+	if i := strings.LastIndex(sig, "."); i >= 0 {
+		id, sig = sig[:i], sig[i+1:]
+	}
+
+	if strings.ContainsAny(sig, "+/") {
+		hints = append(hints, "the signature contains + or /, so it is standard base64; gothumb expects URL-safe base64, with - and _")
+	}
+	if algorithmForSignature(sig) == "" {
+		var lengths []string
+		padded := sig + strings.Repeat("=", (4-len(sig)%4)%4)
+		for _, a := range urlbuilder.Algorithms {
+			lengths = append(lengths, fmt.Sprintf("%d for %s", a.SignatureLen(), a))
+			if padded != sig && len(padded) == a.SignatureLen() {
+				hints = append(hints, fmt.Sprintf("the signature looks like a %s signature without its = padding", a))
+			}
+		}
+		hints = append(hints, fmt.Sprintf("the signature is %d characters long; expected %s", len(sig), strings.Join(lengths, ", ")))
+		return hints
+	}
+	algorithm := algorithmForSignature(sig)
+	if !acceptedAlgorithms[algorithm] {
+		var accepted []string
+		for _, a := range urlbuilder.Algorithms {
+			if acceptedAlgorithms[string(a)] {
+				accepted = append(accepted, string(a))
+			}
+		}
+		return append(hints, fmt.Sprintf("this server accepts %s signatures; sign with one of those", strings.Join(accepted, ", ")))
+	}
+
+	type variant struct {
+		path, hint string
+	}
+	variants := []variant{
+		{pathPart, ""},
+		{decoded, "the path was signed before it was percent-encoded; sign the path exactly as it appears in the URL"},
+		{"/" + pathPart, "the signed path included the leading slash; sign the path after the signature segment, without it"},
+		{urlbuilder.EscapePath(decoded), fmt.Sprintf("the signature matches %s; the URL was encoded differently after it was signed", urlbuilder.EscapePath(decoded))},
+		{opts.signedPath(), fmt.Sprintf("the signature matches the canonical path %s; the URL was changed after it was signed", opts.signedPath())},
+	}
+	if u.RawQuery != "" {
+		variants = append(variants, variant{pathPart + "?" + u.RawQuery, "the signed path included the query string; escape the ? in the source as %3F before signing"})
+	}
+	if i := strings.Index(pathPart, ":/"); i >= 0 && !strings.HasPrefix(pathPart[i:], "://") {
+		fixed := pathPart[:i] + "://" + pathPart[i+2:]
+		variants = append(variants, variant{fixed, "the // in the source URL was collapsed to a single /, probably by a proxy or client that cleans paths"})
+	}
+
+	for _, k := range securityKeys {
+		for _, v := range variants {
+			if v.path == pathPart && (id == "" || k.id == id) {
+				continue // the check that just failed
+			}
+			if sig != k.sign(algorithm, v.path) {
+				continue
+			}
+			hint := v.hint
+			if id != "" && k.id != id {
+				keyHint := fmt.Sprintf("the signature was made with key %s, not %s", k.name(), id)
+				if hint == "" {
+					hint = keyHint
+				} else {
+					hint = keyHint + "; " + hint
+				}
+			}
+			return append(hints, hint)
+		}
+	}
+	return append(hints, "the signature matches no configured key for this path or its common variants; check the key, the algorithm and that exactly the path after the signature was signed")
+}
+
+// runRenderCommand implements "gothumb render", which runs a local image
+// through the same checks and processing as the server.
+func runRenderCommand(args []string) {
+	fs := commandFlags("render", "[flags] <input> <output>")
+	size := fs.String("size", "", "resize to `WxH`")
+	options := fs.String("options", "", "`options` as in a URL path, e.g. fit-in/300x200/filters:quality(80) or preset:card")
+	// render never checks signatures, so it needs no security key.
+	c, err := loadConfigFlags(fs, append([]string{"-unsafe"}, args...))
+	if err != nil {
+		exitWithError(err)
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *size != "" && *options != "" {
+		exitWithError("-size and -options can't be used together; put the size in -options")
+	}
+	if err = c.applyRenderSettings(); err != nil {
+		exitWithError(err)
+	}
+	p := strings.Trim(*options, "/")
+	if *size != "" {
+		p = *size
+	}
+	out := fs.Arg(1)
+	res, err := renderFile(fs.Arg(0), out, p)
+	if err != nil {
+		exitWithError(err)
+	}
+	if s, err := bimg.Size(res.Data); err == nil {
+		fmt.Printf("%s: %dx%d %s, %d bytes\n", out, s.Width, s.Height, res.ContentType, len(res.Data))
+	}
+}
+
+// renderFile renders the image in the file in with the URL options p, and
+// writes the result to the file out. Unless p has a format() filter, the
+// output format is taken from out's extension.
+func renderFile(in, out, p string) (*result, error) {
+	source := "file:" + filepath.ToSlash(in)
+	if p != "" {
+		source = p + "/" + source
+	}
+	opts, err := parseImageOptions(source)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.HasFormat() {
+		f, err := newFormatFilter([]string{strings.TrimPrefix(filepath.Ext(out), ".")})
+		if err != nil {
+			return nil, fmt.Errorf("can't tell the output format from %s; add a format() filter", out)
+		}
+		opts.Filters = append(opts.Filters, f)
+	}
+
+	src, err := fileLoader{root: filepath.Dir(in)}.Load(filepath.Base(in))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", in, err)
+	}
+	rpath := normalizePath("/" + opts.String())
+	res, err := renderSource(rootLogger.With("path", rpath), src.Data, rpath, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(out, res.Data, 0644); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// runPurgeCommand implements "gothumb purge", which purges results through
+// a running server's admin endpoint, so that its in-memory caches and purge
+// hook see the purge too. Other servers' in-memory caches only see it if the
+// purge hook forwards it to them.
+func runPurgeCommand(args []string) {
+	fs := commandFlags("purge", "[flags] <result path>... | -source <source URL>... | -prefix <prefix>...")
+	server := fs.String("server", "", "the server to purge on (default: localhost on the listen port)")
+	bySource := fs.Bool("source", false, "purge every result rendered from the given source URLs")
+	byPrefix := fs.Bool("prefix", false, "purge every result whose path starts with one of the given prefixes")
+	c, err := loadConfigFlags(fs, args)
+	if err != nil {
+		exitWithError(err)
+	}
+	if fs.NArg() == 0 || (*bySource && *byPrefix) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if c.AdminKey == "" {
+		exitWithError("no admin key is configured")
+	}
+
+	pr := &purgeRequest{}
+	switch {
+	case *bySource:
+		pr.Sources = fs.Args()
+	case *byPrefix:
+		pr.Prefixes = fs.Args()
+	default:
+		pr.Paths = fs.Args()
+	}
+	target := *server
+	if target == "" {
+		_, port, err := net.SplitHostPort(c.Listen)
+		if err != nil {
+			exitWithError(fmt.Errorf("can't tell the server from listen address %q; use -server", c.Listen))
+		}
+		target = "http://localhost:" + port
+	}
+
+	body, err := json.Marshal(pr)
+	if err != nil {
+		exitWithError(err)
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(target, "/")+"/admin/purge", bytes.NewReader(body))
+	if err != nil {
+		exitWithError(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.AdminKey)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		exitWithError(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 500 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		exitWithError(fmt.Sprintf("%s: %s", res.Status, strings.TrimSpace(string(msg))))
+	}
+	var resp purgeResponse
+	if err = json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		exitWithError(fmt.Errorf("%s: %s", res.Status, err))
+	}
+	for _, p := range resp.Purged {
+		fmt.Println(p)
+	}
+	fmt.Fprintf(os.Stderr, "purged %d results\n", len(resp.Purged))
+	if len(resp.Errors) > 0 {
+		exitWithError(strings.Join(resp.Errors, "\n"))
+	}
+}
+
+// runMigrateCommand implements "gothumb migrate", which copies the objects
+// in result storage from the configured key layout to another. Objects are
+// copied rather than moved, so that servers using either layout keep
+// working while the migration runs.
+func runMigrateCommand(args []string) {
+	fs := commandFlags("migrate", "[flags] -to-layout <raw|hashed> [-to-root <path>]")
+	toLayout := fs.String("to-layout", "", "the layout to copy objects to (default: the configured layout)")
+	toRoot := fs.String("to-root", "", "the root path to copy objects to (default: the configured root)")
+	dryRun := fs.Bool("dry-run", false, "print what would be copied without copying it")
+	c, err := loadConfigFlags(fs, args)
+	if err != nil {
+		exitWithError(err)
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if !given["to-layout"] {
+		*toLayout = c.ResultStorageLayout
+	}
+	if !given["to-root"] {
+		*toRoot = c.ResultStorageRoot
+	}
+
+	store, err := newResultStorage(c)
+	if err != nil {
+		exitWithError(err)
+	}
+	if store == nil {
+		exitWithError("no result storage is configured")
+	}
+	from, err := newKeyLayout(c.ResultStorageLayout, c.ResultStorageRoot)
+	if err != nil {
+		exitWithError(err)
+	}
+	to, err := newKeyLayout(*toLayout, *toRoot)
+	if err != nil {
+		exitWithError(err)
+	}
+	if from == to {
+		exitWithError(fmt.Sprintf("result storage already uses the %s", to))
+	}
+
+	fmt.Fprintf(os.Stderr, "copying from the %s to the %s\n", from, to)
+	copied, skipped, err := migrateResults(store, from, to, *dryRun, func(oldKey, newKey string) {
+		fmt.Printf("%s -> %s\n", oldKey, newKey)
+	})
+	verb := "copied"
+	if *dryRun {
+		verb = "would copy"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d objects, skipped %d\n", verb, copied, skipped)
+	if err != nil {
+		exitWithError(err)
+	}
+}
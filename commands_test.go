@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useRenderSettings applies c's render settings for the duration of a test.
+// Call the returned func to restore the previous ones.
+func useRenderSettings(t *testing.T, c *Config) func() {
+	restoreURLSettings := useURLSettings(t, c)
+	format, bytes, pixels, types, private, client, hosts := logFormat, maxSourceBytes, maxSourcePixels, allowedSourceTypes, allowPrivateSources, httpClient, allowedSourceHosts
+	if err := c.applyRenderSettings(); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		restoreURLSettings()
+		logFormat, maxSourceBytes, maxSourcePixels, allowedSourceTypes, allowPrivateSources, httpClient, allowedSourceHosts = format, bytes, pixels, types, private, client, hosts
+	}
+}
+
+// TestApplyRenderSettings checks that the render command's settings leave
+// loaders, storage and caches alone, however they are configured.
+func TestApplyRenderSettings(t *testing.T) {
+	defer func(s ResultStorage, sources *sourceCache, o map[string]Loader, b map[string]Loader) {
+		resultStorage, cachedSources, origins, sourceBuckets = s, sources, o, b
+	}(resultStorage, cachedSources, origins, sourceBuckets)
+	c := defaultConfig()
+	c.Unsafe = true
+	c.ResultStorage, c.ResultStorageBucket = "s3", "thumbs"
+	c.SourceCache = "storage"
+	c.SourceS3Buckets = []string{"originals"}
+	c.Origins = map[string]string{"photos": "s3://originals/photos"}
+	c.LogFormat, c.MaxSourceBytes = "json", 1234
+	c.AllowedSourceHosts = []string{"*.example.com"}
+	resultStorage, cachedSources, origins, sourceBuckets, httpClient = nil, nil, nil, nil, nil
+
+	defer useRenderSettings(t, c)()
+	if resultStorage != nil || cachedSources != nil || origins != nil || sourceBuckets != nil {
+		t.Errorf("render settings set up storage %v, source cache %v, origins %v or buckets %v", resultStorage, cachedSources, origins, sourceBuckets)
+	}
+	if logFormat != "json" || maxSourceBytes != 1234 || !unsafeMode {
+		t.Errorf("log_format %q, max_source_bytes %d, unsafe %v not applied", logFormat, maxSourceBytes, unsafeMode)
+	}
+	// Watermarks are fetched while rendering, so the source client is set up.
+	if httpClient == nil || len(allowedSourceHosts) != 1 {
+		t.Errorf("render settings left source client %v and allowed hosts %v unset", httpClient, allowedSourceHosts)
+	}
+}
+
+// writeTestJPEG writes a small, real JPEG to a temporary directory, and
+// returns its path along with a func that removes the directory.
+func writeTestJPEG(t *testing.T) (string, func()) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gothumb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "in.jpg")
+	if err = ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p, func() { os.RemoveAll(dir) }
+}
+
+func TestRenderFile(t *testing.T) {
+	in, cleanup := writeTestJPEG(t)
+	defer cleanup()
+	defer useURLSettings(t, defaultConfig())()
+	out := filepath.Join(filepath.Dir(in), "out.jpg")
+
+	res, err := renderFile(in, out, "4x4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ContentType != "image/jpeg" || res.Path != "/4x4/filters:format(jpeg)/file:"+filepath.ToSlash(in) {
+		t.Errorf("rendered %s as %s", res.Path, res.ContentType)
+	}
+	if written, err := ioutil.ReadFile(out); err != nil || !bytes.Equal(written, res.Data) {
+		t.Errorf("%s doesn't hold the result: %v", out, err)
+	}
+
+	cases := []struct{ in, out, p, err string }{
+		{in, filepath.Join(filepath.Dir(in), "out.bmp"), "4x4", "can't tell the output format"},
+		{in, out, "4x4/filters:nope()", "nope"},
+		{filepath.Join(filepath.Dir(in), "missing.jpg"), out, "4x4", "source not found"},
+	}
+	for _, c := range cases {
+		if _, err := renderFile(c.in, c.out, c.p); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("renderFile(%s, %s, %q) = %v, want an error mentioning %q", c.in, c.out, c.p, err, c.err)
+		}
+	}
+}
+
+func TestRenderFileWatermark(t *testing.T) {
+	var mark bytes.Buffer
+	if err := png.Encode(&mark, image.NewNRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(mark.Bytes())
+	}))
+	defer srv.Close()
+	in, cleanup := writeTestJPEG(t)
+	defer cleanup()
+	out := filepath.Join(filepath.Dir(in), "out.jpg")
+	p := "4x4/filters:watermark(" + srv.URL + "/mark.png,0,0,50)"
+
+	// The test server is on a loopback address, which sources may only
+	// resolve to when private sources are allowed.
+	c := defaultConfig()
+	defer useRenderSettings(t, c)()
+	if _, err := renderFile(in, out, p); err == nil || !strings.Contains(err.Error(), "private address") {
+		t.Errorf("renderFile with a loopback watermark = %v, want it blocked", err)
+	}
+
+	c.AllowPrivateSources = true
+	defer useRenderSettings(t, c)()
+	if _, err := renderFile(in, out, p); err != nil {
+		t.Errorf("renderFile with a watermark: %v", err)
+	}
+}
+
+func TestVerifyURL(t *testing.T) {
+	c := defaultConfig()
+	c.SecurityKey = "secret"
+	defer useURLSettings(t, c)()
+	sign := func(p string) string { return "/" + securityKeys[0].sign(signingAlgorithm, p) + "/" + p }
+	now := time.Unix(1600000000, 0)
+
+	cases := []struct {
+		name  string
+		url   string
+		valid bool
+		line  string
+	}{
+		{"valid", sign("300x200/https://example.com/a%20b.jpg"), true, "signature matches key"},
+		{"signed before encoding", "/" + securityKeys[0].sign(signingAlgorithm, "300x200/https://example.com/a b.jpg") + "/300x200/https://example.com/a%20b.jpg", false, "signed before it was percent-encoded"},
+		{"collapsed slashes", "/" + securityKeys[0].sign(signingAlgorithm, "300x200/https://example.com/a.jpg") + "/300x200/https:/example.com/a.jpg", false, "collapsed to a single /"},
+		{"standard base64", "/abc+def/300x200/a.jpg", false, "standard base64"},
+		{"expired", sign("expires:1500000000/300x200/a.jpg"), false, "invalid: URL expired"},
+		{"bad path", "/sig", false, "expected a path of the form"},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := verifyURL(u, now)
+		report := strings.Join(r.lines, "\n")
+		if r.valid != c.valid || !strings.Contains(report, c.line) {
+			t.Errorf("%s: valid %v, want %v, with a line mentioning %q:\n%s", c.name, r.valid, c.valid, c.line, report)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// checkNotModified evaluates the request's If-None-Match and
+// If-Modified-Since headers against a result, per RFC 7232. When the client's
+// copy is current it responds with 304 Not Modified and returns true.
+func checkNotModified(w http.ResponseWriter, req *http.Request, res *result) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+
+	notModified := false
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		// If-Modified-Since is ignored when If-None-Match is present.
+		notModified = etagListMatches(inm, res.ETag)
+	} else if ims := req.Header.Get("If-Modified-Since"); ims != "" && !res.LastModified.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil {
+			notModified = !res.LastModified.Truncate(time.Second).After(t)
+		}
+	}
+	if !notModified {
+		return false
+	}
+
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagListMatches reports whether the comma-separated entity tags in list
+// include etag, using the weak comparison required for If-None-Match.
+func etagListMatches(list, etag string) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tag = strings.TrimPrefix(tag, "W/")
+		if strings.Trim(tag, `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEtagListMatches(t *testing.T) {
+	const etag = "d41d8cd98f00b204e9800998ecf8427e"
+	cases := []struct {
+		list string
+		want bool
+	}{
+		{`"d41d8cd98f00b204e9800998ecf8427e"`, true},
+		{`W/"d41d8cd98f00b204e9800998ecf8427e"`, true},
+		{`"other", "d41d8cd98f00b204e9800998ecf8427e"`, true},
+		{`"other",W/"d41d8cd98f00b204e9800998ecf8427e" , "third"`, true},
+		{`*`, true},
+		{`"other", *`, true},
+		{`"other"`, false},
+		{`"other", W/"another"`, false},
+		{`"d41d8cd98f00b204e9800998ecf8427"`, false},
+		{``, false},
+	}
+	for _, c := range cases {
+		if got := etagListMatches(c.list, etag); got != c.want {
+			t.Errorf("etagListMatches(%s) = %v, want %v", c.list, got, c.want)
+		}
+	}
+}
+
+func TestCheckNotModified(t *testing.T) {
+	modified := time.Date(2026, 1, 2, 15, 4, 5, 500, time.UTC)
+	res := &result{ETag: "abc", LastModified: modified}
+	at := func(t time.Time) string { return t.Format(http.TimeFormat) }
+
+	cases := []struct {
+		method      string
+		ifNoneMatch string
+		ifModSince  string
+		want        bool
+	}{
+		{"GET", "", "", false},
+		{"GET", `"abc"`, "", true},
+		{"HEAD", `W/"abc"`, "", true},
+		{"GET", `"xyz", "abc"`, "", true},
+		{"GET", "*", "", true},
+		{"GET", `"xyz"`, "", false},
+		{"POST", `"abc"`, "", false},
+		{"GET", "", at(modified), true},
+		{"GET", "", at(modified.Add(time.Hour)), true},
+		{"GET", "", at(modified.Add(-time.Second)), false},
+		{"GET", "", "not a date", false},
+		// If-None-Match takes precedence over If-Modified-Since.
+		{"GET", `"xyz"`, at(modified.Add(time.Hour)), false},
+		{"GET", `"abc"`, at(modified.Add(-time.Hour)), true},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/x", nil)
+		if c.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", c.ifNoneMatch)
+		}
+		if c.ifModSince != "" {
+			req.Header.Set("If-Modified-Since", c.ifModSince)
+		}
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", "image/jpeg")
+		rec.Header().Set("Content-Length", "3")
+		got := checkNotModified(rec, req, res)
+		if got != c.want {
+			t.Errorf("%s If-None-Match %q If-Modified-Since %q: not modified %v, want %v", c.method, c.ifNoneMatch, c.ifModSince, got, c.want)
+			continue
+		}
+		if got && (rec.Code != 304 || rec.Header().Get("Content-Type") != "" || rec.Header().Get("Content-Length") != "") {
+			t.Errorf("%s If-None-Match %q: %d with headers %v", c.method, c.ifNoneMatch, rec.Code, rec.Header())
+		}
+	}
+
+	// Results without a modification time only match by ETag.
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.Header.Set("If-Modified-Since", at(modified))
+	if checkNotModified(httptest.NewRecorder(), req, &result{ETag: "abc"}) {
+		t.Error("If-Modified-Since matched a result without a modification time")
+	}
+}
+
+func TestStoredResultRange(t *testing.T) {
+	defer func(unsafe bool, hosts []string, rs ResultStorage) {
+		unsafeMode, allowedSourceHosts, resultStorage = unsafe, hosts, rs
+	}(unsafeMode, allowedSourceHosts, resultStorage)
+	unsafeMode, allowedSourceHosts = true, nil
+	storage := newMemoryResultStorage()
+	resultStorage = storage
+
+	const p = "300x200/https://img.example.com/a.jpg"
+	opts, err := parseImageOptions(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("0123456789")
+	meta := &ResultMeta{ContentType: "image/jpeg", ETag: "abc", LastModified: time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)}
+	if err := storage.Put(normalizePath("/"+opts.String()), data, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		rangeHeader, ifRange string
+		code                 int
+		body                 string
+	}{
+		{"", "", 200, "0123456789"},
+		{"bytes=2-4", "", 206, "234"},
+		{"bytes=-3", "", 206, "789"},
+		{"bytes=7-", "", 206, "789"},
+		{"bytes=20-30", "", 416, ""},
+		{"bytes=2-4", `"abc"`, 206, "234"},
+		{"bytes=2-4", `"stale"`, 200, "0123456789"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/unsafe/"+p, nil)
+		if c.rangeHeader != "" {
+			req.Header.Set("Range", c.rangeHeader)
+		}
+		if c.ifRange != "" {
+			req.Header.Set("If-Range", c.ifRange)
+		}
+		rec := httptest.NewRecorder()
+		newHandler().ServeHTTP(rec, req)
+		if rec.Code != c.code || (c.body != "" && rec.Body.String() != c.body) {
+			t.Errorf("Range %q If-Range %q = %d %q, want %d %q", c.rangeHeader, c.ifRange, rec.Code, rec.Body.String(), c.code, c.body)
+		}
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Config is gothumb's configuration. It is built from defaults, then an
+// optional config file, then env vars and finally command line flags, each
+// overriding the ones before it.
+type Config struct {
+	Listen       string   `json:"listen"`
+	MaxAge       int      `json:"max_age"`
+	SecurityKey  string   `json:"security_key"`
+	SecurityKeys []string `json:"security_keys"`
+
+	SignatureAlgorithms []string `json:"signature_algorithms"`
+	SigningAlgorithm    string   `json:"signing_algorithm"`
+	Unsafe              bool     `json:"unsafe"`
+	AutoWebP            bool     `json:"auto_webp"`
+	AutoAVIF            bool     `json:"auto_avif"`
+	LogFormat           string   `json:"log_format"`
+	ShutdownTimeout     Duration `json:"shutdown_timeout"`
+	CoalesceTimeout     Duration `json:"coalesce_timeout"`
+
+	Concurrency  int      `json:"concurrency"`
+	QueueDepth   int      `json:"queue_depth"`
+	QueueTimeout Duration `json:"queue_timeout"`
+
+	ConnectTimeout      Duration          `json:"connect_timeout"`
+	FetchTimeout        Duration          `json:"fetch_timeout"`
+	MaxSourceBytes      int64             `json:"max_source_bytes"`
+	MaxSourcePixels     int               `json:"max_source_pixels"`
+	AllowedSourceTypes  []string          `json:"allowed_source_types"`
+	AllowedSourceHosts  []string          `json:"allowed_source_hosts"`
+	AllowPrivateSources bool              `json:"allow_private_sources"`
+	Origins             map[string]string `json:"origins"`
+	SourceS3Buckets     []string          `json:"source_s3_buckets"`
+
+	Presets     map[string]string `json:"presets"`
+	PresetsOnly bool              `json:"presets_only"`
+
+	ResultCacheBytes int64    `json:"result_cache_bytes"`
+	ResultCacheTTL   Duration `json:"result_cache_ttl"`
+
+	SourceCache      string   `json:"source_cache"`
+	SourceCacheBytes int64    `json:"source_cache_bytes"`
+	SourceCachePath  string   `json:"source_cache_path"`
+	SourceCacheTTL   Duration `json:"source_cache_ttl"`
+
+	ResultStorage       string `json:"result_storage"`
+	ResultStorageBucket string `json:"result_storage_bucket"`
+	ResultStoragePath   string `json:"result_storage_path"`
+	ResultStorageRoot   string `json:"result_storage_root"`
+	ResultStorageLayout string `json:"result_storage_layout"`
+	UseRRS              bool   `json:"use_rrs"`
+
+	ResultTTL            Duration `json:"result_ttl"`
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"`
+	StaleIfError         Duration `json:"stale_if_error"`
+
+	AdminKey     string `json:"admin_key"`
+	PurgeWebhook string `json:"purge_webhook"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:             ":8888",
+		LogFormat:          "logfmt",
+		ShutdownTimeout:    Duration(25 * time.Second),
+		CoalesceTimeout:    Duration(30 * time.Second),
+		Concurrency:        runtime.NumCPU(),
+		QueueDepth:         100,
+		QueueTimeout:       Duration(10 * time.Second),
+		ConnectTimeout:     Duration(5 * time.Second),
+		FetchTimeout:       Duration(30 * time.Second),
+		MaxSourceBytes:     int64(50 * MB),
+		MaxSourcePixels:    50000000,
+		AllowedSourceTypes: []string{"image/jpeg", "image/png", "image/gif", "image/webp", "image/tiff"},
+		// SHA-1 stays accepted so that existing URLs keep working.
+		SignatureAlgorithms: []string{"sha1", "sha256", "sha512"},
+		SigningAlgorithm:    "sha256",
+		Origins:             map[string]string{},
+		Presets:             map[string]string{},
+		ResultCacheTTL:      Duration(time.Hour),
+		ResultStorageLayout: "raw",
+		SourceCacheBytes:    int64(256 * MB),
+		SourceCacheTTL:      Duration(5 * time.Minute),
+	}
+}
+
+// A setting ties a Config field to its command line flag and env var.
+type setting struct {
+	flag, env, usage string
+	value            flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"l", "", "listen address (PORT sets the port)", (*stringValue)(&c.Listen)},
+		{"max-age", "MAX_AGE", "the maximum HTTP caching age to use on returned images", (*intValue)(&c.MaxAge)},
+		{"k", "SECURITY_KEY", "the primary security key, used to sign new URLs", (*stringValue)(&c.SecurityKey)},
+		{"security-keys", "SECURITY_KEYS", "comma-separated additional security keys, each secret or id=secret, accepted for URLs signed before a rotation", (*stringList)(&c.SecurityKeys)},
+		{"signature-algorithms", "SIGNATURE_ALGORITHMS", "comma-separated HMAC algorithms signatures are accepted with: sha1, sha256, sha512", (*stringList)(&c.SignatureAlgorithms)},
+		{"signing-algorithm", "SIGNING_ALGORITHM", "the HMAC algorithm new URLs are signed with", (*stringValue)(&c.SigningAlgorithm)},
+		{"unsafe", "", "whether to allow /unsafe URLs", (*boolValue)(&c.Unsafe)},
+		{"auto-webp", "AUTO_WEBP", "whether to serve WebP to clients that accept it", (*boolValue)(&c.AutoWebP)},
+		{"auto-avif", "AUTO_AVIF", "whether to serve AVIF to clients that accept it, in preference to WebP (needs libvips 8.9+ with AV1 support)", (*boolValue)(&c.AutoAVIF)},
+		{"log-format", "LOG_FORMAT", "log line format: logfmt or json", (*stringValue)(&c.LogFormat)},
+		{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long to wait for in-flight requests and result stores when shutting down", &c.ShutdownTimeout},
+		{"coalesce-timeout", "COALESCE_TIMEOUT", "how long to wait for an identical in-flight render before giving up (0 waits indefinitely)", &c.CoalesceTimeout},
+		{"concurrency", "CONCURRENCY", "the maximum number of images to process at once", (*intValue)(&c.Concurrency)},
+		{"queue-depth", "QUEUE_DEPTH", "the maximum number of requests waiting to be processed", (*intValue)(&c.QueueDepth)},
+		{"queue-timeout", "QUEUE_TIMEOUT", "how long a request may wait to be processed before a 503", &c.QueueTimeout},
+		{"connect-timeout", "CONNECT_TIMEOUT", "the timeout for connecting to a source", &c.ConnectTimeout},
+		{"fetch-timeout", "FETCH_TIMEOUT", "the timeout for fetching a source, including reading its body", &c.FetchTimeout},
+		{"max-source-bytes", "MAX_SOURCE_BYTES", "the maximum size of a source image in bytes (0 for no limit)", (*int64Value)(&c.MaxSourceBytes)},
+		{"max-source-pixels", "MAX_SOURCE_PIXELS", "the maximum width*height of a source image (0 for no limit)", (*intValue)(&c.MaxSourcePixels)},
+		{"allowed-source-types", "ALLOWED_SOURCE_TYPES", "comma-separated MIME types sources may be served as (empty allows any)", (*stringList)(&c.AllowedSourceTypes)},
+		{"allowed-source-hosts", "ALLOWED_SOURCE_HOSTS", "comma-separated source host patterns, e.g. *.example.com (empty allows any)", (*stringList)(&c.AllowedSourceHosts)},
+		{"allow-private-sources", "ALLOW_PRIVATE_SOURCES", "whether sources may resolve to private, loopback or link-local addresses", (*boolValue)(&c.AllowPrivateSources)},
+		{"origins", "ORIGINS", "comma-separated name=URL origins usable as origin:<name>/<path> sources; URLs may be http(s), s3 or file", (*stringMap)(&c.Origins)},
+		{"source-s3-buckets", "SOURCE_S3_BUCKETS", "comma-separated S3 buckets usable as s3://<bucket>/<key> sources", (*stringList)(&c.SourceS3Buckets)},
+		{"presets", "PRESETS", "semicolon-separated name=options presets usable as preset:<name>, e.g. card=fit-in/300x200;avatar=64x64/smart", (*presetMap)(&c.Presets)},
+		{"presets-only", "PRESETS_ONLY", "whether to reject URLs that don't use a preset", (*boolValue)(&c.PresetsOnly)},
+		{"result-cache-bytes", "RESULT_CACHE_BYTES", "the size of the in-memory cache of recent results in bytes (0 disables it)", (*int64Value)(&c.ResultCacheBytes)},
+		{"result-cache-ttl", "RESULT_CACHE_TTL", "how long results stay in the in-memory cache (0 keeps them until evicted)", &c.ResultCacheTTL},
+		{"source-cache", "SOURCE_CACHE", "where to cache source images: memory, file, storage (alongside results) or none", (*stringValue)(&c.SourceCache)},
+		{"source-cache-bytes", "SOURCE_CACHE_BYTES", "the size of the memory or file source cache in bytes", (*int64Value)(&c.SourceCacheBytes)},
+		{"source-cache-path", "SOURCE_CACHE_PATH", "the directory sources are cached in with the file source cache", (*stringValue)(&c.SourceCachePath)},
+		{"source-cache-ttl", "SOURCE_CACHE_TTL", "how long a cached source is used before it is revalidated with its origin", &c.SourceCacheTTL},
+		{"result-storage", "RESULT_STORAGE", "where to store results: s3, file, memory or none", (*stringValue)(&c.ResultStorage)},
+		{"result-storage-bucket", "RESULT_STORAGE_BUCKET", "the S3 bucket results are stored in", (*stringValue)(&c.ResultStorageBucket)},
+		{"result-storage-path", "RESULT_STORAGE_PATH", "the directory results are stored in with file storage", (*stringValue)(&c.ResultStoragePath)},
+		{"result-storage-root", "RESULT_STORAGE_ROOT", "a path results are stored beneath, e.g. thumbs", (*stringValue)(&c.ResultStorageRoot)},
+		{"result-storage-layout", "RESULT_STORAGE_LAYOUT", "how results are keyed in storage: raw (their path) or hashed (a SHA-256 of it, sharded by its first byte)", (*stringValue)(&c.ResultStorageLayout)},
+		{"use-rrs", "USE_RRS", "whether to store S3 results with reduced redundancy", (*boolValue)(&c.UseRRS)},
+		{"result-ttl", "RESULT_TTL", "how long a stored result is fresh before it is refreshed from its source (0 keeps results fresh forever)", &c.ResultTTL},
+		{"stale-while-revalidate", "STALE_WHILE_REVALIDATE", "how long past its freshness a result may be served while it is refreshed in the background", &c.StaleWhileRevalidate},
+		{"stale-if-error", "STALE_IF_ERROR", "how long past its freshness a result may be served when refreshing it fails", &c.StaleIfError},
+		{"admin-key", "ADMIN_KEY", "the bearer token admin endpoints such as /admin/purge require (empty disables them)", (*stringValue)(&c.AdminKey)},
+		{"purge-webhook", "PURGE_WEBHOOK", "a URL each purge is POSTed to as JSON, e.g. to invalidate a CDN or forward the purge to other gothumb instances", (*stringValue)(&c.PurgeWebhook)},
+	}
+}
+
+// loadConfig builds the configuration from the config file named by
+// -config or CONFIG_FILE, env vars and the command line flags in args, and
+// validates it.
+func loadConfig(name string, args []string) (*Config, error) {
+	return loadConfigFlags(flag.NewFlagSet(name, flag.ExitOnError), args)
+}
+
+// loadConfigFlags is loadConfig for commands that define flags of their own
+// in fs. Arguments after the flags are left in fs.Args().
+func loadConfigFlags(fs *flag.FlagSet, args []string) (*Config, error) {
+	// Flags are parsed first, into a throwaway Config, so that -config is
+	// known before anything else is loaded. The flags that were given are
+	// replayed onto the real Config last so that they take precedence.
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML, TOML or JSON config file")
+	for _, s := range defaultConfig().settings() {
+		fs.Var(s.value, s.flag, s.usage)
+	}
+	fs.Parse(args)
+
+	c := defaultConfig()
+	if *configFile != "" {
+		if err := c.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]setting)
+	for _, s := range c.settings() {
+		settings[s.flag] = s
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if s, ok := settings[f.Name]; ok {
+			s.value.Set(f.Value.String())
+		}
+	})
+
+	// For backwards compatibility, setting only a bucket selects S3.
+	if c.ResultStorage == "" && c.ResultStorageBucket != "" {
+		c.ResultStorage = "s3"
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile reads settings from a config file. The format is chosen by the
+// file's extension.
+func (c *Config) loadFile(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("reading config: %s", err)
+	}
+
+	var values map[string]interface{}
+	switch ext := strings.ToLower(path.Ext(name)); ext {
+	case ".json":
+		err = json.Unmarshal(data, &values)
+	case ".yaml", ".yml":
+		values, err = parseYAMLConfig(data)
+	case ".toml":
+		values, err = parseTOMLConfig(data)
+	default:
+		return fmt.Errorf("config file %s: unknown format %q, expected .yaml, .toml or .json", name, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %s", name, err)
+	}
+
+	fields := configFields()
+	var unknown, errs []string
+	for key := range values {
+		if _, ok := fields[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("config file %s: unknown settings %s", name, strings.Join(unknown, ", "))
+	}
+
+	// Decode each setting separately, by round-tripping it through JSON, so
+	// that type errors can name the setting.
+	v := reflect.ValueOf(c).Elem()
+	for key, value := range values {
+		field := v.Field(fields[key])
+		field.Set(reflect.Zero(field.Type()))
+		data, _ := json.Marshal(value)
+		if err := json.Unmarshal(data, field.Addr().Interface()); err != nil {
+			errs = append(errs, fmt.Sprintf("%s must be %s", key, describeType(field.Type())))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("config file %s:\n  - %s", name, strings.Join(errs, "\n  - "))
+	}
+	return nil
+}
+
+// configFields maps the setting names a config file may use to the index of
+// their Config field.
+func configFields() map[string]int {
+	fields := make(map[string]int)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		fields[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = i
+	}
+	return fields
+}
+
+func describeType(t reflect.Type) string {
+	switch t {
+	case reflect.TypeOf(Duration(0)):
+		return "a duration such as \"10s\""
+	case reflect.TypeOf([]string(nil)):
+		return "a list of strings"
+	case reflect.TypeOf(map[string]string(nil)):
+		return "a map of strings"
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64:
+		return "an integer"
+	case reflect.Bool:
+		return "true or false"
+	}
+	return "a " + t.String()
+}
+
+// loadEnv overrides settings with any env vars that are set.
+func (c *Config) loadEnv() error {
+	if port := os.Getenv("PORT"); port != "" {
+		c.Listen = ":" + port
+	}
+	for _, s := range c.settings() {
+		if s.env == "" {
+			continue
+		}
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.value.Set(v); err != nil {
+				return fmt.Errorf("invalid %s: %s", s.env, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the configuration, reporting every problem at once.
+func (c *Config) validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Listen != "", "listen must be set")
+	check(c.MaxAge >= 0, "max_age must not be negative")
+	check(c.SecurityKey != "" || len(c.SecurityKeys) > 0 || c.Unsafe, "security_key or security_keys must be set unless unsafe URLs are allowed")
+	if _, err := parseSecurityKeys(c.SecurityKey, c.SecurityKeys); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if algorithms, err := parseSignatureAlgorithms(c.SignatureAlgorithms); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		check(len(algorithms) > 0 || c.Unsafe, "signature_algorithms must not be empty")
+		check(algorithms[c.SigningAlgorithm], "signing_algorithm %q must be one of signature_algorithms", c.SigningAlgorithm)
+	}
+	check(c.LogFormat == "logfmt" || c.LogFormat == "json", "log_format must be logfmt or json, not %q", c.LogFormat)
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout must not be negative")
+	check(c.CoalesceTimeout >= 0, "coalesce_timeout must not be negative")
+	check(c.Concurrency >= 1, "concurrency must be at least 1")
+	check(c.QueueDepth >= 0, "queue_depth must not be negative")
+	check(c.QueueTimeout > 0, "queue_timeout must be positive")
+	check(c.ConnectTimeout > 0, "connect_timeout must be positive")
+	check(c.FetchTimeout > 0, "fetch_timeout must be positive")
+	check(c.MaxSourceBytes >= 0, "max_source_bytes must not be negative")
+	check(c.MaxSourcePixels >= 0, "max_source_pixels must not be negative")
+	if _, err := parseAllowedSourceHosts(c.AllowedSourceHosts); err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, name := range sortedStringKeys(c.Origins) {
+		check(name != "", "origin names must not be empty")
+		check(!strings.ContainsAny(name, "/:"), "origin name %q must not contain / or :", name)
+		if err := checkLoaderTarget(c.Origins[name]); err != nil {
+			errs = append(errs, fmt.Sprintf("origin %s: %s", name, err))
+		}
+	}
+	if _, err := parsePresets(c.Presets); err != nil {
+		errs = append(errs, err.Error())
+	}
+	check(!c.PresetsOnly || len(c.Presets) > 0, "presets_only requires presets")
+	check(c.ResultCacheBytes >= 0, "result_cache_bytes must not be negative")
+	check(c.ResultCacheTTL >= 0, "result_cache_ttl must not be negative")
+	switch c.SourceCache {
+	case "", "none":
+	case "memory":
+		check(c.SourceCacheBytes > 0, "source_cache memory requires source_cache_bytes")
+	case "file":
+		check(c.SourceCacheBytes > 0, "source_cache file requires source_cache_bytes")
+		check(c.SourceCachePath != "", "source_cache file requires source_cache_path")
+	case "storage":
+		check(c.ResultStorage != "" && c.ResultStorage != "none", "source_cache storage requires result_storage")
+	default:
+		errs = append(errs, fmt.Sprintf("source_cache must be memory, file, storage or none, not %q", c.SourceCache))
+	}
+	check(c.SourceCacheTTL >= 0, "source_cache_ttl must not be negative")
+
+	switch c.ResultStorage {
+	case "", "none", "memory":
+	case "s3":
+		check(c.ResultStorageBucket != "", "result_storage s3 requires result_storage_bucket")
+	case "file":
+		check(c.ResultStoragePath != "", "result_storage file requires result_storage_path")
+	default:
+		errs = append(errs, fmt.Sprintf("result_storage must be s3, file, memory or none, not %q", c.ResultStorage))
+	}
+	check(c.ResultStorageLayout == "" || c.ResultStorageLayout == "raw" || c.ResultStorageLayout == "hashed",
+		"result_storage_layout must be raw or hashed, not %q", c.ResultStorageLayout)
+	check(!strings.Contains("/"+c.ResultStorageRoot+"/", "/../"), "result_storage_root must not contain ..")
+	check(c.ResultTTL >= 0, "result_ttl must not be negative")
+	check(c.StaleWhileRevalidate >= 0, "stale_while_revalidate must not be negative")
+	check(c.StaleIfError >= 0, "stale_if_error must not be negative")
+	if c.PurgeWebhook != "" {
+		check(c.AdminKey != "", "purge_webhook requires admin_key")
+		u, err := url.Parse(c.PurgeWebhook)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "purge_webhook must be an http(s) URL")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	return nil
+}
+
+// apply installs the configuration into the package settings and builds
+// the clients, pool and loaders it describes.
+func (c *Config) apply() error {
+	listenInterface = c.Listen
+	maxAge = c.MaxAge
+	resultTTL = time.Duration(c.ResultTTL)
+	staleWhileRevalidate = time.Duration(c.StaleWhileRevalidate)
+	staleIfError = time.Duration(c.StaleIfError)
+	adminKey = c.AdminKey
+	cdnPurger = nil
+	if c.PurgeWebhook != "" {
+		cdnPurger = newWebhookPurgeHook(c.PurgeWebhook)
+	}
+	autoFormats = nil
+	if c.AutoAVIF {
+		if !bimg.IsTypeSupportedSave(bimg.AVIF) {
+			return errors.New("auto_avif is set but libvips can't encode AVIF")
+		}
+		autoFormats = append(autoFormats, bimg.AVIF)
+	}
+	if c.AutoWebP {
+		if !bimg.IsTypeSupportedSave(bimg.WEBP) {
+			return errors.New("auto_webp is set but libvips can't encode WebP")
+		}
+		autoFormats = append(autoFormats, bimg.WEBP)
+	}
+	shutdownTimeout = time.Duration(c.ShutdownTimeout)
+	coalesceTimeout = time.Duration(c.CoalesceTimeout)
+
+	processingPool = newWorkerPool(c.Concurrency, c.QueueDepth, time.Duration(c.QueueTimeout))
+	cachedResults = nil
+	if c.ResultCacheBytes > 0 {
+		cachedResults = newResultCache(c.ResultCacheBytes, time.Duration(c.ResultCacheTTL))
+	}
+
+	err := c.applyRenderSettings()
+	if err != nil {
+		return err
+	}
+	if origins, err = newOrigins(c.Origins); err != nil {
+		return err
+	}
+	if sourceBuckets, err = newSourceBuckets(c.SourceS3Buckets); err != nil {
+		return err
+	}
+	if resultStorage, err = newResultStorage(c); err != nil {
+		return err
+	}
+	resultLayout = keyLayout{}
+	if resultStorage != nil {
+		if resultLayout, err = newKeyLayout(c.ResultStorageLayout, c.ResultStorageRoot); err != nil {
+			return err
+		}
+		resultStorage = instrumentedStorage{layoutStorage{resultStorage, resultLayout}}
+	}
+	if cachedSources, err = newSourceCache(c, resultStorage); err != nil {
+		return err
+	}
+	return nil
+}
+
+// applyRenderSettings installs only the settings used to check and render
+// a source that has already been loaded, for commands that render local
+// files. That includes fetching watermarks, with the same safeguards as the
+// server, but it sets up no loaders or storage.
+func (c *Config) applyRenderSettings() error {
+	logFormat = c.LogFormat
+	maxSourceBytes = c.MaxSourceBytes
+	maxSourcePixels = c.MaxSourcePixels
+	allowedSourceTypes = parseAllowedSourceTypes(c.AllowedSourceTypes)
+	allowPrivateSources = c.AllowPrivateSources
+	httpClient = newSourceClient(time.Duration(c.ConnectTimeout), time.Duration(c.FetchTimeout))
+	var err error
+	if allowedSourceHosts, err = parseAllowedSourceHosts(c.AllowedSourceHosts); err != nil {
+		return err
+	}
+	return c.applyURLSettings()
+}
+
+// applyURLSettings installs only the settings used to parse, sign and
+// verify URLs, for commands that don't serve images.
+func (c *Config) applyURLSettings() error {
+	unsafeMode = c.Unsafe
+	presetsOnly = c.PresetsOnly
+	var err error
+	if presets, err = parsePresets(c.Presets); err != nil {
+		return err
+	}
+	if securityKeys, err = parseSecurityKeys(c.SecurityKey, c.SecurityKeys); err != nil {
+		return err
+	}
+	if acceptedAlgorithms, err = parseSignatureAlgorithms(c.SignatureAlgorithms); err != nil {
+		return err
+	}
+	signingAlgorithm = c.SigningAlgorithm
+	return nil
+}
+
+// redacted returns a copy of c that is safe to print.
+func (c *Config) redacted() *Config {
+	r := *c
+	if r.SecurityKey != "" {
+		r.SecurityKey = "REDACTED"
+	}
+	if r.AdminKey != "" {
+		r.AdminKey = "REDACTED"
+	}
+	if r.PurgeWebhook != "" {
+		r.PurgeWebhook = redactURL(r.PurgeWebhook)
+	}
+	if len(c.Origins) > 0 {
+		r.Origins = make(map[string]string)
+		for name, target := range c.Origins {
+			r.Origins[name] = redactURL(target)
+		}
+	}
+	r.SecurityKeys = nil
+	for _, entry := range c.SecurityKeys {
+		if id, _ := splitKeyEntry(entry); id != "" {
+			r.SecurityKeys = append(r.SecurityKeys, id+"=REDACTED")
+		} else {
+			r.SecurityKeys = append(r.SecurityKeys, "REDACTED")
+		}
+	}
+	return &r
+}
+
+// redactURL hides the credentials a URL may carry in its userinfo or query
+// string.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "REDACTED"
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.String()
+}
+
+// runConfigCommand implements "gothumb config print", which prints the
+// effective configuration with secrets redacted.
+func runConfigCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: gothumb config print [flags]")
+		os.Exit(2)
+	}
+	c, err := loadConfig("gothumb config print", args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out, err := json.MarshalIndent(c.redacted(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", out)
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Duration is a time.Duration that is written as a string such as "10s" in
+// config files.
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// flag.Value implementations for the remaining Config field types. Lists
+// and maps are written as comma-separated values, and maps as name=value
+// pairs, in both flags and env vars. Presets are separated by semicolons
+// instead, since their options may contain commas.
+type (
+	stringValue string
+	intValue    int
+	int64Value  int64
+	boolValue   bool
+	stringList  []string
+	stringMap   map[string]string
+	presetMap   map[string]string
+)
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", s)
+	}
+	*v = intValue(n)
+	return nil
+}
+
+func (v *int64Value) String() string { return strconv.FormatInt(int64(*v), 10) }
+func (v *int64Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", s)
+	}
+	*v = int64Value(n)
+	return nil
+}
+
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", s)
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+func (v *stringList) String() string { return strings.Join(*v, ",") }
+func (v *stringList) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+func (v *stringMap) String() string { return formatPairs(*v, ",") }
+func (v *stringMap) Set(s string) (err error) {
+	*v, err = parsePairs(s, ",")
+	return err
+}
+
+func (v *presetMap) String() string { return formatPairs(*v, ";") }
+func (v *presetMap) Set(s string) (err error) {
+	*v, err = parsePairs(s, ";")
+	return err
+}
+
+func formatPairs(m map[string]string, sep string) string {
+	var pairs []string
+	for _, key := range sortedStringKeys(m) {
+		pairs = append(pairs, key+"="+m[key])
+	}
+	return strings.Join(pairs, sep)
+}
+
+func parsePairs(s, sep string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, sep) {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid name=value pair %q", pair)
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
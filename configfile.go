@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// parseYAMLConfig and parseTOMLConfig decode a config file into the same
+// generic form encoding/json produces, so that all three formats are decoded
+// by Config.loadFile in the same way.
+
+// parseYAMLConfig decodes YAML strictly, so that a setting given twice is an
+// error rather than the last one silently winning.
+func parseYAMLConfig(data []byte) (map[string]interface{}, error) {
+	var values map[string]interface{}
+	if err := yaml.UnmarshalStrict(data, &values); err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		v, err := stringKeys(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		values[key] = v
+	}
+	return values, nil
+}
+
+// stringKeys converts the map[interface{}]interface{} YAML decodes nested
+// maps into to map[string]interface{}, which encoding/json can marshal.
+func stringKeys(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", key)
+			}
+			var err error
+			if m[name], err = stringKeys(item); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		for i, item := range v {
+			var err error
+			if v[i], err = stringKeys(item); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
+
+func parseTOMLConfig(data []byte) (map[string]interface{}, error) {
+	var values map[string]interface{}
+	if _, err := toml.Decode(string(data), &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
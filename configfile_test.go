@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAMLConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want map[string]interface{}
+	}{
+		{"scalars", "listen: :8888\nmax_age: 3600\nunsafe: true\nratio: 1.5\nnothing: ~\n",
+			map[string]interface{}{"listen": ":8888", "max_age": 3600, "unsafe": true, "ratio": 1.5, "nothing": nil}},
+		{"comments and quoting", "---\n# a comment\na: \"x # not a comment\" # trailing\nb: 'it''s'\nurl: http://example.com/#anchor\n",
+			map[string]interface{}{"a": "x # not a comment", "b": "it's", "url": "http://example.com/#anchor"}},
+		{"lists", "a: [x, \"y, z\", 3]\nhosts:\n- a.example.com\n- b.example.com\n",
+			map[string]interface{}{"a": []interface{}{"x", "y, z", 3}, "hosts": []interface{}{"a.example.com", "b.example.com"}}},
+		{"maps", "origins:\n  photos: https://photos.example.com\npresets: {card: fit-in/300x200}\n",
+			map[string]interface{}{
+				"origins": map[string]interface{}{"photos": "https://photos.example.com"},
+				"presets": map[string]interface{}{"card": "fit-in/300x200"},
+			}},
+		{"block scalars and anchors", "key: |\n  line one\n  line two\nbase: &base\n  photos: https://photos.example.com\norigins: *base\n",
+			map[string]interface{}{
+				"key":     "line one\nline two\n",
+				"base":    map[string]interface{}{"photos": "https://photos.example.com"},
+				"origins": map[string]interface{}{"photos": "https://photos.example.com"},
+			}},
+		{"empty", "", nil},
+	}
+	for _, c := range cases {
+		got, err := parseYAMLConfig([]byte(c.in))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s:\n got %#v\nwant %#v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseYAMLConfigErrors(t *testing.T) {
+	cases := []struct{ name, in, err string }{
+		{"duplicate key", "a: 1\nb: 2\na: 3\n", `key "a" already set`},
+		{"top-level list", "- a\n", "cannot unmarshal !!seq"},
+		{"unterminated string", "a: \"open\n", "line 2"},
+		{"non-string key", "origins:\n  1: x\n", "origins: key 1 is not a string"},
+	}
+	for _, c := range cases {
+		got, err := parseYAMLConfig([]byte(c.in))
+		if err == nil {
+			t.Errorf("%s: parsed as %#v, want an error", c.name, got)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error %q doesn't mention %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestParseTOMLConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want map[string]interface{}
+	}{
+		{"scalars", "listen = \":8888\"\nmax_age = 3_600\nunsafe = true\nratio = 1.5\n",
+			map[string]interface{}{"listen": ":8888", "max_age": int64(3600), "unsafe": true, "ratio": 1.5}},
+		{"comments and quoting", "# a comment\na = \"x # not a comment\" # trailing\nb = 'C:\\path'\nc = \"\"\"\nmulti\nline\"\"\"\n",
+			map[string]interface{}{"a": "x # not a comment", "b": `C:\path`, "c": "multi\nline"}},
+		{"arrays", "a = [\"x\", \"y, z\"]\nc = [\n  \"one\", # first\n  \"two\",\n]\n",
+			map[string]interface{}{"a": []interface{}{"x", "y, z"}, "c": []interface{}{"one", "two"}}},
+		{"tables", "listen = \":80\"\npresets = { card = \"fit-in/300x200\" }\n[origins]\nphotos = \"https://photos.example.com\"\n",
+			map[string]interface{}{
+				"listen":  ":80",
+				"origins": map[string]interface{}{"photos": "https://photos.example.com"},
+				"presets": map[string]interface{}{"card": "fit-in/300x200"},
+			}},
+	}
+	for _, c := range cases {
+		got, err := parseTOMLConfig([]byte(c.in))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s:\n got %#v\nwant %#v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseTOMLConfigErrors(t *testing.T) {
+	cases := []struct{ name, in, err string }{
+		{"duplicate key", "a = 1\na = 2\n", "'a' has already been defined"},
+		{"duplicate table", "[origins]\n[origins]\n", "'origins' has already been defined"},
+		{"bare string", "a = hello\n", "line 1"},
+		{"unterminated string", "a = \"open\n", "line 1"},
+	}
+	for _, c := range cases {
+		got, err := parseTOMLConfig([]byte(c.in))
+		if err == nil {
+			t.Errorf("%s: parsed as %#v, want an error", c.name, got)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error %q doesn't mention %q", c.name, err, c.err)
+		}
+	}
+}
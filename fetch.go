@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+var (
+	maxSourceBytes     int64
+	maxSourcePixels    int
+	allowedSourceTypes map[string]bool
+
+	// sourceFlights coalesces concurrent fetches of the same source, such
+	// as renders of several sizes of a new image, into one download.
+	sourceFlights = newFlightGroup()
+)
+
+// genericContentTypes are sent by origins that don't know what they are
+// serving; such sources are checked by sniffing the image data instead.
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// imageTypeMIME maps the formats bimg can detect to their MIME types.
+var imageTypeMIME = map[bimg.ImageType]string{
+	bimg.JPEG: "image/jpeg",
+	bimg.PNG:  "image/png",
+	bimg.GIF:  "image/gif",
+	bimg.WEBP: "image/webp",
+	bimg.TIFF: "image/tiff",
+	bimg.AVIF: "image/avif",
+	bimg.PDF:  "application/pdf",
+	bimg.SVG:  "image/svg+xml",
+}
+
+// newSourceClient returns the client used to fetch sources. connectTimeout
+// bounds establishing a connection and timeout bounds the whole fetch,
+// including reading the body.
+func newSourceClient(connectTimeout, timeout time.Duration) *http.Client {
+	// No proxy is used: connecting through one would bypass the private
+	// address checks done when dialing.
+	return &http.Client{
+		Timeout:       timeout,
+		CheckRedirect: checkSourceRedirect,
+		Transport: &http.Transport{
+			Dial:                newGuardedDialer(connectTimeout).Dial,
+			TLSHandshakeTimeout: connectTimeout,
+			MaxIdleConnsPerHost: 16,
+		},
+	}
+}
+
+// fetchSource downloads the image at sourceURL, enforcing the configured
+// size and content type limits. Failures are returned as *statusError. With
+// a source cache, fresh cached copies are used as they are and stale ones
+// are revalidated with the origin. Concurrent fetches of one source share a
+// single download.
+func fetchSource(sourceURL string) (*sourceImage, error) {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, &statusError{Code: 400, Message: "invalid source URL"}
+	}
+	if err = checkSourceHost(u); err != nil {
+		return nil, fetchError(err)
+	}
+	return sourceFlights.DoSource(sourceURL, func() (*sourceImage, error) {
+		return downloadSource(sourceURL)
+	})
+}
+
+// downloadSource does the work of fetchSource for a source URL that has
+// been checked.
+func downloadSource(sourceURL string) (*sourceImage, error) {
+	cached := cachedSources.get(sourceURL)
+	if cached != nil && cachedSources.fresh(cached) {
+		sourceCacheLookups.Inc("hit")
+		return cached.source(), cached.check()
+	}
+
+	req, err := http.NewRequest("GET", sourceURL, nil)
+	if err != nil {
+		return nil, &statusError{Code: 400, Message: "invalid source URL"}
+	}
+	if cached != nil {
+		cached.setValidators(req)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 304 && cached != nil {
+		sourceCacheLookups.Inc("revalidated")
+		h := cached.validators(resp.Header)
+		cachedSources.refresh(sourceURL, cached, h)
+		return &sourceImage{Data: cached.data, ETag: h.Get("ETag"), LastModified: h.Get("Last-Modified")}, cached.check()
+	}
+	if resp.StatusCode != 200 {
+		return nil, originStatusError("source", resp.StatusCode)
+	}
+
+	if maxSourceBytes > 0 && resp.ContentLength > maxSourceBytes {
+		return nil, sourceTooLargeError()
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !genericContentTypes[mediaType] && !allowedSourceType(mediaType) {
+		return nil, &statusError{Code: 415, Message: fmt.Sprintf("source content type %q is not allowed", mediaType)}
+	}
+
+	img, err := readSource(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if genericContentTypes[mediaType] {
+		if err = checkSourceType(img); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case cached != nil:
+		sourceCacheLookups.Inc("changed")
+	case cachedSources != nil:
+		sourceCacheLookups.Inc("miss")
+	}
+	cachedSources.put(sourceURL, img, mediaType, resp.Header)
+	return &sourceImage{Data: img, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, nil
+}
+
+// readSource reads a source body, failing with a 413 once it exceeds
+// maxSourceBytes.
+func readSource(r io.Reader) ([]byte, error) {
+	if maxSourceBytes > 0 {
+		r = io.LimitReader(r, maxSourceBytes+1)
+	}
+	img, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	if maxSourceBytes > 0 && int64(len(img)) > maxSourceBytes {
+		return nil, sourceTooLargeError()
+	}
+	return img, nil
+}
+
+// checkSourceType sniffs the format of img and checks it against
+// allowedSourceTypes.
+func checkSourceType(img []byte) error {
+	sniffed := imageTypeMIME[bimg.DetermineImageType(img)]
+	if sniffed == "" || !allowedSourceType(sniffed) {
+		return &statusError{Code: 415, Message: "source is not an allowed image type"}
+	}
+	return nil
+}
+
+// checkSourcePixels rejects images whose dimensions exceed maxSourcePixels.
+// Only the image header is read, so this is cheap to run before decoding.
+func checkSourcePixels(img []byte) error {
+	if maxSourcePixels <= 0 {
+		return nil
+	}
+	size, err := bimg.Size(img)
+	if err != nil {
+		return &statusError{Code: 415, Message: fmt.Sprintf("reading source dimensions: %s", err)}
+	}
+	if size.Width*size.Height > maxSourcePixels {
+		return &statusError{Code: 422, Message: fmt.Sprintf("source is %dx%d, more than %d pixels", size.Width, size.Height, maxSourcePixels)}
+	}
+	return nil
+}
+
+func allowedSourceType(mediaType string) bool {
+	return len(allowedSourceTypes) == 0 || allowedSourceTypes[mediaType]
+}
+
+func parseAllowedSourceTypes(mediaTypes []string) map[string]bool {
+	types := make(map[string]bool)
+	for _, t := range mediaTypes {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types[t] = true
+		}
+	}
+	return types
+}
+
+func sourceTooLargeError() *statusError {
+	return &statusError{Code: 413, Message: fmt.Sprintf("source is larger than %d bytes", maxSourceBytes)}
+}
+
+// originStatusError maps an origin's unsuccessful response status onto the
+// one gothumb answers with: a 404 when the source is missing or gone, and a
+// 502 for anything else, since redirects, origin auth failures and origin
+// errors aren't the client's to see.
+func originStatusError(origin string, code int) *statusError {
+	if code == 404 || code == 410 {
+		return &statusError{Code: 404, Message: fmt.Sprintf("source not found: %s responded %d", origin, code)}
+	}
+	return &statusError{Code: 502, Message: fmt.Sprintf("unexpected status code from %s: %d", origin, code)}
+}
+
+// fetchError maps a transport error onto a 403 for blocked sources, a 504
+// for timeouts and a 502 for anything else.
+func fetchError(err error) error {
+	if berr, ok := asBlockedSourceError(err); ok {
+		return &statusError{Code: 403, Message: berr.Error()}
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return &statusError{Code: 504, Message: fmt.Sprintf("fetching source: %s", err)}
+	}
+	return &statusError{Code: 502, Message: fmt.Sprintf("fetching source: %s", err)}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jpegData starts like a JPEG, which is all format sniffing looks at.
+var jpegData = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+
+// useSourceSettings installs source fetch settings for a test, and returns
+// a func that restores the previous ones.
+func useSourceSettings(maxBytes int64, timeout time.Duration) func() {
+	client, bytes, types, private, cache := httpClient, maxSourceBytes, allowedSourceTypes, allowPrivateSources, cachedSources
+	allowPrivateSources = true
+	httpClient = newSourceClient(time.Second, timeout)
+	maxSourceBytes = maxBytes
+	allowedSourceTypes = parseAllowedSourceTypes(defaultConfig().AllowedSourceTypes)
+	cachedSources = nil
+	return func() {
+		httpClient, maxSourceBytes, allowedSourceTypes, allowPrivateSources, cachedSources = client, bytes, types, private, cache
+	}
+}
+
+func TestOriginStatusError(t *testing.T) {
+	cases := []struct{ code, want int }{
+		{404, 404},
+		{410, 404},
+		{301, 502},
+		{304, 502},
+		{400, 502},
+		{401, 502},
+		{403, 502},
+		{429, 502},
+		{500, 502},
+		{503, 502},
+	}
+	for _, c := range cases {
+		if got := originStatusError("source", c.code); got.Code != c.want {
+			t.Errorf("originStatusError(%d) = %d, want %d", c.code, got.Code, c.want)
+		}
+	}
+}
+
+func TestFetchSource(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/a.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(jpegData)
+		case "/generic.jpg":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(jpegData)
+		case "/page.jpg":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("<html><body>not an image</body></html>"))
+		case "/a.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write(jpegData)
+		case "/large.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(append(jpegData, make([]byte, 100)...))
+		case "/chunked.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(jpegData)
+			w.(http.Flusher).Flush()
+			w.Write(make([]byte, 100))
+		case "/slow.jpg":
+			<-unblock
+		case "/moved.jpg":
+			w.WriteHeader(301)
+		default:
+			code := 404
+			switch req.URL.Path {
+			case "/gone.jpg":
+				code = 410
+			case "/private.jpg":
+				code = 403
+			case "/broken.jpg":
+				code = 500
+			}
+			w.WriteHeader(code)
+		}
+	}))
+	defer srv.Close()
+	defer close(unblock)
+	defer useSourceSettings(int64(len(jpegData)+50), 100*time.Millisecond)()
+
+	cases := []struct {
+		path string
+		code int
+	}{
+		{"/a.jpg", 0},
+		{"/generic.jpg", 0},
+		{"/page.jpg", 415},
+		{"/a.html", 415},
+		{"/large.jpg", 413},
+		{"/chunked.jpg", 413},
+		{"/slow.jpg", 504},
+		{"/missing.jpg", 404},
+		{"/gone.jpg", 404},
+		{"/private.jpg", 502},
+		{"/broken.jpg", 502},
+		{"/moved.jpg", 502},
+	}
+	for _, c := range cases {
+		src, err := fetchSource(srv.URL + c.path)
+		code := 0
+		if err != nil {
+			serr, ok := err.(*statusError)
+			if !ok {
+				t.Errorf("%s: %#v is not a statusError", c.path, err)
+				continue
+			}
+			code = serr.Code
+		}
+		if code != c.code {
+			t.Errorf("%s: status %d (%v), want %d", c.path, code, err, c.code)
+		}
+		if code == 0 && string(src.Data) != string(jpegData) {
+			t.Errorf("%s: got %q", c.path, src.Data)
+		}
+	}
+
+	src, err := fetchSource(srv.URL + "/a.jpg")
+	if err != nil || src.ETag != `"v1"` {
+		t.Errorf("ETag of a fetched source = %q, %v", src.ETag, err)
+	}
+}
+
+func TestFetchSourcePrivate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(jpegData)
+	}))
+	defer srv.Close()
+	defer useSourceSettings(0, time.Second)()
+	allowPrivateSources = false
+	httpClient = newSourceClient(time.Second, time.Second)
+
+	_, err := fetchSource(srv.URL + "/a.jpg")
+	if serr, ok := err.(*statusError); !ok || serr.Code != 403 || !strings.Contains(serr.Message, "private address") {
+		t.Errorf("fetching from loopback = %v, want a 403", err)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// A filter is one validated name(args) call from a request's filters:
+// segment. Filters are applied in URL order on top of the bimg options
+// derived from the rest of the URL.
+type filter interface {
+	// String returns the canonical name(args) form of the filter, which is
+	// what ends up in the result path.
+	String() string
+	apply(o *bimg.Options, opts *imageOptions) error
+}
+
+// A pixelFilter is a filter bimg has no option for. Its pixels are changed
+// directly once the image is resized, which is only correct for filters
+// that change each pixel on its own.
+type pixelFilter interface {
+	filter
+	adjust(img *image.NRGBA)
+}
+
+// newFilterFunc validates raw URL arguments and returns the filter they
+// describe.
+type newFilterFunc func(args []string) (filter, error)
+
+var filterRegistry = map[string]newFilterFunc{
+	"background_color": newBackgroundColorFilter,
+	"blur":             newBlurFilter,
+	"brightness":       newBrightnessFilter,
+	"contrast":         newContrastFilter,
+	"fill":             newFillFilter,
+	"format":           newFormatFilter,
+	"grayscale":        newGrayscaleFilter,
+	"quality":          newQualityFilter,
+	"rotate":           newRotateFilter,
+	"sharpen":          newSharpenFilter,
+	"strip_exif":       newStripExifFilter,
+	"watermark":        newWatermarkFilter,
+}
+
+// newFilter looks up the named filter in filterRegistry and validates args
+// against it.
+func newFilter(name string, args []string) (filter, error) {
+	newFunc, ok := filterRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown filter %q", name)
+	}
+	f, err := newFunc(args)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s filter: %s", name, err)
+	}
+	return f, nil
+}
+
+func checkArgCount(args []string, min, max int) error {
+	if len(args) < min || len(args) > max {
+		if min == max {
+			return fmt.Errorf("expected %d arguments, got %d", min, len(args))
+		}
+		return fmt.Errorf("expected %d to %d arguments, got %d", min, max, len(args))
+	}
+	return nil
+}
+
+func parseIntArg(arg string, min, max int) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q", arg)
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("%d is out of range [%d, %d]", n, min, max)
+	}
+	return n, nil
+}
+
+func parseFloatArg(arg string, min, max float64) (float64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", arg)
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("%g is out of range [%g, %g]", n, min, max)
+	}
+	return n, nil
+}
+
+func formatFloat(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// parseColor parses a hex color of the form RGB or RRGGBB, with or without a
+// leading "#".
+func parseColor(arg string) (bimg.Color, error) {
+	hex := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(arg)), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return bimg.Color{}, fmt.Errorf("invalid color %q", arg)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return bimg.Color{}, fmt.Errorf("invalid color %q", arg)
+	}
+	return bimg.Color{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb)}, nil
+}
+
+func formatColor(c bimg.Color) string {
+	return fmt.Sprintf("%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// quality(amount) sets the output quality, 0-100.
+type qualityFilter struct{ quality int }
+
+func newQualityFilter(args []string) (filter, error) {
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	q, err := parseIntArg(args[0], 0, 100)
+	if err != nil {
+		return nil, err
+	}
+	return qualityFilter{q}, nil
+}
+
+func (f qualityFilter) String() string { return fmt.Sprintf("quality(%d)", f.quality) }
+
+func (f qualityFilter) apply(o *bimg.Options, opts *imageOptions) error {
+	o.Quality = f.quality
+	return nil
+}
+
+// format(name) sets the output image format.
+type formatFilter struct{ format bimg.ImageType }
+
+var formatNames = map[string]bimg.ImageType{
+	"jpeg": bimg.JPEG,
+	"jpg":  bimg.JPEG,
+	"png":  bimg.PNG,
+	"webp": bimg.WEBP,
+	"tiff": bimg.TIFF,
+	"avif": bimg.AVIF,
+}
+
+func newFormatFilter(args []string) (filter, error) {
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	t, ok := formatNames[strings.ToLower(strings.TrimSpace(args[0]))]
+	if !ok {
+		return nil, fmt.Errorf("unsupported format %q", args[0])
+	}
+	return formatFilter{t}, nil
+}
+
+func (f formatFilter) String() string {
+	return fmt.Sprintf("format(%s)", bimg.ImageTypeName(f.format))
+}
+
+func (f formatFilter) apply(o *bimg.Options, opts *imageOptions) error {
+	o.Type = f.format
+	return nil
+}
+
+// blur(radius[,sigma]) applies a gaussian blur. sigma defaults to radius.
+type blurFilter struct{ radius, sigma float64 }
+
+func newBlurFilter(args []string) (filter, error) {
+	if err := checkArgCount(args, 1, 2); err != nil {
+		return nil, err
+	}
+	radius, err := parseFloatArg(args[0], 0, 150)
+	if err != nil {
+		return nil, err
+	}
+	sigma := radius
+	if len(args) == 2 {
+		if sigma, err = parseFloatArg(args[1], 0, 150); err != nil {
+			return nil, err
+		}
+	}
+	return blurFilter{radius, sigma}, nil
+}
+
+func (f blurFilter) String() string {
+	if f.sigma == f.radius {
+		return fmt.Sprintf("blur(%s)", formatFloat(f.radius))
+	}
+	return fmt.Sprintf("blur(%s,%s)", formatFloat(f.radius), formatFloat(f.sigma))
+}
+
+// apply blurs with a kernel reaching out radius pixels. libvips sizes the
+// kernel by the smallest amplitude it keeps, which is the amplitude the
+// gaussian falls to at radius.
+func (f blurFilter) apply(o *bimg.Options, opts *imageOptions) error {
+	if f.radius > 0 && f.sigma > 0 {
+		minAmpl := math.Exp(-f.radius * f.radius / (2 * f.sigma * f.sigma))
+		o.GaussianBlur = bimg.GaussianBlur{Sigma: f.sigma, MinAmpl: math.Max(minAmpl, 0.001)}
+	}
+	return nil
+}
+
+// sharpen(amount,radius,luminance_only) sharpens the image. libvips always
+// sharpens the luminance channel only, so the last argument is accepted for
+// compatibility and otherwise ignored.
+type sharpenFilter struct {
+	amount float64
+	radius int
+}
+
+func newSharpenFilter(args []string) (filter, error) {
+	if err := checkArgCount(args, 2, 3); err != nil {
+		return nil, err
+	}
+	amount, err := parseFloatArg(args[0], 0, 10)
+	if err != nil {
+		return nil, err
+	}
+	radius, err := parseIntArg(args[1], 1, 50)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 3 {
+		if _, err := strconv.ParseBool(strings.TrimSpace(args[2])); err != nil {
+			return nil, fmt.Errorf("invalid boolean %q", args[2])
+		}
+	}
+	return sharpenFilter{amount, radius}, nil
+}
+
+func (f sharpenFilter) String() string {
+	return fmt.Sprintf("sharpen(%s,%d)", formatFloat(f.amount), f.radius)
+}
+
+func (f sharpenFilter) apply(o *bimg.Options, opts *imageOptions) error {
+	o.Sharpen = bimg.Sharpen{Radius: f.radius, X1: 2, Y2: 10, Y3: 20, M1: 0, M2: f.amount}
+	return nil
+}
+
+// grayscale() converts the image to black and white.
+type grayscaleFilter struct{}
+
+func newGrayscaleFilter(args []string) (filter, error) {
+	return grayscaleFilter{}, checkArgCount(args, 0, 0)
+}
+
+func (grayscaleFilter) String() string { return "grayscale()" }
+
+func (grayscaleFilter) apply(o *bimg.Options, opts *imageOptions) error {
+	o.Interpretation = bimg.InterpretationBW
+	return nil
+}
+
+// brightness(amount) adds amount percent of full brightness, -100 to 100,
+// to each color channel.
+type brightnessFilter struct{ amount int }
+
+func newBrightnessFilter(args []string) (filter, error) {
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	amount, err := parseIntArg(args[0], -100, 100)
+	if err != nil {
+		return nil, err
+	}
+	return brightnessFilter{amount}, nil
+}
+
+func (f brightnessFilter) String() string { return fmt.Sprintf("brightness(%d)", f.amount) }
+
+func (brightnessFilter) apply(o *bimg.Options, opts *imageOptions) error { return nil }
+
+func (f brightnessFilter) adjust(img *image.NRGBA) {
+	offset := float64(f.amount) * 255 / 100
+	adjustChannels(img, func(c float64) float64 { return c + offset })
+}
+
+// contrast(amount) scales the distance of each color channel from the
+// middle by 1+amount/100, with amount from -100 (flat gray) to 100 (twice
+// the contrast).
+type contrastFilter struct{ amount int }
+
+func newContrastFilter(args []string) (filter, error) {
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	amount, err := parseIntArg(args[0], -100, 100)
+	if err != nil {
+		return nil, err
+	}
+	return contrastFilter{amount}, nil
+}
+
+func (f contrastFilter) String() string { return fmt.Sprintf("contrast(%d)", f.amount) }
+
+func (contrastFilter) apply(o *bimg.Options, opts *imageOptions) error { return nil }
+
+func (f contrastFilter) adjust(img *image.NRGBA) {
+	scale := 1 + float64(f.amount)/100
+	adjustChannels(img, func(c float64) float64 { return (c-127.5)*scale + 127.5 })
+}
+
+// adjustChannels maps the red, green and blue channels of every pixel of img
+// through fn, clamping the results. Alpha is left alone.
+func adjustChannels(img *image.NRGBA, fn func(float64) float64) {
+	var lookup [256]uint8
+	for i := range lookup {
+		lookup[i] = uint8(math.Max(0, math.Min(255, math.Floor(fn(float64(i))+0.5))))
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			row[i], row[i+1], row[i+2] = lookup[row[i]], lookup[row[i+1]], lookup[row[i+2]]
+		}
+	}
+}
+
+// rotate(angle) rotates the image by a multiple of 90 degrees.
+type rotateFilter struct{ angle int }
+
+func newRotateFilter(args []string) (filter, error) {
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	angle, err := parseIntArg(args[0], -360, 360)
+	if err != nil {
+		return nil, err
+	}
+	if angle%90 != 0 {
+		return nil, fmt.Errorf("angle must be a multiple of 90")
+	}
+	return rotateFilter{(angle + 360) % 360}, nil
+}
+
+func (f rotateFilter) String() string { return fmt.Sprintf("rotate(%d)", f.angle) }
+
+func (f rotateFilter) apply(o *bimg.Options, opts *imageOptions) error {
+	o.Rotate = bimg.Angle(f.angle)
+	return nil
+}
+
+// background_color(color) sets the color transparent images are flattened
+// onto.
+type backgroundColorFilter struct{ color bimg.Color }
+
+func newBackgroundColorFilter(args []string) (filter, error) {
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	c, err := parseColor(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return backgroundColorFilter{c}, nil
+}
+
+func (f backgroundColorFilter) String() string {
+	return fmt.Sprintf("background_color(%s)", formatColor(f.color))
+}
+
+func (f backgroundColorFilter) apply(o *bimg.Options, opts *imageOptions) error {
+	o.Background = f.color
+	return nil
+}
+
+// fill(color) pads a fit-in image out to the requested size with color.
+type fillFilter struct{ color bimg.Color }
+
+func newFillFilter(args []string) (filter, error) {
+	if err := checkArgCount(args, 1, 1); err != nil {
+		return nil, err
+	}
+	c, err := parseColor(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return fillFilter{c}, nil
+}
+
+func (f fillFilter) String() string { return fmt.Sprintf("fill(%s)", formatColor(f.color)) }
+
+func (f fillFilter) apply(o *bimg.Options, opts *imageOptions) error {
+	if !opts.FitIn || opts.Width == 0 || opts.Height == 0 {
+		return nil
+	}
+	o.Width, o.Height = int(opts.Width), int(opts.Height)
+	o.Embed = true
+	o.Extend = bimg.ExtendBackground
+	o.Background = f.color
+	return nil
+}
+
+// strip_exif() removes EXIF and other metadata from the output.
+type stripExifFilter struct{}
+
+func newStripExifFilter(args []string) (filter, error) {
+	return stripExifFilter{}, checkArgCount(args, 0, 0)
+}
+
+func (stripExifFilter) String() string { return "strip_exif()" }
+
+func (stripExifFilter) apply(o *bimg.Options, opts *imageOptions) error {
+	o.StripMetadata = true
+	return nil
+}
+
+// watermark(url,x,y,alpha) overlays the image at url with its top-left corner
+// at x,y. alpha is the watermark's transparency, 0 (opaque) to 100.
+type watermarkFilter struct {
+	url   string
+	x, y  int
+	alpha int
+}
+
+func newWatermarkFilter(args []string) (filter, error) {
+	if err := checkArgCount(args, 4, 4); err != nil {
+		return nil, err
+	}
+	u := strings.TrimSpace(args[0])
+	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return nil, fmt.Errorf("invalid watermark URL %q", u)
+	}
+	x, err := parseIntArg(args[1], 0, bimg.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	y, err := parseIntArg(args[2], 0, bimg.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	alpha, err := parseIntArg(args[3], 0, 100)
+	if err != nil {
+		return nil, err
+	}
+	return watermarkFilter{u, x, y, alpha}, nil
+}
+
+func (f watermarkFilter) String() string {
+	return fmt.Sprintf("watermark(%s,%d,%d,%d)", f.url, f.x, f.y, f.alpha)
+}
+
+func (f watermarkFilter) apply(o *bimg.Options, opts *imageOptions) error {
+	mark, err := fetchSource(f.url)
+	if serr, ok := err.(*statusError); ok {
+		return &statusError{Code: serr.Code, Message: "fetching watermark: " + serr.Message, RetryAfter: serr.RetryAfter}
+	}
+	if err != nil {
+		return fmt.Errorf("fetching watermark: %s", err)
+	}
+	o.WatermarkImage = bimg.WatermarkImage{
+		Left:    f.x,
+		Top:     f.y,
+		Buf:     mark.Data,
+		Opacity: 1 - float32(f.alpha)/100,
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestNewFilter(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"quality", []string{" 80 "}, "quality(80)"},
+		{"format", []string{"JPG"}, "format(jpeg)"},
+		{"format", []string{"webp"}, "format(webp)"},
+		{"format", []string{"AVIF"}, "format(avif)"},
+		{"blur", []string{"5"}, "blur(5)"},
+		{"blur", []string{"5", "2.5"}, "blur(5,2.5)"},
+		{"blur", []string{"5", "5"}, "blur(5)"},
+		{"sharpen", []string{"1.5", "2", "true"}, "sharpen(1.5,2)"},
+		{"grayscale", nil, "grayscale()"},
+		{"brightness", []string{"-40"}, "brightness(-40)"},
+		{"contrast", []string{"25"}, "contrast(25)"},
+		{"rotate", []string{"-90"}, "rotate(270)"},
+		{"rotate", []string{"360"}, "rotate(0)"},
+		{"background_color", []string{"#FFF"}, "background_color(ffffff)"},
+		{"fill", []string{"00ff7f"}, "fill(00ff7f)"},
+		{"strip_exif", nil, "strip_exif()"},
+		{"watermark", []string{"https://example.com/m.png", "10", "20", "50"}, "watermark(https://example.com/m.png,10,20,50)"},
+	}
+	for _, c := range cases {
+		f, err := newFilter(c.name, c.args)
+		if err != nil {
+			t.Errorf("%s%q: %v", c.name, c.args, err)
+			continue
+		}
+		if got := f.String(); got != c.want {
+			t.Errorf("%s%q = %s, want %s", c.name, c.args, got, c.want)
+		}
+	}
+}
+
+func TestNewFilterErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+	}{
+		{"nosuch", nil},
+		{"quality", nil},
+		{"quality", []string{"101"}},
+		{"quality", []string{"high"}},
+		{"format", []string{"gif"}},
+		{"blur", []string{"151"}},
+		{"blur", []string{"1", "2", "3"}},
+		{"sharpen", []string{"1", "0"}},
+		{"sharpen", []string{"1", "2", "maybe"}},
+		{"grayscale", []string{"1"}},
+		{"brightness", []string{"101"}},
+		{"contrast", []string{"-101"}},
+		{"contrast", []string{"1.5"}},
+		{"rotate", []string{"45"}},
+		{"background_color", []string{"white"}},
+		{"fill", []string{"#12345"}},
+		{"watermark", []string{"ftp://example.com/m.png", "0", "0", "0"}},
+		{"watermark", []string{"https://example.com/m.png", "0", "0", "101"}},
+	}
+	for _, c := range cases {
+		if f, err := newFilter(c.name, c.args); err == nil {
+			t.Errorf("%s%q = %s, want an error", c.name, c.args, f)
+		}
+	}
+}
+
+func TestFilterApply(t *testing.T) {
+	apply := func(name string, args []string, opts *imageOptions) bimg.Options {
+		f, err := newFilter(name, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var o bimg.Options
+		if err = f.apply(&o, opts); err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	plain := &imageOptions{}
+
+	if o := apply("quality", []string{"80"}, plain); o.Quality != 80 {
+		t.Errorf("quality: Quality = %d", o.Quality)
+	}
+	if o := apply("format", []string{"png"}, plain); o.Type != bimg.PNG {
+		t.Errorf("format: Type = %v", o.Type)
+	}
+	if o := apply("grayscale", nil, plain); o.Interpretation != bimg.InterpretationBW {
+		t.Errorf("grayscale: Interpretation = %v", o.Interpretation)
+	}
+	if o := apply("strip_exif", nil, plain); !o.StripMetadata {
+		t.Error("strip_exif: StripMetadata not set")
+	}
+	if o := apply("rotate", []string{"-90"}, plain); o.Rotate != bimg.D270 {
+		t.Errorf("rotate: Rotate = %v", o.Rotate)
+	}
+
+	// The blur kernel reaches out to radius: the gaussian falls to MinAmpl
+	// there.
+	o := apply("blur", []string{"6", "3"}, plain)
+	if want := math.Exp(-2); o.GaussianBlur.Sigma != 3 || math.Abs(o.GaussianBlur.MinAmpl-want) > 1e-9 {
+		t.Errorf("blur(6,3): GaussianBlur = %+v, want sigma 3 and min amplitude %g", o.GaussianBlur, want)
+	}
+	if wide, narrow := apply("blur", []string{"9", "3"}, plain), o; wide.GaussianBlur.MinAmpl >= narrow.GaussianBlur.MinAmpl {
+		t.Errorf("blur radius 9 kept amplitude %g, not less than radius 6's %g", wide.GaussianBlur.MinAmpl, narrow.GaussianBlur.MinAmpl)
+	}
+	if o := apply("blur", []string{"0", "3"}, plain); o.GaussianBlur != (bimg.GaussianBlur{}) {
+		t.Errorf("blur(0,3): GaussianBlur = %+v, want none", o.GaussianBlur)
+	}
+
+	// fill only pads fit-in images.
+	if o := apply("fill", []string{"ff0000"}, &imageOptions{Width: 300, Height: 200}); o.Embed {
+		t.Error("fill embedded an image that isn't fit-in")
+	}
+	o = apply("fill", []string{"ff0000"}, &imageOptions{FitIn: true, Width: 300, Height: 200})
+	if !o.Embed || o.Width != 300 || o.Height != 200 || o.Background != (bimg.Color{R: 255}) || o.Extend != bimg.ExtendBackground {
+		t.Errorf("fill: %+v", o)
+	}
+}
+
+func TestPixelFilters(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.NRGBA{0, 100, 200, 255})
+	img.Set(1, 0, color.NRGBA{128, 250, 10, 40})
+
+	cases := []struct {
+		f    pixelFilter
+		want [2]color.NRGBA
+	}{
+		{brightnessFilter{0}, [2]color.NRGBA{{0, 100, 200, 255}, {128, 250, 10, 40}}},
+		{brightnessFilter{20}, [2]color.NRGBA{{51, 151, 251, 255}, {179, 255, 61, 40}}},
+		{brightnessFilter{-100}, [2]color.NRGBA{{0, 0, 0, 255}, {0, 0, 0, 40}}},
+		{contrastFilter{0}, [2]color.NRGBA{{0, 100, 200, 255}, {128, 250, 10, 40}}},
+		{contrastFilter{-100}, [2]color.NRGBA{{128, 128, 128, 255}, {128, 128, 128, 40}}},
+		{contrastFilter{100}, [2]color.NRGBA{{0, 73, 255, 255}, {129, 255, 0, 40}}},
+	}
+	for _, c := range cases {
+		adjusted := image.NewNRGBA(img.Bounds())
+		copy(adjusted.Pix, img.Pix)
+		c.f.adjust(adjusted)
+		for x, want := range c.want {
+			if got := adjusted.NRGBAAt(x, 0); got != want {
+				t.Errorf("%s: pixel %d = %v, want %v", c.f, x, got, want)
+			}
+		}
+	}
+}
+
+func TestWatermarkFetchStatus(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = srv.Client()
+
+	f, err := newFilter("watermark", []string{srv.URL + "/mark.png", "0", "0", "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.apply(&bimg.Options{}, &imageOptions{})
+	if serr, ok := err.(*statusError); !ok || serr.Code != 404 {
+		t.Errorf("missing watermark: %#v, want a 404 statusError", err)
+	}
+}
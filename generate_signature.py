@@ -2,12 +2,16 @@ import hmac
 import base64
 import hashlib
 
-def generate_signature(message, key):
+def generate_signature(message, key, key_id=None, digest=hashlib.sha256):
     key = bytes(key, 'UTF-8')
     message = bytes(message, 'UTF-8')
-    digester = hmac.new(key, message, hashlib.sha1)
+    digester = hmac.new(key, message, digest)
     signature1 = digester.digest()
     signature2 = base64.urlsafe_b64encode(signature1)
-    return str(signature2, 'UTF-8')
+    signature = str(signature2, 'UTF-8')
+    if key_id:
+        # Named keys may be selected by prefixing the signature with the id.
+        return key_id + '.' + signature
+    return signature
 
 generate_signature('300x0/https://listing-photos-production.s3.amazonaws.com/uploads/listing-4772/1973884-RCle1Lr6Q2w.jpg', SECURITY_KEY)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Build information, set at link time with e.g.
+// -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD)".
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// storageProbePath is looked up to check that result storage is reachable.
+// It is never written, so a not-found answer means storage is healthy.
+const storageProbePath = "/.gothumb-readyz"
+
+// storageProbeTimeout is how long a readiness check waits for storage.
+var storageProbeTimeout = 2 * time.Second
+
+// storageProbe is the storage lookup in flight, if any. A probe that outlasts
+// its check is left to finish, and later checks wait on it rather than
+// starting another, so a hung storage backend can't pile up goroutines.
+var storageProbe struct {
+	sync.Mutex
+	current *probe
+}
+
+type probe struct {
+	done chan struct{} // closed once err is set
+	err  error
+}
+
+// handleHealthz reports that the process is up and serving.
+func handleHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether gothumb can currently serve images: libvips
+// works, result storage answers and the processing pool has room. It
+// responds with a 503 when any check fails.
+func handleReadyz(w http.ResponseWriter, req *http.Request) {
+	checks := map[string]string{
+		"libvips":    checkLibvips(),
+		"storage":    checkStorage(),
+		"processing": checkProcessing(),
+	}
+	status, code := "ok", 200
+	for _, result := range checks {
+		if result != "ok" {
+			status, code = "unavailable", 503
+		}
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+func checkLibvips() string {
+	// bimg starts libvips when the process starts; asking it about the
+	// default output format confirms that it loaded with JPEG support.
+	if !bimg.IsTypeSupportedSave(bimg.JPEG) {
+		return "libvips cannot save JPEG images"
+	}
+	return "ok"
+}
+
+func checkStorage() string {
+	if resultStorage == nil {
+		return "ok"
+	}
+	storageProbe.Lock()
+	p := storageProbe.current
+	if p == nil {
+		p = &probe{done: make(chan struct{})}
+		storageProbe.current = p
+		go func(s ResultStorage) {
+			_, p.err = s.Head(storageProbePath)
+			storageProbe.Lock()
+			storageProbe.current = nil
+			storageProbe.Unlock()
+			close(p.done)
+		}(resultStorage)
+	}
+	storageProbe.Unlock()
+
+	timer := time.NewTimer(storageProbeTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		if p.err != nil && p.err != errResultNotFound {
+			return p.err.Error()
+		}
+		return "ok"
+	case <-timer.C:
+		return fmt.Sprintf("no response within %s", storageProbeTimeout)
+	}
+}
+
+func checkProcessing() string {
+	if processingPool.Saturated() {
+		return "processing queue is full"
+	}
+	return "ok"
+}
+
+// handleVersion reports build information and the image formats the linked
+// libvips can read and write.
+func handleVersion(w http.ResponseWriter, req *http.Request) {
+	var load, save []string
+	for t, name := range bimg.ImageTypes {
+		if bimg.IsTypeSupported(t) {
+			load = append(load, name)
+		}
+		if bimg.IsTypeSupportedSave(t) {
+			save = append(save, name)
+		}
+	}
+	sort.Strings(load)
+	sort.Strings(save)
+
+	writeJSON(w, 200, map[string]interface{}{
+		"version":         version,
+		"commit":          commit,
+		"build_date":      buildDate,
+		"go_version":      runtime.Version(),
+		"bimg_version":    bimg.Version,
+		"libvips_version": bimg.VipsVersion,
+		"formats": map[string][]string{
+			"load": load,
+			"save": save,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(append(body, '\n'))
+}
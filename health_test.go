@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type unreachableStorage struct{ ResultStorage }
+
+func (unreachableStorage) Head(string) (*ResultMeta, error) {
+	return nil, errors.New("connection refused")
+}
+
+// hungStorage blocks lookups until release is closed, counting them.
+type hungStorage struct {
+	ResultStorage
+	release chan struct{}
+	heads   int32
+}
+
+func (s *hungStorage) Head(string) (*ResultMeta, error) {
+	atomic.AddInt32(&s.heads, 1)
+	<-s.release
+	return nil, errResultNotFound
+}
+
+func TestCheckStorageOneProbeInFlight(t *testing.T) {
+	defer func(s ResultStorage, d time.Duration) { resultStorage, storageProbeTimeout = s, d }(resultStorage, storageProbeTimeout)
+	s := &hungStorage{release: make(chan struct{})}
+	resultStorage, storageProbeTimeout = s, 10*time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		if got, want := checkStorage(), "no response within 10ms"; got != want {
+			t.Errorf("checkStorage with hung storage = %q, want %q", got, want)
+		}
+	}
+	if heads := atomic.LoadInt32(&s.heads); heads != 1 {
+		t.Errorf("%d probes started while one hung, want 1", heads)
+	}
+
+	close(s.release)
+	storageProbeTimeout = time.Second
+	if got := checkStorage(); got != "ok" {
+		t.Errorf("checkStorage once storage answers = %q, want ok", got)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != 200 || rec.Body.String() != "ok\n" || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("healthz = %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	defer func(s ResultStorage, p *workerPool) { resultStorage, processingPool = s, p }(resultStorage, processingPool)
+
+	cases := []struct {
+		name    string
+		storage ResultStorage
+		busy    bool
+		code    int
+		checks  map[string]string
+	}{
+		{"no storage", nil, false, 200, map[string]string{"storage": "ok", "processing": "ok"}},
+		{"storage", newMemoryResultStorage(), false, 200, map[string]string{"storage": "ok", "processing": "ok"}},
+		{"unreachable storage", unreachableStorage{}, false, 503, map[string]string{"storage": "connection refused", "processing": "ok"}},
+		{"saturated", nil, true, 503, map[string]string{"storage": "ok", "processing": "processing queue is full"}},
+	}
+	for _, c := range cases {
+		resultStorage = c.storage
+		processingPool = newWorkerPool(1, 0, time.Second)
+		if c.busy {
+			release, _ := processingPool.Acquire()
+			defer release()
+		}
+
+		rec := httptest.NewRecorder()
+		handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+		var body struct {
+			Status string            `json:"status"`
+			Checks map[string]string `json:"checks"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if rec.Code != c.code {
+			t.Errorf("%s: readyz = %d, want %d", c.name, rec.Code, c.code)
+		}
+		if want := map[int]string{200: "ok", 503: "unavailable"}[c.code]; body.Status != want {
+			t.Errorf("%s: status %q, want %q", c.name, body.Status, want)
+		}
+		for check, want := range c.checks {
+			if body.Checks[check] != want {
+				t.Errorf("%s: %s check %q, want %q", c.name, check, body.Checks[check], want)
+			}
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "1.2.3", "abc123"
+
+	rec := httptest.NewRecorder()
+	handleVersion(rec, httptest.NewRequest("GET", "/version", nil))
+	var body struct {
+		Version string              `json:"version"`
+		Commit  string              `json:"commit"`
+		Formats map[string][]string `json:"formats"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Version != "1.2.3" || body.Commit != "abc123" {
+		t.Errorf("version %q commit %q", body.Version, body.Commit)
+	}
+	save := make(map[string]bool)
+	for _, f := range body.Formats["save"] {
+		save[f] = true
+	}
+	if !save["jpeg"] || save["gif"] {
+		t.Errorf("save formats %v, want jpeg and not gif", body.Formats["save"])
+	}
+}
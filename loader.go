@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+// A Loader fetches source images. Failures are returned as *statusError
+// where a specific response code applies.
+type Loader interface {
+	// Load returns the image at p, which is relative to the loader's root.
+	Load(p string) (*sourceImage, error)
+}
+
+// sourceImage is a loaded source along with the validators its origin sent,
+// which identify the version of the source a result was rendered from.
+type sourceImage struct {
+	Data         []byte
+	ETag         string
+	LastModified string
+}
+
+// sameVersion reports whether s is the version of the source that meta was
+// rendered from. Sources without validators never match.
+func (s *sourceImage) sameVersion(meta *ResultMeta) bool {
+	if s.ETag == "" && s.LastModified == "" {
+		return false
+	}
+	return s.ETag == meta.SourceETag && s.LastModified == meta.SourceLastModified
+}
+
+var (
+	// origins are the named sources usable as origin:<name>/<path>.
+	origins = map[string]Loader{}
+	// sourceBuckets are the buckets usable directly as s3://<bucket>/<key>.
+	sourceBuckets = map[string]Loader{}
+)
+
+// resolveSource returns the loader for a source URL from a request and the
+// path to pass to it. Supported forms are http(s) URLs, s3://<bucket>/<key>
+// for buckets in sourceBuckets and origin:<name>/<path> for named origins.
+// Only HTTP origins pass a query on; other sources reject one rather than
+// silently serving the same image for every query.
+func resolveSource(u *url.URL) (Loader, string, error) {
+	switch u.Scheme {
+	case "http", "https":
+		if err := checkSourceHost(u); err != nil {
+			return nil, "", err
+		}
+		return httpLoader{}, u.String(), nil
+	case "s3":
+		l, ok := sourceBuckets[u.Host]
+		if !ok {
+			return nil, "", &blockedSourceError{fmt.Sprintf("source bucket %q is not allowed", u.Host)}
+		}
+		if u.RawQuery != "" {
+			return nil, "", fmt.Errorf("s3 sources don't take a query")
+		}
+		return l, u.Path, nil
+	case "origin":
+		name, p := nextSegment(u.Opaque)
+		l, ok := origins[name]
+		if !ok {
+			return nil, "", fmt.Errorf("unknown origin %q", name)
+		}
+		if u.RawQuery != "" {
+			if _, ok := l.(httpLoader); !ok {
+				return nil, "", fmt.Errorf("origin %q doesn't take a query", name)
+			}
+			p += "?" + u.RawQuery
+		}
+		return l, p, nil
+	}
+	return nil, "", fmt.Errorf("invalid source URL")
+}
+
+// loadSource resolves and loads a source URL.
+func loadSource(source string) (*sourceImage, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, &statusError{Code: 400, Message: "invalid source URL"}
+	}
+	l, p, err := resolveSource(u)
+	if err != nil {
+		if _, ok := err.(*blockedSourceError); ok {
+			return nil, &statusError{Code: 403, Message: err.Error()}
+		}
+		return nil, &statusError{Code: 400, Message: err.Error()}
+	}
+
+	start := time.Now()
+	src, err := l.Load(p)
+	if err != nil {
+		sourceFetchDuration.ObserveSince(start, u.Scheme, "error")
+		return nil, err
+	}
+	sourceFetchDuration.ObserveSince(start, u.Scheme, "ok")
+	sourceFetchBytes.Observe(float64(len(src.Data)), u.Scheme)
+	return src, nil
+}
+
+// joinSourcePath joins p onto root without letting p escape it.
+func joinSourcePath(root, p string) string {
+	return strings.TrimSuffix(root, "/") + path.Clean("/"+p)
+}
+
+// httpLoader loads sources over HTTP. With an empty base, paths are
+// absolute URLs. Otherwise they are joined onto base and may end in a query.
+type httpLoader struct {
+	base string
+}
+
+func (l httpLoader) Load(p string) (*sourceImage, error) {
+	if l.base == "" {
+		return fetchSource(p)
+	}
+	var query string
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		p, query = p[:i], p[i:]
+	}
+	return fetchSource(joinSourcePath(l.base, p) + query)
+}
+
+// s3Loader loads sources from an S3 bucket using signed requests, so that
+// originals can stay private.
+type s3Loader struct {
+	bucket *s3gof3r.Bucket
+	prefix string
+}
+
+func (l *s3Loader) Load(p string) (*sourceImage, error) {
+	r, h, err := l.bucket.GetReader(joinSourcePath(l.prefix, p), nil)
+	if err != nil {
+		if rerr, ok := err.(*s3gof3r.RespError); ok {
+			return nil, originStatusError("S3", rerr.StatusCode)
+		}
+		return nil, fetchError(err)
+	}
+	defer r.Close()
+	length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err == nil && maxSourceBytes > 0 && length > maxSourceBytes {
+		return nil, sourceTooLargeError()
+	}
+	img, err := readSource(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkSourceType(img); err != nil {
+		return nil, err
+	}
+	return &sourceImage{Data: img, ETag: h.Get("ETag"), LastModified: h.Get("Last-Modified")}, nil
+}
+
+// fileLoader loads sources from a directory on the local filesystem.
+type fileLoader struct {
+	root string
+}
+
+func (l fileLoader) Load(p string) (*sourceImage, error) {
+	f, err := os.Open(filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+p))))
+	if os.IsNotExist(err) {
+		return nil, &statusError{Code: 404, Message: "source not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := readSource(f)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkSourceType(img); err != nil {
+		return nil, err
+	}
+	src := &sourceImage{Data: img}
+	if fi, err := f.Stat(); err == nil {
+		src.LastModified = fi.ModTime().UTC().Format(http.TimeFormat)
+	}
+	return src, nil
+}
+
+// newLoader returns a loader rooted at target, which is an http(s), s3 or
+// file URL.
+func newLoader(target string) (Loader, error) {
+	if err := checkLoaderTarget(target); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(target)
+	switch u.Scheme {
+	case "s3":
+		bucket, err := newS3Bucket(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Loader{bucket: bucket, prefix: u.Path}, nil
+	case "file":
+		return fileLoader{root: u.Path}, nil
+	}
+	return httpLoader{base: target}, nil
+}
+
+// checkLoaderTarget checks that target is a URL newLoader can serve from,
+// without connecting to anything.
+func checkLoaderTarget(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "s3":
+		if u.Host == "" {
+			return fmt.Errorf("origin URL %q has no host", target)
+		}
+		return nil
+	case "file":
+		if u.Path == "" {
+			return fmt.Errorf("origin URL %q has no path", target)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported origin URL %q", target)
+}
+
+// newOrigins builds the loaders for a map of origin names to URLs, e.g.
+// listings=https://photos.example.com/uploads or private=s3://originals.
+func newOrigins(urls map[string]string) (map[string]Loader, error) {
+	loaders := make(map[string]Loader)
+	for name, target := range urls {
+		l, err := newLoader(target)
+		if err != nil {
+			return nil, fmt.Errorf("origin %s: %s", name, err)
+		}
+		loaders[name] = l
+	}
+	return loaders, nil
+}
+
+// newSourceBuckets builds the loaders for buckets that may be used directly
+// in s3:// sources.
+func newSourceBuckets(names []string) (map[string]Loader, error) {
+	loaders := make(map[string]Loader)
+	for _, name := range names {
+		bucket, err := newS3Bucket(name)
+		if err != nil {
+			return nil, err
+		}
+		loaders[name] = &s3Loader{bucket: bucket}
+	}
+	return loaders, nil
+}
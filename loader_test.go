@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type stubLoader struct{ name string }
+
+func (l stubLoader) Load(p string) (*sourceImage, error) {
+	return &sourceImage{Data: []byte(l.name + ":" + p)}, nil
+}
+
+func TestResolveSource(t *testing.T) {
+	defer func(o, b map[string]Loader, hosts []string) {
+		origins, sourceBuckets, allowedSourceHosts = o, b, hosts
+	}(origins, sourceBuckets, allowedSourceHosts)
+	origins = map[string]Loader{"photos": stubLoader{"photos"}, "cdn": httpLoader{"https://cdn.example.com"}}
+	sourceBuckets = map[string]Loader{"originals": stubLoader{"originals"}}
+	allowedSourceHosts = []string{"*.example.com"}
+
+	cases := []struct {
+		source  string
+		loader  Loader
+		path    string
+		blocked bool
+	}{
+		{"https://img.example.com/a.jpg?v=1", httpLoader{}, "https://img.example.com/a.jpg?v=1", false},
+		{"http://img.example.com/a.jpg", httpLoader{}, "http://img.example.com/a.jpg", false},
+		{"https://evil.com/a.jpg", nil, "", true},
+		{"s3://originals/a/b.jpg", stubLoader{"originals"}, "/a/b.jpg", false},
+		{"s3://secrets/a.jpg", nil, "", true},
+		{"s3://originals/a.jpg?v=1", nil, "", false},
+		{"origin:photos/a/b.jpg", stubLoader{"photos"}, "a/b.jpg", false},
+		{"origin:photos/a.jpg?v=1", nil, "", false},
+		{"origin:cdn/a/b.jpg?v=1&w=2", httpLoader{"https://cdn.example.com"}, "a/b.jpg?v=1&w=2", false},
+		{"origin:missing/a.jpg", nil, "", false},
+		{"ftp://img.example.com/a.jpg", nil, "", false},
+		{"a.jpg", nil, "", false},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, p, err := resolveSource(u)
+		if c.loader == nil {
+			_, blocked := err.(*blockedSourceError)
+			if err == nil || blocked != c.blocked {
+				t.Errorf("resolveSource(%s) = %v, want an error, blocked %v", c.source, err, c.blocked)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(l, c.loader) || p != c.path {
+			t.Errorf("resolveSource(%s) = %#v, %q, %v, want %#v, %q", c.source, l, p, err, c.loader, c.path)
+		}
+	}
+}
+
+func TestJoinSourcePath(t *testing.T) {
+	cases := []struct{ root, p, want string }{
+		{"https://example.com/uploads", "a/b.jpg", "https://example.com/uploads/a/b.jpg"},
+		{"https://example.com/uploads/", "/a.jpg", "https://example.com/uploads/a.jpg"},
+		{"https://example.com/uploads", "../../etc/passwd", "https://example.com/uploads/etc/passwd"},
+		{"https://example.com/uploads", "a/./../b.jpg", "https://example.com/uploads/b.jpg"},
+		{"", "/a.jpg", "/a.jpg"},
+	}
+	for _, c := range cases {
+		if got := joinSourcePath(c.root, c.p); got != c.want {
+			t.Errorf("joinSourcePath(%q, %q) = %q, want %q", c.root, c.p, got, c.want)
+		}
+	}
+}
+
+func TestFileLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gothumb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "a", "b.jpg"), jpegData, 0644)
+	ioutil.WriteFile(filepath.Join(root, "notes.txt"), []byte("not an image at all"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret.jpg"), jpegData, 0644)
+	defer useSourceSettings(0, time.Second)()
+
+	l := fileLoader{root: root}
+	src, err := l.Load("a/b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(src.Data) != string(jpegData) || src.LastModified == "" {
+		t.Errorf("Load(a/b.jpg) = %+v", src)
+	}
+	cases := []struct {
+		p    string
+		code int
+	}{
+		{"missing.jpg", 404},
+		{"../secret.jpg", 404},
+		{"a/../../secret.jpg", 404},
+		{"notes.txt", 415},
+	}
+	for _, c := range cases {
+		_, err := l.Load(c.p)
+		if serr, ok := err.(*statusError); !ok || serr.Code != c.code {
+			t.Errorf("Load(%s) = %v, want a %d", c.p, err, c.code)
+		}
+	}
+}
+
+func TestLoadSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/uploads/a.jpg" || (req.URL.RawQuery != "" && req.URL.RawQuery != "v=2") {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(jpegData)
+	}))
+	defer srv.Close()
+	defer useSourceSettings(0, time.Second)()
+	defer func(o map[string]Loader) { origins = o }(origins)
+	var err error
+	if origins, err = newOrigins(map[string]string{"photos": srv.URL + "/uploads"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, source := range []string{"origin:photos/a.jpg", "origin:photos/a.jpg?v=2"} {
+		if src, err := loadSource(source); err != nil || string(src.Data) != string(jpegData) {
+			t.Errorf("loadSource(%s) = %v", source, err)
+		}
+	}
+	cases := []struct {
+		source string
+		code   int
+	}{
+		{"origin:photos/missing.jpg", 404},
+		{"origin:photos/a.jpg?v=3", 404},
+		{"origin:other/a.jpg", 400},
+		{"s3://unlisted/a.jpg", 403},
+		{"%zz", 400},
+	}
+	for _, c := range cases {
+		_, err := loadSource(c.source)
+		if serr, ok := err.(*statusError); !ok || serr.Code != c.code {
+			t.Errorf("loadSource(%s) = %v, want a %d", c.source, err, c.code)
+		}
+	}
+}
+
+func TestCheckLoaderTarget(t *testing.T) {
+	for _, target := range []string{"https://example.com/uploads", "http://example.com", "s3://bucket/prefix", "file:///srv/images"} {
+		if err := checkLoaderTarget(target); err != nil {
+			t.Errorf("checkLoaderTarget(%s) = %v", target, err)
+		}
+	}
+	for _, target := range []string{"https:///uploads", "s3:///prefix", "file://", "ftp://example.com", "example.com/uploads", "%zz"} {
+		if err := checkLoaderTarget(target); err == nil {
+			t.Errorf("checkLoaderTarget(%s) accepted it", target)
+		}
+	}
+}
+
+func TestSameVersion(t *testing.T) {
+	meta := &ResultMeta{SourceETag: `"v1"`, SourceLastModified: "Fri, 02 Jan 2026 15:04:05 GMT"}
+	cases := []struct {
+		src  sourceImage
+		want bool
+	}{
+		{sourceImage{ETag: `"v1"`, LastModified: "Fri, 02 Jan 2026 15:04:05 GMT"}, true},
+		{sourceImage{ETag: `"v2"`, LastModified: "Fri, 02 Jan 2026 15:04:05 GMT"}, false},
+		{sourceImage{ETag: `"v1"`}, false},
+		{sourceImage{}, false},
+	}
+	for _, c := range cases {
+		if got := c.src.sameVersion(meta); got != c.want {
+			t.Errorf("sameVersion of %+v = %v, want %v", c.src, got, c.want)
+		}
+	}
+	if (&sourceImage{}).sameVersion(&ResultMeta{}) {
+		t.Error("a source without validators matched a result without them")
+	}
+}
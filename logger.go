@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFormat selects how log lines are encoded: "logfmt" or "json".
+var logFormat = "logfmt"
+
+var (
+	logMu     sync.Mutex
+	logOutput io.Writer = os.Stderr
+)
+
+// rootLogger is the logger every other logger is derived from.
+var rootLogger = &logger{}
+
+// logger writes structured log lines. Loggers are immutable; With returns a
+// new logger carrying additional fields, which is how request-scoped fields
+// such as the request ID end up on every line of a request.
+type logger struct {
+	fields []interface{}
+}
+
+// With returns a logger that adds the given key/value pairs to every line.
+func (l *logger) With(keyvals ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(append(fields, l.fields...), keyvals...)
+	return &logger{fields: fields}
+}
+
+// Info logs msg with the given key/value pairs.
+func (l *logger) Info(msg string, keyvals ...interface{}) {
+	l.write("info", msg, keyvals)
+}
+
+// Error logs msg at error level with the given key/value pairs.
+func (l *logger) Error(msg string, keyvals ...interface{}) {
+	l.write("error", msg, keyvals)
+}
+
+func (l *logger) write(level, msg string, keyvals []interface{}) {
+	all := make([]interface{}, 0, 6+len(l.fields)+len(keyvals))
+	all = append(all, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level, "msg", msg)
+	all = append(append(all, l.fields...), keyvals...)
+	if len(all)%2 != 0 {
+		all = append(all, "")
+	}
+
+	var buf bytes.Buffer
+	if logFormat == "json" {
+		encodeJSONLine(&buf, all)
+	} else {
+		encodeLogfmtLine(&buf, all)
+	}
+
+	logMu.Lock()
+	logOutput.Write(buf.Bytes())
+	logMu.Unlock()
+}
+
+func encodeJSONLine(buf *bytes.Buffer, keyvals []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(keyvals[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(logValue(keyvals[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(keyvals[i+1]))
+		}
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+}
+
+func encodeLogfmtLine(buf *bytes.Buffer, keyvals []interface{}) {
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(keyvals[i]))
+		buf.WriteByte('=')
+		value := fmt.Sprint(logValue(keyvals[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+}
+
+// logValue converts values that don't encode usefully on their own.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return float64(v) / float64(time.Millisecond)
+	}
+	return v
+}
+
+// stdLogWriter sends lines written through the standard log package, such
+// as startup errors and messages from dependencies, to rootLogger.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	rootLogger.Error(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// sourceHost names where a source is loaded from for logging: the host of
+// http(s) and s3 URLs, or the origin name of origin: sources.
+func sourceHost(u *url.URL) string {
+	if u.Host != "" {
+		return u.Host
+	}
+	if u.Opaque != "" {
+		return strings.SplitN(u.Opaque, "/", 2)[0]
+	}
+	return u.Scheme
+}
+
+// requestID returns the request's X-Request-ID when it is usable, and a new
+// random ID otherwise.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-ID"); id != "" && len(id) <= 200 && isPrintableASCII(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// accessRecorder captures the status and size of a response for the access
+// log line.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = 200
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
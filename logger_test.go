@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sends log lines in format to a buffer for a test, and returns
+// it along with a func that restores the previous output.
+func captureLogs(format string) (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	output, f := logOutput, logFormat
+	logOutput, logFormat = &buf, format
+	return &buf, func() { logOutput, logFormat = output, f }
+}
+
+var logTime = regexp.MustCompile(`^time=\S+ `)
+
+func TestLogfmt(t *testing.T) {
+	buf, restore := captureLogs("logfmt")
+	defer restore()
+
+	l := rootLogger.With("request_id", "abc").With("path", "/300x200/a.jpg")
+	l.Error("failed", "error", errors.New(`bad "thing"`), "duration_ms", 1500*time.Microsecond, "empty", "", "odd")
+	l.Info("done")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{
+		`level=error msg=failed request_id=abc path=/300x200/a.jpg error="bad \"thing\"" duration_ms=1.5 empty="" odd=""`,
+		`level=info msg=done request_id=abc path=/300x200/a.jpg`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		if !logTime.MatchString(line) {
+			t.Errorf("line %d has no time: %s", i, line)
+		}
+		if got := logTime.ReplaceAllString(line, ""); got != want[i] {
+			t.Errorf("line %d:\n got %s\nwant %s", i, got, want[i])
+		}
+	}
+
+	// With doesn't change the logger it derives from.
+	buf.Reset()
+	rootLogger.Info("plain")
+	if strings.Contains(buf.String(), "request_id") {
+		t.Errorf("rootLogger picked up fields: %s", buf.String())
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	buf, restore := captureLogs("json")
+	defer restore()
+
+	rootLogger.With("request_id", "abc").Info("request", "status", 200, "error", errors.New("x\ny"), "duration_ms", 2*time.Millisecond)
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	want := map[string]interface{}{
+		"level": "info", "msg": "request", "request_id": "abc",
+		"status": float64(200), "error": "x\ny", "duration_ms": float64(2),
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%s = %#v, want %#v", key, line[key], value)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, line["time"].(string)); err != nil {
+		t.Errorf("time: %v", err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "req-123")
+	if id := requestID(req); id != "req-123" {
+		t.Errorf("requestID kept %q, want req-123", id)
+	}
+
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	for _, bad := range []string{"", "has space", "new\nline", strings.Repeat("x", 201)} {
+		req.Header.Set("X-Request-ID", bad)
+		if id := requestID(req); !generated.MatchString(id) {
+			t.Errorf("requestID for %q = %q, want a generated ID", bad, id)
+		}
+	}
+	req.Header.Del("X-Request-ID")
+	if a, b := requestID(req), requestID(req); a == b {
+		t.Errorf("generated request IDs repeat: %s", a)
+	}
+}
+
+func TestSourceHost(t *testing.T) {
+	cases := []struct{ source, want string }{
+		{"https://photos.example.com/a.jpg", "photos.example.com"},
+		{"s3://originals/a.jpg", "originals"},
+		{"origin:listings/a/b.jpg", "listings"},
+		{"file:/srv/a.jpg", "file"},
+	}
+	for _, c := range cases {
+		u, _ := url.Parse(c.source)
+		if got := sourceHost(u); got != c.want {
+			t.Errorf("sourceHost(%s) = %s, want %s", c.source, got, c.want)
+		}
+	}
+}
+
+func TestAccessRecorder(t *testing.T) {
+	rec := &accessRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.Write([]byte("hello"))
+	rec.Write([]byte(" world"))
+	if rec.status != 200 || rec.bytes != 11 {
+		t.Errorf("status %d, bytes %d, want 200 and 11", rec.status, rec.bytes)
+	}
+
+	rec = &accessRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.WriteHeader(404)
+	rec.WriteHeader(500)
+	if rec.status != 404 {
+		t.Errorf("status %d, want the first one written, 404", rec.status)
+	}
+}
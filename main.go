@@ -1,12 +1,8 @@
 package main
 
 import (
-	"crypto/hmac"
+	"bytes"
 	"crypto/md5"
-	"crypto/sha1"
-	"crypto/subtle"
-	"encoding/base64"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -20,20 +16,20 @@ import (
 	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"github.com/rlmcpherson/s3gof3r"
 	"gopkg.in/h2non/bimg.v1"
 )
 
 var (
-	listenInterface  string
-	maxAge           int
-	securityKey      []byte
-	resultBucketName string
-	useRRS           bool
-	unsafeMode       bool
-
-	httpClient   = http.DefaultClient
-	resultBucket *s3gof3r.Bucket
+	listenInterface string
+	maxAge          int
+	unsafeMode      bool
+	autoFormats     []bimg.ImageType
+	coalesceTimeout time.Duration
+
+	httpClient       *http.Client
+	resultStorage    ResultStorage
+	thumbnailFlights = newFlightGroup()
+	processingPool   *workerPool
 )
 
 type ByteSize int64
@@ -45,123 +41,228 @@ const (
 )
 
 func main() {
-	log.SetFlags(0) // hide timestamps from Go logs
+	log.SetFlags(0) // timestamps are added by the structured logger
+	log.SetOutput(stdLogWriter{})
 
-	parseFlags()
-
-	resultBucketName = os.Getenv("RESULT_STORAGE_BUCKET")
-	if resultBucketName != "" {
-		keys, err := s3gof3r.EnvKeys()
-		if err != nil {
-			log.Fatal(err)
-		}
-		resultBucket = s3gof3r.New(s3gof3r.DefaultDomain, keys).Bucket(resultBucketName)
-		resultBucket.Concurrency = 4
-		resultBucket.PartSize = int64(2 * MB)
-		resultBucket.Md5Check = false
-		httpClient = resultBucket.Client
-
-		if rrs := os.Getenv("USE_RRS"); rrs == "true" || rrs == "1" {
-			useRRS = true
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
 		}
 	}
 
-	router := httprouter.New()
-	router.HEAD("/:signature/:size/*source", handleResize)
-	router.GET("/:signature/:size/*source", handleResize)
-	log.Fatal(http.ListenAndServe(listenInterface, router))
-}
-
-func parseFlags() {
-	securityKeyStr := ""
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8888"
+	cfg, err := loadConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = cfg.apply(); err != nil {
+		log.Fatal(err)
 	}
 
-	if maxAgeStr := os.Getenv("MAX_AGE"); maxAgeStr != "" {
-		var err error
-		if maxAge, err = strconv.Atoi(maxAgeStr); err != nil {
-			log.Fatal("invalid MAX_AGE setting")
-		}
+	if err = serve(&http.Server{Addr: listenInterface, Handler: newHandler()}); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	flag.StringVar(&listenInterface, "l", ":"+port, "listen address")
-	flag.IntVar(&maxAge, "max-age", maxAge, "the maximum HTTP caching age to use on returned images")
-	flag.StringVar(&securityKeyStr, "k", os.Getenv("SECURITY_KEY"), "security key")
-	flag.BoolVar(&unsafeMode, "unsafe", false, "whether to allow /unsafe URLs")
+// newHandler returns the handler for every path gothumb serves.
+func newHandler() http.Handler {
+	router := httprouter.New()
+	router.HEAD("/:signature/*path", handleResize)
+	router.GET("/:signature/*path", handleResize)
+
+	return &exactPathMux{
+		paths: map[string]http.Handler{
+			"/metrics":     http.HandlerFunc(handleMetrics),
+			"/healthz":     http.HandlerFunc(handleHealthz),
+			"/readyz":      http.HandlerFunc(handleReadyz),
+			"/version":     http.HandlerFunc(handleVersion),
+			"/admin/purge": adminOnly(http.HandlerFunc(handlePurge)),
+		},
+		fallback: countResponses(router),
+	}
+}
 
-	flag.Parse()
+// exactPathMux serves a fixed set of paths and hands every other request to
+// fallback. It stands in for http.ServeMux, which would redirect the "//" in
+// source URLs to a cleaned path, and lets these paths coexist with the
+// router's /:signature wildcard.
+type exactPathMux struct {
+	paths    map[string]http.Handler
+	fallback http.Handler
+}
 
-	if securityKeyStr == "" && !unsafeMode {
-		log.Fatalf("must provide a security key with -k or allow unsafe URLs")
+func (m *exactPathMux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h, ok := m.paths[req.URL.Path]; ok {
+		h.ServeHTTP(w, req)
+		return
 	}
-	securityKey = []byte(securityKeyStr)
+	m.fallback.ServeHTTP(w, req)
 }
 
 func handleResize(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	start := time.Now()
 	reqPath := req.URL.EscapedPath()
-	log.Printf("%s %s", req.Method, reqPath)
-	sourceURL, err := url.Parse(strings.TrimPrefix(params.ByName("source"), "/"))
-	if err != nil || !(sourceURL.Scheme == "http" || sourceURL.Scheme == "https") {
-		http.Error(w, "invalid source URL", 400)
+	reqID := requestID(req)
+	w.Header().Set("X-Request-ID", reqID)
+	done, ok := activeRequests.Start(reqPath)
+	if !ok {
+		w.Header().Set("Connection", "close")
+		writeError(w, &statusError{Code: 503, Message: "shutting down"})
 		return
 	}
+	defer done()
+	rec := &accessRecorder{ResponseWriter: w}
+	w = rec
 
+	l := rootLogger.With("request_id", reqID, "method", req.Method, "path", reqPath)
+	cache := "none"
+	defer func() {
+		if rec.status == 0 {
+			rec.status = 200
+		}
+		l.Info("request", "status", rec.status, "bytes", rec.bytes, "cache", cache, "duration_ms", time.Since(start))
+	}()
+
+	opts, err := parseImageOptions(params.ByName("path"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err = checkPresetsOnly(opts); err != nil {
+		writeError(w, err)
+		return
+	}
+	if opts.Preset != "" {
+		l = l.With("preset", opts.Preset)
+	}
+
+	// The signature is checked before the source is looked at, so that
+	// unsigned requests can't probe which sources are allowed.
 	sig := params.ByName("signature")
 	pathToVerify := strings.TrimPrefix(reqPath, "/"+sig+"/")
-	if err := validateSignature(sig, pathToVerify); err != nil {
+	key, algorithm, err := validateSignature(sig, pathToVerify)
+	if err != nil {
+		l.Error("invalid signature", "error", err)
 		http.Error(w, "invalid signature", 401)
 		return
 	}
+	if key != nil {
+		l = l.With("signature_key", key.name(), "signature_algorithm", algorithm)
+	}
+	if err = opts.checkValidity(time.Now()); err != nil {
+		writeError(w, err)
+		return
+	}
 
-	width, height, err := parseWidthAndHeight(params.ByName("size"))
+	sourceURL, err := url.Parse(opts.Source)
 	if err != nil {
-		http.Error(w, "invalid height requested", 400)
+		http.Error(w, "invalid source URL", 400)
+		return
+	}
+	l = l.With("source_host", sourceHost(sourceURL), "width", opts.Width, "height", opts.Height)
+	if _, _, err = resolveSource(sourceURL); err != nil {
+		if _, ok := err.(*blockedSourceError); ok {
+			l.Error("blocked source", "error", err)
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		http.Error(w, err.Error(), 400)
 		return
 	}
+	opts.Source = sourceURL.String()
+
+	negotiateFormat(w.Header(), req, opts)
+
+	resultPath := normalizePath("/" + opts.String())
 
-	resultPath := normalizePath(strings.TrimPrefix(reqPath, "/"+sig))
+	if res, ok := cachedResults.Get(resultPath); ok {
+		cache = "memory"
+		writeResult(w, req, l, res, opts.Expires)
+		return
+	}
 
-	// TODO(bgentry): everywhere that switches on resultBucket should switch on
-	// something like resultStorage instead.
-	if resultBucket == nil {
+	if resultStorage == nil {
 		// no result storage, just generate the thumbnail
-		generateThumbnail(w, req.Method, resultPath, sourceURL.String(), width, height)
+		generateThumbnail(w, req, l, resultPath, opts)
 		return
 	}
 
 	// try to get stored result
-	r, h, err := getStoredResult(req.Method, resultPath)
+	r, meta, err := getStoredResult(l, req.Method, resultPath)
 	if err != nil {
-		log.Printf("getting stored result: %s", err)
-		generateThumbnail(w, req.Method, resultPath, sourceURL.String(), width, height)
+		cache = "miss"
+		storedResultLookups.Inc("miss")
+		generateThumbnail(w, req, l, resultPath, opts)
 		return
 	}
 	defer r.Close()
+	cache = "hit"
+	storedResultLookups.Inc("hit")
 
 	// return stored result
-	length, err := strconv.Atoi(h.Get("Content-Length"))
-	if err != nil {
-		log.Printf("invalid result content-length: %s", err)
-		// TODO: try to generate instead of erroring w/ 500?
-		http.Error(w, err.Error(), 500)
+	res := &result{
+		ContentType:   meta.ContentType,
+		ContentLength: int(meta.ContentLength),
+		ETag:          meta.ETag,
+		LastModified:  meta.LastModified,
+		Path:          resultPath,
+		Created:       meta.Created,
+	}
+	if stale := staleFor(res, time.Now()); stale > 0 {
+		if stale < staleWhileRevalidate {
+			cache = "stale"
+			staleResults.Inc("revalidating")
+			revalidateResult(l, resultPath, opts, meta)
+		} else {
+			// Keep the stale copy to fall back on if refreshing it fails.
+			if res.Data, err = ioutil.ReadAll(r); err != nil {
+				l.Error("reading stored result", "error", err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			r.Close()
+			fresh, err := thumbnailFlights.Do(resultPath, coalesceTimeout, func() (*result, error) {
+				return renderThumbnail(l, resultPath, opts, meta)
+			})
+			if err == nil {
+				cache = "refreshed"
+				writeResult(w, req, l, fresh, opts.Expires)
+				return
+			}
+			if stale >= staleIfError {
+				writeError(w, err)
+				return
+			}
+			l.Error("refreshing stale result", "stale_ms", stale, "error", err)
+			cache = "stale"
+			staleResults.Inc("error")
+			writeResult(w, req, l, res, opts.Expires)
+			return
+		}
+	}
+	if req.Method == "GET" && (cachedResults != nil || req.Header.Get("Range") != "") {
+		// Stored results are small, so buffer the result to cache it, or
+		// for ranges rather than requiring seekable storage readers.
+		if res.Data, err = ioutil.ReadAll(r); err != nil {
+			l.Error("reading stored result", "error", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		cachedResults.Add(res)
+		writeResult(w, req, l, res, opts.Expires)
+		return
+	}
+	indexRequest(l, reqPath, res)
+	setResultHeaders(w, res, opts.Expires)
+	if checkNotModified(w, req, res) || req.Method == "HEAD" {
 		return
 	}
-
-	setResultHeaders(w, &result{
-		ContentType:   h.Get("Content-Type"),
-		ContentLength: length,
-		ETag:          strings.Trim(h.Get("Etag"), `"`),
-		Path:          resultPath,
-	})
 	if _, err = io.Copy(w, r); err != nil {
-		log.Printf("copying from stored result: %s", err)
+		l.Error("copying from stored result", "error", err)
 		return
 	}
 	if err = r.Close(); err != nil {
-		log.Printf("closing stored result copy: %s", err)
+		l.Error("closing stored result copy", "error", err)
 	}
 }
 
@@ -170,7 +271,43 @@ type result struct {
 	ContentType   string
 	ContentLength int
 	ETag          string
+	LastModified  time.Time
 	Path          string
+
+	// Source is the URL the result was rendered from. Created is when it was
+	// rendered or last found to be current with the source, whose validators
+	// are SourceETag and SourceLastModified.
+	Source             string
+	Created            time.Time
+	SourceETag         string
+	SourceLastModified string
+}
+
+// statusError is an error that maps onto a specific HTTP response.
+type statusError struct {
+	Code       int
+	Message    string
+	RetryAfter int // seconds; sent as Retry-After when positive
+}
+
+func (e *statusError) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.Code)
+	}
+	return e.Message
+}
+
+// writeError responds with err's status code when it is a *statusError, and
+// with a 500 otherwise.
+func writeError(w http.ResponseWriter, err error) {
+	if serr, ok := err.(*statusError); ok {
+		if serr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(serr.RetryAfter))
+		}
+		http.Error(w, serr.Message, serr.Code)
+		return
+	}
+	http.Error(w, err.Error(), 500)
 }
 
 func computeHexMD5(data []byte) string {
@@ -179,167 +316,228 @@ func computeHexMD5(data []byte) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func generateThumbnail(w http.ResponseWriter, rmethod, rpath string, sourceURL string, width, height uint) {
-	log.Printf("generating %s", rpath)
-	resp, err := httpClient.Get(sourceURL)
+func generateThumbnail(w http.ResponseWriter, req *http.Request, l *logger, rpath string, opts *imageOptions) {
+	res, err := thumbnailFlights.Do(rpath, coalesceTimeout, func() (*result, error) {
+		return renderThumbnail(l, rpath, opts, nil)
+	})
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, err)
 		return
 	}
-	defer resp.Body.Close()
+	writeResult(w, req, l, res, opts.Expires)
+}
 
-	if resp.StatusCode != 200 {
-		log.Printf("unexpected status code from source: %d", resp.StatusCode)
-		http.Error(w, "", resp.StatusCode)
+// writeResult responds with a result held in memory.
+func writeResult(w http.ResponseWriter, req *http.Request, l *logger, res *result, expires time.Time) {
+	indexRequest(l, req.URL.EscapedPath(), res)
+	setResultHeaders(w, res, expires)
+	if checkNotModified(w, req, res) || req.Method == "HEAD" {
 		return
 	}
-
-	img, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	if req.Header.Get("Range") != "" {
+		http.ServeContent(w, req, "", res.LastModified, bytes.NewReader(res.Data))
 		return
 	}
+	if _, err := w.Write(res.Data); err != nil {
+		l.Error("writing buffer to response", "error", err)
+	}
+}
 
-	buf, err := bimg.Resize(img, bimg.Options{
-		Height:       int(height),
-		Width:        int(width),
-		Gravity:      bimg.GravityCentre,
-		Interpolator: bimg.Bicubic,
-		Quality:      50,
-	})
+// renderThumbnail fetches the source and processes it into a result. It is
+// only run by the leader of a flight, which also stores the result. When
+// refreshing a stale stored result, the stored copy is reused if the source
+// hasn't changed since it was rendered.
+func renderThumbnail(l *logger, rpath string, opts *imageOptions, stored *ResultMeta) (*result, error) {
+	release, err := processingPool.Acquire()
+	if err != nil {
+		l.Error("rejecting render", "error", err)
+		return nil, err
+	}
+	defer release()
 
+	fetchStart := time.Now()
+	src, err := loadSource(opts.Source)
+	fetchTime := time.Since(fetchStart)
 	if err != nil {
-		responseCode := 500
-		if err.Error() == "Unsupported image format" || strings.Contains(err.Error(), "VIPS cannot save to") {
-			responseCode = 415 // Unsupported Media Type
+		msg := "loading source"
+		if serr, ok := err.(*statusError); ok && serr.Code == 403 {
+			msg = "blocked source"
 		}
-		http.Error(w, fmt.Sprintf("resizing image: %s", err.Error()), responseCode)
-		return
+		l.Error(msg, "fetch_ms", fetchTime, "error", err)
+		return nil, err
 	}
 
-	res := &result{
-		ContentType:   "image/jpeg", // TODO: support PNGs as well
-		ContentLength: len(buf),
-		Data:          buf, // TODO: check if I need to copy this
-		ETag:          computeHexMD5(buf),
-		Path:          rpath,
+	var res *result
+	if stored != nil && src.sameVersion(stored) {
+		if res = readStoredResult(l, rpath); res != nil {
+			l.Info("source unchanged, reusing stored result", "fetch_ms", fetchTime)
+		}
 	}
-	setResultHeaders(w, res)
-	if rmethod != "HEAD" {
-		if _, err = w.Write(buf); err != nil {
-			log.Printf("writing buffer to response: %s", err)
+	if res == nil {
+		if res, err = renderSource(l.With("fetch_ms", fetchTime), src.Data, rpath, opts); err != nil {
+			return nil, err
 		}
 	}
-
-	if resultBucket != nil {
-		go storeResult(res)
+	res.Source, res.Created = opts.Source, time.Now().UTC()
+	res.SourceETag, res.SourceLastModified = src.ETag, src.LastModified
+	cachedResults.Add(res)
+	if resultStorage != nil && !pendingStores.Go(rpath, func() { storeResult(l, res) }) {
+		l.Error("not storing result while shutting down", "result_path", rpath)
 	}
+	return res, nil
 }
 
-// caller is responsible for closing the returned ReadCloser
-func getStoredResult(method, path string) (io.ReadCloser, http.Header, error) {
-	if method != "HEAD" {
-		return resultBucket.GetReader(path, nil)
+// renderSource checks and processes a loaded source image into the result
+// for rpath. The render command runs it on local files, so that it produces
+// exactly what the server would.
+func renderSource(l *logger, img []byte, rpath string, opts *imageOptions) (*result, error) {
+	if err := checkSourcePixels(img); err != nil {
+		l.Error("rejecting source", "source_bytes", len(img), "error", err)
+		return nil, err
 	}
 
-	s3URL := fmt.Sprintf("https://%s.s3.amazonaws.com%s", resultBucketName, path)
-	req, err := http.NewRequest(method, s3URL, nil)
+	start := time.Now()
+	buf, err := processImage(img, opts)
 	if err != nil {
-		return nil, nil, err
+		resizeDuration.ObserveSince(start, "error")
+		l.Error("resizing image", "resize_ms", time.Since(start), "error", err)
+		if serr, ok := err.(*statusError); ok {
+			return nil, serr
+		}
+		responseCode := 500
+		if err.Error() == "Unsupported image format" || strings.Contains(err.Error(), "VIPS cannot save to") {
+			responseCode = 415 // Unsupported Media Type
+		}
+		return nil, &statusError{Code: responseCode, Message: fmt.Sprintf("resizing image: %s", err.Error())}
 	}
 
-	resultBucket.Sign(req)
-	res, err := httpClient.Do(req)
-	if err != nil {
-		return nil, nil, err
-	}
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		// TODO: drain res.Body to ioutil.Discard before closing?
-		res.Body.Close()
-		return nil, nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
-	}
-	res.Header.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
-	return res.Body, res.Header, err
+	resizeTime := time.Since(start)
+	outputType := bimg.DetermineImageType(buf)
+	resizeDuration.Observe(resizeTime.Seconds(), bimg.ImageTypeName(outputType))
+	l.Info("rendered", "source_bytes", len(img), "bytes", len(buf), "resize_ms", resizeTime)
+
+	return &result{
+		ContentType:   contentType(outputType),
+		ContentLength: len(buf),
+		Data:          buf, // TODO: check if I need to copy this
+		ETag:          computeHexMD5(buf),
+		LastModified:  time.Now().UTC().Truncate(time.Second),
+		Path:          rpath,
+	}, nil
 }
 
-func mustGetenv(name string) string {
-	value := os.Getenv(name)
-	if value == "" {
-		log.Fatalf("missing %s env", name)
+// getStoredResult looks up a stored result, logging failures other than the
+// result not existing. The caller is responsible for closing the returned
+// ReadCloser.
+func getStoredResult(l *logger, method, path string) (io.ReadCloser, *ResultMeta, error) {
+	start := time.Now()
+	var r io.ReadCloser = ioutil.NopCloser(strings.NewReader(""))
+	var meta *ResultMeta
+	var err error
+	if method == "HEAD" {
+		meta, err = resultStorage.Head(path)
+	} else {
+		r, meta, err = resultStorage.Get(path)
+	}
+	if err != nil {
+		if err != errResultNotFound {
+			l.Error("getting stored result", "storage_ms", time.Since(start), "error", err)
+		}
+		return nil, nil, err
 	}
-	return value
+	return r, meta, nil
 }
 
+// normalizePath cleans a result path. The storage key a result is kept at,
+// including any root path, is chosen by the result_storage_layout setting.
 func normalizePath(p string) string {
-	// TODO(bgentry): Support for custom root path? ala RESULT_STORAGE_AWS_STORAGE_ROOT_PATH
 	return path.Clean(p)
 }
 
-func parseWidthAndHeight(str string) (width, height uint, err error) {
+// parseWidthAndHeight parses a WxH size. Either dimension may be omitted to
+// mean 0, and a leading "-" on a dimension requests a flip along that axis.
+func parseWidthAndHeight(str string) (width, height uint, flipH, flipV bool, err error) {
 	sizeParts := strings.Split(str, "x")
 	if len(sizeParts) != 2 {
 		err = fmt.Errorf("invalid size requested")
 		return
 	}
-	width64, err := strconv.ParseUint(sizeParts[0], 10, 64)
-	if err != nil {
-		err = fmt.Errorf("invalid width requested")
-		return
+	widthStr, heightStr := sizeParts[0], sizeParts[1]
+	if strings.HasPrefix(widthStr, "-") {
+		flipH, widthStr = true, widthStr[1:]
 	}
-	height64, err := strconv.ParseUint(sizeParts[1], 10, 64)
-	if err != nil {
-		err = fmt.Errorf("invalid height requested")
-		return
+	if strings.HasPrefix(heightStr, "-") {
+		flipV, heightStr = true, heightStr[1:]
+	}
+
+	var width64, height64 uint64
+	if widthStr != "" {
+		if width64, err = strconv.ParseUint(widthStr, 10, 64); err != nil {
+			err = fmt.Errorf("invalid width requested")
+			return
+		}
 	}
-	return uint(width64), uint(height64), nil
+	if heightStr != "" {
+		if height64, err = strconv.ParseUint(heightStr, 10, 64); err != nil {
+			err = fmt.Errorf("invalid height requested")
+			return
+		}
+	}
+	return uint(width64), uint(height64), flipH, flipV, nil
 }
 
-func setCacheHeaders(w http.ResponseWriter) {
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d,public", maxAge))
-	w.Header().Set("Expires", time.Now().UTC().Add(time.Duration(maxAge)*time.Second).Format(http.TimeFormat))
+// setCacheHeaders allows caching for maxAge seconds, or until expires when
+// that is sooner, so that an expiring URL isn't served from caches after it
+// expires. For the same reason, caches are only allowed to serve stale
+// copies of URLs that don't expire.
+func setCacheHeaders(w http.ResponseWriter, expires time.Time) {
+	now := time.Now().UTC()
+	age := maxAge
+	if !expires.IsZero() {
+		if untilExpiry := int(expires.Sub(now) / time.Second); untilExpiry < age {
+			age = maxInt(untilExpiry, 0)
+		}
+	}
+	cacheControl := fmt.Sprintf("max-age=%d,public", age)
+	if expires.IsZero() {
+		if staleWhileRevalidate > 0 {
+			cacheControl += fmt.Sprintf(",stale-while-revalidate=%d", staleWhileRevalidate/time.Second)
+		}
+		if staleIfError > 0 {
+			cacheControl += fmt.Sprintf(",stale-if-error=%d", staleIfError/time.Second)
+		}
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Expires", now.Add(time.Duration(age)*time.Second).Format(http.TimeFormat))
 }
 
-func setResultHeaders(w http.ResponseWriter, result *result) {
+func setResultHeaders(w http.ResponseWriter, result *result, expires time.Time) {
 	w.Header().Set("Content-Type", result.ContentType)
 	w.Header().Set("Content-Length", strconv.Itoa(result.ContentLength))
 	w.Header().Set("ETag", `"`+result.ETag+`"`)
-	setCacheHeaders(w)
+	if !result.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", result.LastModified.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	setCacheHeaders(w, expires)
 }
 
-func storeResult(res *result) {
-	h := make(http.Header)
-	h.Set("Content-Type", res.ContentType)
-	if useRRS {
-		h.Set("x-amz-storage-class", "REDUCED_REDUNDANCY")
-	}
-	w, err := resultBucket.PutWriter(res.Path, h, nil)
+func storeResult(l *logger, res *result) {
+	start := time.Now()
+	err := resultStorage.Put(res.Path, res.Data, &ResultMeta{
+		ContentType:        res.ContentType,
+		ETag:               res.ETag,
+		LastModified:       res.LastModified,
+		Created:            res.Created,
+		SourceETag:         res.SourceETag,
+		SourceLastModified: res.SourceLastModified,
+	})
 	if err != nil {
-		log.Printf("storing result for %s: %s", res.Path, err)
+		l.Error("storing result", "result_path", res.Path, "storage_ms", time.Since(start), "error", err)
 		return
 	}
-	defer w.Close()
-	if _, err = w.Write(res.Data); err != nil {
-		log.Printf("storing result for %s: %s", res.Path, err)
-		return
-	}
-	if err = w.Close(); err != nil {
-		log.Printf("storing result for %s: %s", res.Path, err)
-	}
-}
-
-func validateSignature(sig, pathPart string) error {
-	if unsafeMode && sig == "unsafe" {
-		return nil
-	}
-
-	h := hmac.New(sha1.New, securityKey)
-	if _, err := h.Write([]byte(pathPart)); err != nil {
-		return err
-	}
-	actualSig := base64.URLEncoding.EncodeToString(h.Sum(nil))
-	// constant-time string comparison
-	if subtle.ConstantTimeCompare([]byte(sig), []byte(actualSig)) != 1 {
-		return fmt.Errorf("signature mismatch")
+	l.Info("stored result", "result_path", res.Path, "bytes", len(res.Data), "storage_ms", time.Since(start))
+	if err = indexResult(res.Source, res.Path); err != nil {
+		l.Error("indexing result", "result_path", res.Path, "error", err)
 	}
-	return nil
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useURLSettings applies c's URL settings for a test, and returns a func
+// that restores the previous ones.
+func useURLSettings(t *testing.T, c *Config) func() {
+	unsafe, only, p, keys, accepted, signing := unsafeMode, presetsOnly, presets, securityKeys, acceptedAlgorithms, signingAlgorithm
+	if err := c.applyURLSettings(); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		unsafeMode, presetsOnly, presets, securityKeys, acceptedAlgorithms, signingAlgorithm = unsafe, only, p, keys, accepted, signing
+	}
+}
+
+// TestPublicEndpointsHideSecrets checks that keys given on the command line
+// never appear in what unauthenticated clients can fetch.
+func TestPublicEndpointsHideSecrets(t *testing.T) {
+	const key, admin = "s3cr3t-security-key", "s3cr3t-admin-key"
+	defer func(args []string, keys []*signingKey, aKey string, pool *workerPool) {
+		os.Args, securityKeys, adminKey, processingPool = args, keys, aKey, pool
+	}(os.Args, securityKeys, adminKey, processingPool)
+	os.Args = []string{"gothumb", "-k", key, "-admin-key", admin}
+	securityKeys = []*signingKey{{secret: []byte(key)}}
+	adminKey = admin
+	processingPool = newWorkerPool(1, 1, time.Second)
+
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+	get := func(p string, header http.Header) (int, string) {
+		req, _ := http.NewRequest("GET", srv.URL+p, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	wrongKey := http.Header{"Authorization": {"Bearer " + key}}
+	for _, p := range []string{"/metrics", "/admin/purge", "/bad-signature/300x200/a.jpg"} {
+		for _, header := range []http.Header{nil, wrongKey} {
+			if code, body := get(p, header); strings.Contains(body, key) || strings.Contains(body, admin) {
+				t.Errorf("GET %s (%v) = %d and leaks a key:\n%s", p, header, code, body)
+			}
+		}
+	}
+
+	if code, body := get("/debug/vars", nil); code == 200 || strings.Contains(body, "processing") {
+		t.Errorf("GET /debug/vars = %d, still serves stats:\n%s", code, body)
+	}
+	if code, body := get("/metrics", nil); code != 200 || !strings.Contains(body, "gothumb_processing_active") {
+		t.Errorf("GET /metrics = %d, has no processing stats:\n%s", code, body)
+	}
+}
+
+// TestSignatureCheckedFirst checks that requests are only told whether
+// their source is allowed once their signature checks out.
+func TestSignatureCheckedFirst(t *testing.T) {
+	c := defaultConfig()
+	c.SecurityKey = "secret"
+	defer useURLSettings(t, c)()
+	defer func(hosts []string) { allowedSourceHosts = hosts }(allowedSourceHosts)
+	allowedSourceHosts = []string{"photos.example.com"}
+
+	const p = "300x200/https://blocked.example.com/a.jpg"
+	cases := []struct {
+		sig  string
+		code int
+	}{
+		{"bad-signature", 401},
+		{securityKeys[0].sign(signingAlgorithm, p), 403},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		newHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/"+c.sig+"/"+p, nil))
+		if rec.Code != c.code {
+			t.Errorf("GET /%s/%s = %d, want %d", c.sig, p, rec.Code, c.code)
+		}
+	}
+}
+
+// TestExpiringURLs checks that a URL's validity window is enforced once its
+// signature, which covers the window, checks out.
+func TestExpiringURLs(t *testing.T) {
+	c := defaultConfig()
+	c.SecurityKey = "secret"
+	defer useURLSettings(t, c)()
+
+	now := time.Now().Unix()
+	sig := func(p string) string { return securityKeys[0].sign(signingAlgorithm, p) }
+	expired := fmt.Sprintf("expires:%d/300x200/https://photos.example.com/a.jpg", now-60)
+	extended := fmt.Sprintf("expires:%d/300x200/https://photos.example.com/a.jpg", now+3600)
+	notYet := fmt.Sprintf("expires:%d/not-before:%d/300x200/https://photos.example.com/a.jpg", now+3600, now+60)
+	cases := []struct {
+		path string
+		code int
+	}{
+		{"/" + sig(expired) + "/" + expired, 410},
+		{"/" + sig(notYet) + "/" + notYet, 403},
+		{"/" + sig(expired) + "/" + extended, 401},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		newHandler().ServeHTTP(rec, httptest.NewRequest("GET", c.path, nil))
+		if rec.Code != c.code {
+			t.Errorf("GET %s = %d, want %d", c.path, rec.Code, c.code)
+		}
+	}
+}
+
+func TestSetCacheHeaders(t *testing.T) {
+	defer func(age int, swr, sie time.Duration) {
+		maxAge, staleWhileRevalidate, staleIfError = age, swr, sie
+	}(maxAge, staleWhileRevalidate, staleIfError)
+	maxAge, staleWhileRevalidate, staleIfError = 3600, time.Minute, time.Hour
+
+	cases := []struct {
+		expires time.Time
+		want    string
+	}{
+		{time.Time{}, "max-age=3600,public,stale-while-revalidate=60,stale-if-error=3600"},
+		{time.Now().Add(24 * time.Hour), "max-age=3600,public"},
+		{time.Now().Add(10*time.Minute + time.Second), "max-age=600,public"},
+		{time.Now().Add(-time.Minute), "max-age=0,public"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		setCacheHeaders(rec, c.expires)
+		if got := rec.Header().Get("Cache-Control"); got != c.want {
+			t.Errorf("expires %v: Cache-Control %q, want %q", c.expires, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements just enough of the Prometheus text exposition format
+// to publish gothumb's counters and histograms at /metrics without pulling in
+// the Prometheus client library.
+
+var (
+	sourceFetchDuration = newHistogramVec("gothumb_source_fetch_duration_seconds",
+		"Time spent loading source images.", latencyBuckets, "scheme", "result")
+	sourceFetchBytes = newHistogramVec("gothumb_source_fetch_bytes",
+		"Size of loaded source images.", sizeBuckets, "scheme")
+	resizeDuration = newHistogramVec("gothumb_resize_duration_seconds",
+		"Time spent processing images with libvips.", latencyBuckets, "format")
+	storageDuration = newHistogramVec("gothumb_storage_duration_seconds",
+		"Latency of result storage operations.", latencyBuckets, "operation")
+	storageErrors = newCounterVec("gothumb_storage_errors_total",
+		"Result storage operations that failed.", "operation")
+	storedResultLookups = newCounterVec("gothumb_stored_result_lookups_total",
+		"Stored result lookups by outcome (hit or miss).", "outcome")
+	responses = newCounterVec("gothumb_responses_total",
+		"Responses to image requests by status code.", "code")
+	processingWait = newHistogramVec("gothumb_processing_wait_seconds",
+		"Time requests spent queued for a processing slot.", latencyBuckets)
+	processingRejected = newCounterVec("gothumb_processing_rejected_total",
+		"Requests turned away by the processing pool.", "reason")
+
+	metricsRegistry = []metricWriter{
+		sourceFetchDuration,
+		sourceFetchBytes,
+		resizeDuration,
+		storageDuration,
+		storageErrors,
+		storedResultLookups,
+		responses,
+		processingWait,
+		processingRejected,
+		signatureMatches,
+		signatureFailures,
+		resultCacheLookups,
+		resultCacheRemovals,
+		sourceCacheLookups,
+		staleResults,
+		purgedResults,
+		&gaugeFunc{"gothumb_processing_active", "Images currently being processed.", func() float64 { return float64(processingPool.Active()) }},
+		&gaugeFunc{"gothumb_processing_queued", "Requests waiting for a processing slot.", func() float64 { return float64(processingPool.Queued()) }},
+		&gaugeFunc{"gothumb_result_cache_bytes", "Size of the results in the in-memory cache.", func() float64 { bytes, _ := cachedResults.Size(); return float64(bytes) }},
+		&gaugeFunc{"gothumb_result_cache_entries", "Results in the in-memory cache.", func() float64 { _, entries := cachedResults.Size(); return float64(entries) }},
+	}
+)
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+	sizeBuckets    = []float64{16 * 1024, 64 * 1024, 256 * 1024, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+)
+
+type metricWriter interface {
+	writeMetric(w io.Writer)
+}
+
+// handleMetrics serves every registered metric in the Prometheus text
+// format.
+func handleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	for _, m := range metricsRegistry {
+		m.writeMetric(bw)
+	}
+	bw.Flush()
+}
+
+// counterVec is a set of counters partitioned by label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Inc increments the counter for the given label values.
+func (c *counterVec) Inc(labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeMetric(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+// histogramVec is a set of histograms partitioned by label values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // cumulative counts are computed when writing
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+// Observe records v in the histogram for the given label values.
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *histogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeMetric(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatValue(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatValue(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+// gaugeFunc is a gauge whose value is read when metrics are collected.
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func (g *gaugeFunc) writeMetric(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatValue(g.fn()))
+}
+
+// formatLabels renders label pairs as {a="x",b="y"}, or "" without labels.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + escapeLabelValue(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds one more label pair to an already formatted label set.
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + escapeLabelValue(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = 200
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// countResponses wraps h to count its responses by status code.
+func countResponses(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, req)
+		if rec.status == 0 {
+			rec.status = 200
+		}
+		responses.Inc(strconv.Itoa(rec.status))
+	})
+}
+
+// instrumentedStorage records latency and errors for a ResultStorage.
+type instrumentedStorage struct {
+	ResultStorage
+}
+
+func (s instrumentedStorage) observe(op string, start time.Time, err error) {
+	storageDuration.ObserveSince(start, op)
+	if err != nil && err != errResultNotFound {
+		storageErrors.Inc(op)
+	}
+}
+
+func (s instrumentedStorage) Get(path string) (io.ReadCloser, *ResultMeta, error) {
+	start := time.Now()
+	r, meta, err := s.ResultStorage.Get(path)
+	s.observe("get", start, err)
+	return r, meta, err
+}
+
+func (s instrumentedStorage) Head(path string) (*ResultMeta, error) {
+	start := time.Now()
+	meta, err := s.ResultStorage.Head(path)
+	s.observe("head", start, err)
+	return meta, err
+}
+
+func (s instrumentedStorage) Put(path string, data []byte, meta *ResultMeta) error {
+	start := time.Now()
+	err := s.ResultStorage.Put(path, data, meta)
+	s.observe("put", start, err)
+	return err
+}
+
+func (s instrumentedStorage) UpdateMeta(path string, meta *ResultMeta) error {
+	updater, ok := s.ResultStorage.(MetaUpdater)
+	if !ok {
+		return errMetaUpdateUnsupported
+	}
+	start := time.Now()
+	err := updater.UpdateMeta(path, meta)
+	s.observe("update_meta", start, err)
+	return err
+}
+
+func (s instrumentedStorage) Delete(path string) error {
+	start := time.Now()
+	err := s.ResultStorage.Delete(path)
+	s.observe("delete", start, err)
+	return err
+}
+
+// List isn't timed, since its duration includes whatever fn does with each
+// path.
+func (s instrumentedStorage) List(prefix string, fn func(path string) error) error {
+	lister, ok := s.ResultStorage.(ResultLister)
+	if !ok {
+		return errListUnsupported
+	}
+	return lister.List(prefix, fn)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("test_total", "Things counted.", "kind", "result")
+	c.Inc("b", "ok")
+	c.Inc("a", "ok")
+	c.Inc("b", "ok")
+	c.Inc("a", `say "hi"`+"\n")
+
+	var buf bytes.Buffer
+	c.writeMetric(&buf)
+	want := `# HELP test_total Things counted.
+# TYPE test_total counter
+test_total{kind="a",result="ok"} 1
+test_total{kind="a",result="say \"hi\"\n"} 1
+test_total{kind="b",result="ok"} 2
+`
+	if buf.String() != want {
+		t.Errorf("counter output:\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Time taken.", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "get")
+	h.Observe(0.1, "get")
+	h.Observe(0.5, "get")
+	h.Observe(5, "get")
+
+	var buf bytes.Buffer
+	h.writeMetric(&buf)
+	want := `# HELP test_seconds Time taken.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="get",le="0.1"} 2
+test_seconds_bucket{op="get",le="1"} 3
+test_seconds_bucket{op="get",le="+Inf"} 4
+test_seconds_sum{op="get"} 5.65
+test_seconds_count{op="get"} 4
+`
+	if buf.String() != want {
+		t.Errorf("histogram output:\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	unlabeled := newHistogramVec("test_wait_seconds", "Time waited.", []float64{1})
+	unlabeled.Observe(2)
+	buf.Reset()
+	unlabeled.writeMetric(&buf)
+	if !strings.Contains(buf.String(), "test_wait_seconds_bucket{le=\"1\"} 0\n") || !strings.Contains(buf.String(), "test_wait_seconds_count 1\n") {
+		t.Errorf("unlabeled histogram output:\n%s", buf.String())
+	}
+}
+
+// TestHandleMetrics checks that every registered metric is written in the
+// text format, once.
+func TestHandleMetrics(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %s", ct)
+	}
+
+	sample := regexp.MustCompile(`^[a-z_]+(\{.*\})? [-+0-9.eInf]+$`)
+	types := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			types[strings.Fields(line)[2]]++
+			continue
+		}
+		if !strings.HasPrefix(line, "# HELP ") && !sample.MatchString(line) {
+			t.Errorf("malformed line %q", line)
+		}
+	}
+	if len(types) != len(metricsRegistry) {
+		t.Errorf("%d metrics written, want %d", len(types), len(metricsRegistry))
+	}
+	for name, n := range types {
+		if n != 1 || !strings.HasPrefix(name, "gothumb_") {
+			t.Errorf("metric %s written %d times", name, n)
+		}
+	}
+}
+
+func TestCountResponses(t *testing.T) {
+	h := countResponses(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/missing":
+			http.NotFound(w, req)
+		case "/ok":
+			w.Write([]byte("ok"))
+		}
+	}))
+	count := func(code string) float64 {
+		responses.mu.Lock()
+		defer responses.mu.Unlock()
+		return responses.values[formatLabels(responses.labels, []string{code})]
+	}
+	before404, before200 := count("404"), count("200")
+	for _, p := range []string{"/missing", "/ok", "/empty"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", p, nil))
+	}
+	if n := count("404") - before404; n != 1 {
+		t.Errorf("counted %g 404s, want 1", n)
+	}
+	if n := count("200") - before200; n != 2 {
+		t.Errorf("counted %g 200s, want 2", n)
+	}
+}
+
+type failingStorage struct{ ResultStorage }
+
+func (failingStorage) Put(string, []byte, *ResultMeta) error { return errors.New("disk full") }
+func (failingStorage) Get(string) (io.ReadCloser, *ResultMeta, error) {
+	return nil, nil, errResultNotFound
+}
+
+func TestInstrumentedStorage(t *testing.T) {
+	errorCount := func(op string) float64 {
+		storageErrors.mu.Lock()
+		defer storageErrors.mu.Unlock()
+		return storageErrors.values[formatLabels(storageErrors.labels, []string{op})]
+	}
+	beforePut, beforeGet := errorCount("put"), errorCount("get")
+
+	s := instrumentedStorage{failingStorage{newMemoryResultStorage()}}
+	if err := s.Put("/a.jpg", []byte("x"), &ResultMeta{}); err == nil {
+		t.Error("Put passed over the error")
+	}
+	if _, _, err := s.Get("/a.jpg"); err != errResultNotFound {
+		t.Errorf("Get = %v, want errResultNotFound", err)
+	}
+	if n := errorCount("put") - beforePut; n != 1 {
+		t.Errorf("counted %g put errors, want 1", n)
+	}
+	if n := errorCount("get") - beforeGet; n != 0 {
+		t.Errorf("counted %g get errors for a missing result, want 0", n)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opendoor-labs/gothumb/urlbuilder"
+)
+
+// imageOptions holds the processing options parsed from a Thumbor-style
+// request path:
+//
+//	[expires:<unix time>/][not-before:<unix time>/]
+//	[trim[:top-left|:bottom-right][:tolerance]/][AxB:CxD/][fit-in/][-]WxH[-]/
+//	[left|center|right/][top|middle|bottom/][smart/][filters:name(args)...:name(args)/]source
+//
+// Every segment before the source is optional. Without fit-in, a size is
+// only cropped to fill when an alignment or smart is given; a bare WxH is
+// scaled to the size as it was before gothumb took Thumbor-style URLs, so
+// that results stored from those URLs stay valid. Instead of the processing
+// options, a path may name a configured preset:
+//
+//	[expires:<unix time>/][not-before:<unix time>/]preset:<name>/source
+type imageOptions struct {
+	// Validity window of a signed URL. Zero when unbounded.
+	Expires, NotBefore time.Time
+
+	Trim          bool
+	TrimPosition  string // "top-left" or "bottom-right"
+	TrimTolerance int
+
+	// Manual crop rectangle in source pixels, applied before resizing. All
+	// zero when no crop was requested.
+	CropLeft, CropTop, CropRight, CropBottom int
+
+	FitIn          bool
+	Width, Height  uint
+	FlipHorizontal bool
+	FlipVertical   bool
+	HAlign         string // "left", "center" or "right"
+	VAlign         string // "top", "middle" or "bottom"
+	Smart          bool
+	Filters        []filter
+
+	// Preset is the name of the preset the options came from, if any.
+	Preset string
+
+	Source string
+}
+
+// rawFilter is a single unvalidated name(args) call from the filters:
+// segment.
+type rawFilter struct {
+	Name string
+	Args []string
+}
+
+var (
+	trimRegexp = regexp.MustCompile(`^trim(?::(top-left|bottom-right))?(?::(\d+))?$`)
+	cropRegexp = regexp.MustCompile(`^(\d+)x(\d+):(\d+)x(\d+)$`)
+	sizeRegexp = regexp.MustCompile(`^-?\d*x-?\d*$`)
+)
+
+// checkValidity returns a 410 once the URL has expired and a 403 before its
+// not-before time.
+func (o *imageOptions) checkValidity(now time.Time) error {
+	if !o.Expires.IsZero() && !now.Before(o.Expires) {
+		return &statusError{Code: 410, Message: "URL expired"}
+	}
+	if !o.NotBefore.IsZero() && now.Before(o.NotBefore) {
+		return &statusError{Code: 403, Message: "URL not valid yet"}
+	}
+	return nil
+}
+
+// HasCrop reports whether a manual crop rectangle was requested.
+func (o *imageOptions) HasCrop() bool {
+	return o.CropRight > o.CropLeft && o.CropBottom > o.CropTop
+}
+
+// fills reports whether the image is cropped to fill its size. A bare size
+// is handed to bimg as it always was in gothumb, and an alignment or smart
+// asks for Thumbor's crop.
+func (o *imageOptions) fills() bool {
+	return !o.FitIn && (o.HAlign != "" || o.VAlign != "" || o.Smart)
+}
+
+// flips returns the orientation the requested flips amount to.
+func (o *imageOptions) flips() orientation {
+	var orient orientation
+	if o.FlipHorizontal {
+		orient = orient.then(orientation{flip: true})
+	}
+	if o.FlipVertical {
+		orient = orient.then(orientation{angle: 180, flip: true})
+	}
+	return orient
+}
+
+// HasFormat reports whether the output format was chosen explicitly with the
+// format filter.
+func (o *imageOptions) HasFormat() bool {
+	for _, f := range o.Filters {
+		if _, ok := f.(formatFilter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the canonical path for o, without a leading slash.
+// Equivalent URLs produce the same string, which makes it suitable as a key
+// for stored results. The validity window is left out since it doesn't
+// change the image.
+func (o *imageOptions) String() string {
+	var segments []string
+	if o.Trim {
+		trim := "trim"
+		if o.TrimPosition != "top-left" {
+			trim += ":" + o.TrimPosition
+		}
+		if o.TrimTolerance > 0 {
+			trim += ":" + strconv.Itoa(o.TrimTolerance)
+		}
+		segments = append(segments, trim)
+	}
+	if o.HasCrop() {
+		segments = append(segments, fmt.Sprintf("%dx%d:%dx%d", o.CropLeft, o.CropTop, o.CropRight, o.CropBottom))
+	}
+	if o.FitIn {
+		segments = append(segments, "fit-in")
+	}
+
+	size := ""
+	if o.FlipHorizontal {
+		size += "-"
+	}
+	size += strconv.FormatUint(uint64(o.Width), 10) + "x"
+	if o.FlipVertical {
+		size += "-"
+	}
+	size += strconv.FormatUint(uint64(o.Height), 10)
+	segments = append(segments, size)
+
+	// The default alignments are left out, unless they are all that asks
+	// for a crop.
+	halign, valign := o.HAlign, o.VAlign
+	if halign == "center" {
+		halign = ""
+	}
+	if valign == "middle" {
+		valign = ""
+	}
+	if halign == "" && valign == "" && o.fills() && !o.Smart {
+		halign = "center"
+	}
+	if halign != "" {
+		segments = append(segments, halign)
+	}
+	if valign != "" {
+		segments = append(segments, valign)
+	}
+	if o.Smart {
+		segments = append(segments, "smart")
+	}
+	if len(o.Filters) > 0 {
+		names := make([]string, len(o.Filters))
+		for i, f := range o.Filters {
+			names[i] = f.String()
+		}
+		segments = append(segments, "filters:"+strings.Join(names, ":"))
+	}
+	return strings.Join(append(segments, o.Source), "/")
+}
+
+// signedPath returns the canonical escaped path a URL for o is signed over:
+// String with the validity window in front.
+func (o *imageOptions) signedPath() string {
+	p := o.String()
+	if o.Preset != "" {
+		p = "preset:" + o.Preset + "/" + o.Source
+	}
+	if !o.NotBefore.IsZero() {
+		p = "not-before:" + strconv.FormatInt(o.NotBefore.Unix(), 10) + "/" + p
+	}
+	if !o.Expires.IsZero() {
+		p = "expires:" + strconv.FormatInt(o.Expires.Unix(), 10) + "/" + p
+	}
+	return urlbuilder.EscapePath(p)
+}
+
+// parseImageOptions parses an unsigned request path (everything after the
+// signature) into imageOptions.
+func parseImageOptions(p string) (*imageOptions, error) {
+	opts := &imageOptions{}
+	rest := strings.TrimPrefix(p, "/")
+
+	segment, next := nextSegment(rest)
+	if strings.HasPrefix(segment, "expires:") {
+		t, err := parseUnixTime(strings.TrimPrefix(segment, "expires:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires: %s", err)
+		}
+		opts.Expires = t
+		rest = next
+		segment, next = nextSegment(rest)
+	}
+
+	if strings.HasPrefix(segment, "not-before:") {
+		t, err := parseUnixTime(strings.TrimPrefix(segment, "not-before:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid not-before: %s", err)
+		}
+		opts.NotBefore = t
+		rest = next
+		segment, next = nextSegment(rest)
+	}
+
+	if strings.HasPrefix(segment, "preset:") {
+		if err := opts.applyPreset(strings.TrimPrefix(segment, "preset:")); err != nil {
+			return nil, err
+		}
+		if next == "" {
+			return nil, fmt.Errorf("missing source")
+		}
+		opts.Source = next
+		return opts, nil
+	}
+
+	if m := trimRegexp.FindStringSubmatch(segment); m != nil {
+		opts.Trim = true
+		opts.TrimPosition = m[1]
+		if opts.TrimPosition == "" {
+			opts.TrimPosition = "top-left"
+		}
+		if m[2] != "" {
+			opts.TrimTolerance, _ = strconv.Atoi(m[2])
+		}
+		rest = next
+		segment, next = nextSegment(rest)
+	}
+
+	if m := cropRegexp.FindStringSubmatch(segment); m != nil {
+		opts.CropLeft, _ = strconv.Atoi(m[1])
+		opts.CropTop, _ = strconv.Atoi(m[2])
+		opts.CropRight, _ = strconv.Atoi(m[3])
+		opts.CropBottom, _ = strconv.Atoi(m[4])
+		if !opts.HasCrop() {
+			return nil, fmt.Errorf("invalid crop requested")
+		}
+		rest = next
+		segment, next = nextSegment(rest)
+	}
+
+	if segment == "fit-in" {
+		opts.FitIn = true
+		rest = next
+		segment, next = nextSegment(rest)
+	}
+
+	if sizeRegexp.MatchString(segment) {
+		var err error
+		opts.Width, opts.Height, opts.FlipHorizontal, opts.FlipVertical, err = parseWidthAndHeight(segment)
+		if err != nil {
+			return nil, err
+		}
+		rest = next
+		segment, next = nextSegment(rest)
+	}
+
+	switch segment {
+	case "left", "center", "right":
+		opts.HAlign = segment
+		rest = next
+		segment, next = nextSegment(rest)
+	}
+
+	switch segment {
+	case "top", "middle", "bottom":
+		opts.VAlign = segment
+		rest = next
+		segment, next = nextSegment(rest)
+	}
+
+	if segment == "smart" {
+		opts.Smart = true
+		rest = next
+	}
+
+	if strings.HasPrefix(rest, "filters:") {
+		// filter arguments may themselves contain slashes (e.g. a watermark
+		// URL), so the segment ends at the first ")/" rather than "/".
+		end := strings.Index(rest, ")/")
+		if end == -1 {
+			return nil, fmt.Errorf("invalid filters requested")
+		}
+		rawFilters, err := parseFilters(rest[len("filters:") : end+1])
+		if err != nil {
+			return nil, err
+		}
+		for _, rf := range rawFilters {
+			f, err := newFilter(rf.Name, rf.Args)
+			if err != nil {
+				return nil, err
+			}
+			opts.Filters = append(opts.Filters, f)
+		}
+		rest = rest[end+2:]
+	}
+
+	if rest == "" {
+		return nil, fmt.Errorf("missing source")
+	}
+	opts.Source = rest
+	return opts, nil
+}
+
+// nextSegment splits the first slash-separated segment off of p.
+func nextSegment(p string) (segment, rest string) {
+	if i := strings.Index(p, "/"); i != -1 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// parseFilters parses a colon-separated list of name(args) calls. Arguments
+// are separated by commas and may contain colons and nested parentheses.
+func parseFilters(str string) ([]rawFilter, error) {
+	var filters []rawFilter
+	for str != "" {
+		open := strings.Index(str, "(")
+		if open <= 0 {
+			return nil, fmt.Errorf("invalid filter %q", str)
+		}
+		f := rawFilter{Name: str[:open]}
+
+		depth, argStart, closed := 0, open+1, -1
+		for i := open + 1; i < len(str) && closed == -1; i++ {
+			switch str[i] {
+			case '(':
+				depth++
+			case ')':
+				if depth == 0 {
+					closed = i
+				}
+				depth--
+			case ',':
+				if depth == 0 {
+					f.Args = append(f.Args, str[argStart:i])
+					argStart = i + 1
+				}
+			}
+		}
+		if closed == -1 {
+			return nil, fmt.Errorf("unterminated filter %q", f.Name)
+		}
+		if arg := str[argStart:closed]; arg != "" || len(f.Args) > 0 {
+			f.Args = append(f.Args, arg)
+		}
+		filters = append(filters, f)
+
+		str = str[closed+1:]
+		if str != "" {
+			if str[0] != ':' {
+				return nil, fmt.Errorf("invalid filters requested")
+			}
+			str = str[1:]
+		}
+	}
+	return filters, nil
+}
+
+func parseUnixTime(s string) (time.Time, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return time.Time{}, fmt.Errorf("%q is not a unix time", s)
+	}
+	return time.Unix(n, 0).UTC(), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestParseImageOptions(t *testing.T) {
+	cases := []struct {
+		path string
+		want imageOptions
+		key  string
+	}{
+		{
+			path: "300x200/https://example.com/a.jpg",
+			want: imageOptions{Width: 300, Height: 200, Source: "https://example.com/a.jpg"},
+			key:  "300x200/https://example.com/a.jpg",
+		},
+		{
+			path: "/x200/a.jpg",
+			want: imageOptions{Height: 200, Source: "a.jpg"},
+			key:  "0x200/a.jpg",
+		},
+		{
+			path: "-300x-200/a.jpg",
+			want: imageOptions{Width: 300, Height: 200, FlipHorizontal: true, FlipVertical: true, Source: "a.jpg"},
+			key:  "-300x-200/a.jpg",
+		},
+		{
+			path: "-x/a.jpg",
+			want: imageOptions{FlipHorizontal: true, Source: "a.jpg"},
+			key:  "-0x0/a.jpg",
+		},
+		{
+			path: "trim/a.jpg",
+			want: imageOptions{Trim: true, TrimPosition: "top-left", Source: "a.jpg"},
+			key:  "trim/0x0/a.jpg",
+		},
+		{
+			path: "trim:top-left:0/a.jpg",
+			want: imageOptions{Trim: true, TrimPosition: "top-left", Source: "a.jpg"},
+			key:  "trim/0x0/a.jpg",
+		},
+		{
+			path: "trim:bottom-right:15/a.jpg",
+			want: imageOptions{Trim: true, TrimPosition: "bottom-right", TrimTolerance: 15, Source: "a.jpg"},
+			key:  "trim:bottom-right:15/0x0/a.jpg",
+		},
+		{
+			path: "trim:20/a.jpg",
+			want: imageOptions{Trim: true, TrimPosition: "top-left", TrimTolerance: 20, Source: "a.jpg"},
+			key:  "trim:20/0x0/a.jpg",
+		},
+		{
+			path: "10x20:310x220/fit-in/150x100/right/bottom/smart/a.jpg",
+			want: imageOptions{
+				CropLeft: 10, CropTop: 20, CropRight: 310, CropBottom: 220,
+				FitIn: true, Width: 150, Height: 100,
+				HAlign: "right", VAlign: "bottom", Smart: true, Source: "a.jpg",
+			},
+			key: "10x20:310x220/fit-in/150x100/right/bottom/smart/a.jpg",
+		},
+		{
+			// The default alignments still ask for a crop.
+			path: "300x200/center/middle/a.jpg",
+			want: imageOptions{Width: 300, Height: 200, HAlign: "center", VAlign: "middle", Source: "a.jpg"},
+			key:  "300x200/center/a.jpg",
+		},
+		{
+			path: "300x200/middle/smart/a.jpg",
+			want: imageOptions{Width: 300, Height: 200, VAlign: "middle", Smart: true, Source: "a.jpg"},
+			key:  "300x200/smart/a.jpg",
+		},
+		{
+			path: "expires:1893456000/not-before:1577836800/300x200/a.jpg",
+			want: imageOptions{
+				Expires:   time.Unix(1893456000, 0).UTC(),
+				NotBefore: time.Unix(1577836800, 0).UTC(),
+				Width:     300, Height: 200, Source: "a.jpg",
+			},
+			key: "300x200/a.jpg",
+		},
+		{
+			path: "300x200/filters:quality(80):grayscale()/a.jpg",
+			want: imageOptions{
+				Width: 300, Height: 200,
+				Filters: []filter{qualityFilter{80}, grayscaleFilter{}},
+				Source:  "a.jpg",
+			},
+			key: "300x200/filters:quality(80):grayscale()/a.jpg",
+		},
+		{
+			path: "filters:format(JPG)/a.jpg",
+			want: imageOptions{Filters: []filter{formatFilter{bimg.JPEG}}, Source: "a.jpg"},
+			key:  "0x0/filters:format(jpeg)/a.jpg",
+		},
+		{
+			// Sources keep their own slashes and query strings.
+			path: "300x200/https://example.com/a/b.jpg?w=1",
+			want: imageOptions{Width: 300, Height: 200, Source: "https://example.com/a/b.jpg?w=1"},
+			key:  "300x200/https://example.com/a/b.jpg?w=1",
+		},
+	}
+	for _, c := range cases {
+		opts, err := parseImageOptions(c.path)
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(*opts, c.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", c.path, *opts, c.want)
+		}
+		key := opts.String()
+		if key != c.key {
+			t.Errorf("%s: String() = %s, want %s", c.path, key, c.key)
+		}
+
+		// The canonical form parses back to the same options.
+		again, err := parseImageOptions(key)
+		if err != nil {
+			t.Errorf("%s: reparsing %s: %v", c.path, key, err)
+			continue
+		}
+		if got := again.String(); got != key {
+			t.Errorf("%s: String() of reparsed %s = %s", c.path, key, got)
+		}
+		again.Expires, again.NotBefore = opts.Expires, opts.NotBefore
+		if opts.HAlign == "center" || opts.VAlign == "middle" {
+			continue // the defaults are dropped from the key where they can be
+		}
+		if !reflect.DeepEqual(again, opts) {
+			t.Errorf("%s: reparsed %s:\n got %+v\nwant %+v", c.path, key, again, opts)
+		}
+	}
+}
+
+func TestParseImageOptionsErrors(t *testing.T) {
+	for _, p := range []string{
+		"",
+		"300x200/",
+		"expires:abc/300x200/a.jpg",
+		"expires:-5/300x200/a.jpg",
+		"not-before:x/a.jpg",
+		"310x220:10x20/a.jpg",
+		"0x0:0x0/a.jpg",
+		"filters:quality(80)",
+		"filters:quality(80/a.jpg",
+		"filters:nosuch()/a.jpg",
+		"filters:quality(101)/a.jpg",
+		"filters:quality(80)grayscale()/a.jpg",
+		"preset:missing/a.jpg",
+	} {
+		if opts, err := parseImageOptions(p); err == nil {
+			t.Errorf("%q parsed as %+v, want an error", p, opts)
+		}
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	got, err := parseFilters("watermark(https://example.com/m.png?a=(1),10,20,50):blur(2,1):grayscale()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []rawFilter{
+		{Name: "watermark", Args: []string{"https://example.com/m.png?a=(1)", "10", "20", "50"}},
+		{Name: "blur", Args: []string{"2", "1"}},
+		{Name: "grayscale"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFilters =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestCheckValidity(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cases := []struct {
+		opts imageOptions
+		code int
+	}{
+		{imageOptions{}, 0},
+		{imageOptions{Expires: now.Add(time.Second)}, 0},
+		{imageOptions{Expires: now}, 410},
+		{imageOptions{NotBefore: now}, 0},
+		{imageOptions{NotBefore: now.Add(time.Second)}, 403},
+	}
+	for _, c := range cases {
+		err := c.opts.checkValidity(now)
+		code := 0
+		if serr, ok := err.(*statusError); ok {
+			code = serr.Code
+		}
+		if code != c.code {
+			t.Errorf("checkValidity(%v-%v) = %v, want status %d", c.opts.NotBefore, c.opts.Expires, err, c.code)
+		}
+	}
+}
+
+func TestFills(t *testing.T) {
+	cases := map[string]bool{
+		"300x200/a.jpg":                     false,
+		"300x200/filters:quality(80)/a.jpg": false,
+		"-300x-200/a.jpg":                   false,
+		"trim/10x20:310x220/300x200/a.jpg":  false,
+		"300x200/center/a.jpg":              true,
+		"300x200/left/top/a.jpg":            true,
+		"300x200/smart/a.jpg":               true,
+		"fit-in/300x200/center/smart/a.jpg": false,
+		"fit-in/300x200/right/a.jpg":        false,
+	}
+	for p, want := range cases {
+		opts, err := parseImageOptions(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := opts.fills(); got != want {
+			t.Errorf("%s: fills() = %v, want %v", p, got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// workerPool bounds how many images are processed at once. Requests beyond
+// the limit wait in a queue of bounded depth, and are turned away with a 503
+// when the queue is full or they have waited too long.
+type workerPool struct {
+	slots    chan struct{}
+	maxQueue int64
+	timeout  time.Duration
+	queued   int64
+}
+
+// newWorkerPool returns a pool running at most concurrency jobs, with at most
+// maxQueue more waiting up to timeout each.
+func newWorkerPool(concurrency, maxQueue int, timeout time.Duration) *workerPool {
+	return &workerPool{
+		slots:    make(chan struct{}, concurrency),
+		maxQueue: int64(maxQueue),
+		timeout:  timeout,
+	}
+}
+
+// Acquire reserves a processing slot. The returned func releases it and must
+// be called once the work is done.
+func (p *workerPool) Acquire() (release func(), err error) {
+	select {
+	case p.slots <- struct{}{}:
+		return p.release, nil
+	default:
+	}
+
+	if atomic.AddInt64(&p.queued, 1) > p.maxQueue {
+		atomic.AddInt64(&p.queued, -1)
+		processingRejected.Inc("queue_full")
+		return nil, p.saturatedError("processing queue is full")
+	}
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&p.queued, -1)
+		processingWait.ObserveSince(start)
+	}()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return p.release, nil
+	case <-timer.C:
+		processingRejected.Inc("timeout")
+		return nil, p.saturatedError("timed out waiting for a processing slot")
+	}
+}
+
+// Saturated reports whether every processing slot is busy and the queue is
+// full, so that new work would be rejected.
+func (p *workerPool) Saturated() bool {
+	return len(p.slots) == cap(p.slots) && atomic.LoadInt64(&p.queued) >= p.maxQueue
+}
+
+// Active returns how many jobs are running, and Queued how many are waiting
+// for a slot. Both are 0 for a nil pool.
+func (p *workerPool) Active() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.slots)
+}
+
+func (p *workerPool) Queued() int {
+	if p == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&p.queued))
+}
+
+func (p *workerPool) release() {
+	<-p.slots
+}
+
+func (p *workerPool) saturatedError(msg string) *statusError {
+	return &statusError{
+		Code:       503,
+		Message:    msg,
+		RetryAfter: int(math.Ceil(p.timeout.Seconds())),
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolQueueFull(t *testing.T) {
+	p := newWorkerPool(1, 1, time.Minute)
+	release, err := p.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Saturated() {
+		t.Error("pool with an empty queue reported saturated")
+	}
+
+	queued := make(chan error, 1)
+	go func() {
+		release, err := p.Acquire()
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	for !p.Saturated() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if p.Active() != 1 || p.Queued() != 1 {
+		t.Errorf("pool has %d active and %d queued, want 1 and 1", p.Active(), p.Queued())
+	}
+
+	_, err = p.Acquire()
+	serr, ok := err.(*statusError)
+	if !ok || serr.Code != 503 || serr.RetryAfter != 60 {
+		t.Errorf("Acquire with a full queue = %#v, want a 503 retrying after 60s", err)
+	}
+
+	release()
+	if err = <-queued; err != nil {
+		t.Errorf("queued Acquire: %v", err)
+	}
+	if p.Saturated() {
+		t.Error("pool still saturated once the work is done")
+	}
+	if p.Active() != 0 || p.Queued() != 0 {
+		t.Errorf("idle pool has %d active and %d queued", p.Active(), p.Queued())
+	}
+}
+
+func TestWorkerPoolQueueTimeout(t *testing.T) {
+	p := newWorkerPool(1, 5, 10*time.Millisecond)
+	release, err := p.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = p.Acquire()
+	if serr, ok := err.(*statusError); !ok || serr.Code != 503 || serr.RetryAfter != 1 {
+		t.Errorf("Acquire past the queue timeout = %#v, want a 503 retrying after 1s", err)
+	}
+	if waited := time.Since(start); waited < 10*time.Millisecond {
+		t.Errorf("Acquire gave up after %s, before the queue timeout", waited)
+	}
+
+	release()
+	if release, err = p.Acquire(); err != nil {
+		t.Errorf("Acquire after a release: %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestWorkerPoolNoQueue(t *testing.T) {
+	p := newWorkerPool(2, 0, time.Minute)
+	r1, err1 := p.Acquire()
+	r2, err2 := p.Acquire()
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Acquire within the concurrency: %v, %v", err1, err2)
+	}
+	if !p.Saturated() {
+		t.Error("pool with every slot busy and no queue isn't saturated")
+	}
+	if _, err := p.Acquire(); err == nil {
+		t.Error("Acquire beyond the concurrency with no queue succeeded")
+	}
+	r1()
+	r2()
+}
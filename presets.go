@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// presets are the named option sets usable as preset:<name> in URLs.
+	presets = map[string]*imageOptions{}
+	// presetsOnly rejects URLs that don't use a preset, which bounds the
+	// number of distinct results that can be requested.
+	presetsOnly bool
+)
+
+var presetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// presetSource stands in for the source when parsing a preset's options.
+const presetSource = "preset-source"
+
+// parsePresets parses preset definitions, each written as the options part
+// of a URL path, e.g. card=fit-in/300x200/filters:quality(80).
+func parsePresets(defs map[string]string) (map[string]*imageOptions, error) {
+	parsed := make(map[string]*imageOptions)
+	for _, name := range sortedStringKeys(defs) {
+		if !presetNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid preset name %q: names may only use letters, digits, - and _", name)
+		}
+		def := strings.Trim(defs[name], "/")
+		if def == "" {
+			return nil, fmt.Errorf("preset %s is empty", name)
+		}
+		opts, err := parseImageOptions(def + "/" + presetSource)
+		if err == nil && (opts.Source != presetSource || opts.Preset != "" || !opts.Expires.IsZero() || !opts.NotBefore.IsZero()) {
+			err = errors.New("expected only processing options, such as fit-in/300x200/smart")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("preset %s: %s", name, err)
+		}
+		parsed[name] = opts
+	}
+	return parsed, nil
+}
+
+// applyPreset replaces o's processing options with those of the named
+// preset, keeping its validity window.
+func (o *imageOptions) applyPreset(name string) error {
+	p, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset %q", name)
+	}
+	expires, notBefore := o.Expires, o.NotBefore
+	*o = *p
+	// Copied so that filters added for this request don't change the preset.
+	o.Filters = append([]filter(nil), p.Filters...)
+	o.Expires, o.NotBefore, o.Preset = expires, notBefore, name
+	return nil
+}
+
+// checkPresetsOnly rejects options that don't come from a preset when the
+// server only allows presets.
+func checkPresetsOnly(opts *imageOptions) error {
+	if presetsOnly && opts.Preset == "" {
+		return &statusError{Code: 400, Message: "only preset URLs are allowed, e.g. /<signature>/preset:<name>/<source>"}
+	}
+	return nil
+}
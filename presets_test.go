@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePresets(t *testing.T) {
+	got, err := parsePresets(map[string]string{
+		"card":    "fit-in/300x200/filters:quality(80)",
+		"Thumb_2": "/100x100/smart/",
+		"gray":    "0x0/filters:grayscale()",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"card":    "fit-in/300x200/filters:quality(80)/" + presetSource,
+		"Thumb_2": "100x100/smart/" + presetSource,
+		"gray":    "0x0/filters:grayscale()/" + presetSource,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d presets, want %d", len(got), len(want))
+	}
+	for name, key := range want {
+		if opts, ok := got[name]; !ok || opts.String() != key {
+			t.Errorf("preset %s = %v, want %s", name, opts, key)
+		}
+	}
+
+	if got, err = parsePresets(nil); err != nil || len(got) != 0 {
+		t.Errorf("parsePresets(nil) = %v, %v, want no presets", got, err)
+	}
+}
+
+func TestParsePresetsErrors(t *testing.T) {
+	cases := []struct{ name, def, err string }{
+		{"has space", "300x200", `invalid preset name "has space"`},
+		{"", "300x200", `invalid preset name ""`},
+		{strings.Repeat("x", 65), "300x200", "invalid preset name"},
+		{"empty", "/", "preset empty is empty"},
+		{"source", "300x200/https://example.com/a.jpg", "preset source: expected only processing options"},
+		{"expiring", "expires:1893456000/300x200", "preset expiring: expected only processing options"},
+		{"nested", "preset:card", "preset nested: unknown preset"},
+		{"bad", "filters:quality(101)", "preset bad: "},
+	}
+	for _, c := range cases {
+		got, err := parsePresets(map[string]string{c.name: c.def})
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q=%q: got %v, %v, want an error mentioning %q", c.name, c.def, got, err, c.err)
+		}
+	}
+}
+
+func TestApplyPreset(t *testing.T) {
+	defer func(p map[string]*imageOptions) { presets = p }(presets)
+	var err error
+	if presets, err = parsePresets(map[string]string{"card": "fit-in/300x200/filters:quality(80)"}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := parseImageOptions("expires:1893456000/preset:card/https://example.com/a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Preset != "card" || opts.Source != "https://example.com/a.jpg" || !opts.Expires.Equal(time.Unix(1893456000, 0)) {
+		t.Errorf("preset URL parsed as %+v", opts)
+	}
+	if want := "fit-in/300x200/filters:quality(80)/https://example.com/a.jpg"; opts.String() != want {
+		t.Errorf("result key %s, want %s", opts.String(), want)
+	}
+	if want := "expires:1893456000/preset:card/https://example.com/a.jpg"; opts.signedPath() != want {
+		t.Errorf("signed path %s, want %s", opts.signedPath(), want)
+	}
+
+	// Filters added for one request don't leak into the preset.
+	f, err := newFormatFilter([]string{"png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Filters = append(opts.Filters, f)
+	if n := len(presets["card"].Filters); n != 1 {
+		t.Errorf("preset has %d filters after a request added one, want 1", n)
+	}
+}
+
+func TestCheckPresetsOnly(t *testing.T) {
+	defer func(only bool) { presetsOnly = only }(presetsOnly)
+	cases := []struct {
+		only   bool
+		preset string
+		code   int
+	}{
+		{false, "", 0},
+		{false, "card", 0},
+		{true, "card", 0},
+		{true, "", 400},
+	}
+	for _, c := range cases {
+		presetsOnly = c.only
+		err := checkPresetsOnly(&imageOptions{Preset: c.preset})
+		code := 0
+		if serr, ok := err.(*statusError); ok {
+			code = serr.Code
+		}
+		if code != c.code {
+			t.Errorf("presets_only %v, preset %q: %v, want status %d", c.only, c.preset, err, c.code)
+		}
+	}
+}
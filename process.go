@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// processImage applies opts to the source image in img and returns the
+// encoded result.
+func processImage(img []byte, opts *imageOptions) ([]byte, error) {
+	var err error
+	sourceType := bimg.DetermineImageType(img)
+
+	bopts := bimg.Options{
+		Width:        int(opts.Width),
+		Height:       int(opts.Height),
+		Gravity:      gravity(opts),
+		Interpolator: bimg.Bicubic,
+		Quality:      50,
+		Type:         defaultOutputType(sourceType, hasAlpha(img)),
+	}
+	for _, f := range opts.Filters {
+		if err = f.apply(&bopts, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// Once the image is upright it is flipped as requested and turned by
+	// the rotate filter, all before it is resized.
+	transform := opts.flips().then(orientation{angle: int(bopts.Rotate)})
+
+	// bimg turns images upright by their EXIF orientation, but only when it
+	// isn't told to rotate them, and lets the orientation override requested
+	// flips. Trims and manual crops are in pixels of the upright image too.
+	// In those cases the image is turned upright in a pass of its own, which
+	// strips the orientation tag so that it isn't applied twice.
+	upright := exifOrientation(img)
+	if upright != (orientation{}) && (opts.Trim || opts.HasCrop() || transform != (orientation{})) {
+		o := upright.options()
+		o.StripMetadata = true
+		if img, err = intermediatePass(img, o); err != nil {
+			return nil, err
+		}
+		upright = orientation{}
+	}
+
+	if opts.Trim {
+		if img, err = trimImage(img, opts.TrimPosition, opts.TrimTolerance); err != nil {
+			return nil, err
+		}
+	}
+	if opts.HasCrop() {
+		size, err := bimg.Size(img)
+		if err != nil {
+			return nil, err
+		}
+		right, bottom := minInt(opts.CropRight, size.Width), minInt(opts.CropBottom, size.Height)
+		if right > opts.CropLeft && bottom > opts.CropTop {
+			img, err = intermediatePass(img, bimg.Options{
+				Left:       opts.CropLeft,
+				Top:        opts.CropTop,
+				AreaWidth:  right - opts.CropLeft,
+				AreaHeight: bottom - opts.CropTop,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	bopts.Rotate, bopts.Flip = bimg.Angle(transform.angle), transform.flip
+	// Without fit-in or a crop, bimg v1 scales the image to exactly the
+	// size, which is what a bare size has always done.
+	if opts.Width > 0 && opts.Height > 0 && !bopts.Embed {
+		if opts.FitIn {
+			size, err := bimg.Size(img)
+			if err != nil {
+				return nil, err
+			}
+			if upright.then(transform).angle%180 != 0 {
+				size.Width, size.Height = size.Height, size.Width
+			}
+			bopts.Width, bopts.Height = fitInSize(size.Width, size.Height, bopts.Width, bopts.Height)
+		} else if opts.fills() {
+			bopts.Crop = true
+		}
+	}
+
+	var adjusters []pixelFilter
+	for _, f := range opts.Filters {
+		if pf, ok := f.(pixelFilter); ok {
+			adjusters = append(adjusters, pf)
+		}
+	}
+	if len(adjusters) == 0 {
+		return bimg.Resize(img, bopts)
+	}
+
+	// Pixel filters run on the resized image, which is then encoded as
+	// requested in a final pass.
+	final := bimg.Options{
+		Type:          bopts.Type,
+		Quality:       bopts.Quality,
+		StripMetadata: bopts.StripMetadata,
+		Background:    bopts.Background,
+		NoAutoRotate:  true,
+	}
+	bopts.Type, bopts.Compression = bimg.PNG, 1
+	if img, err = bimg.Resize(img, bopts); err != nil {
+		return nil, err
+	}
+	if img, err = adjustPixels(img, adjusters); err != nil {
+		return nil, err
+	}
+	return bimg.Resize(img, final)
+}
+
+// adjustPixels decodes the PNG img, runs the pixel filters on it in order
+// and encodes it again.
+func adjustPixels(img []byte, filters []pixelFilter) ([]byte, error) {
+	decoded, err := png.Decode(bytes.NewReader(img))
+	if err != nil {
+		return nil, err
+	}
+	nrgba, ok := decoded.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(decoded.Bounds())
+		draw.Draw(nrgba, nrgba.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+	}
+	for _, f := range filters {
+		f.adjust(nrgba)
+	}
+	var buf bytes.Buffer
+	if err = (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(&buf, nrgba); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// intermediatePass runs a bimg pass whose output is processed further. The
+// output is PNG, which is lossless and can be written whatever the source
+// format. The image is expected to be upright already, or to be turned
+// upright by o.
+func intermediatePass(img []byte, o bimg.Options) ([]byte, error) {
+	o.Type = bimg.PNG
+	o.Compression = 1
+	o.NoAutoRotate = true
+	return bimg.Resize(img, o)
+}
+
+// orientation is a clockwise turn by angle degrees, a multiple of 90,
+// followed by a horizontal flip when flip is set, which is the order bimg
+// applies Rotate and Flip in. Any sequence of quarter turns and flips comes
+// down to one orientation.
+type orientation struct {
+	angle int
+	flip  bool
+}
+
+// exifOrientations maps EXIF orientation tags onto the orientation that
+// turns an image upright.
+var exifOrientations = map[int]orientation{
+	2: {0, true},
+	3: {180, false},
+	4: {180, true},
+	5: {90, true},
+	6: {90, false},
+	7: {270, true},
+	8: {270, false},
+}
+
+// exifOrientation returns the orientation that turns img upright.
+func exifOrientation(img []byte) orientation {
+	meta, err := bimg.Metadata(img)
+	if err != nil {
+		return orientation{}
+	}
+	return exifOrientations[meta.Orientation]
+}
+
+// then returns the orientation of applying o followed by next. Flipping
+// first reverses the direction of next's turn.
+func (o orientation) then(next orientation) orientation {
+	angle := next.angle
+	if o.flip {
+		angle = -angle
+	}
+	return orientation{angle: ((o.angle+angle)%360 + 360) % 360, flip: o.flip != next.flip}
+}
+
+func (o orientation) options() bimg.Options {
+	return bimg.Options{Rotate: bimg.Angle(o.angle), Flip: o.flip}
+}
+
+// trimSampleSize bounds the size of the copy of an image that trimImage
+// looks for the border in, so that large images aren't decoded in full.
+const trimSampleSize = 1024
+
+// trimImage crops away the border of img whose color is within tolerance of
+// the pixel at position, top-left or bottom-right. bimg v1 can only trim
+// with libvips' default background and threshold, so the border is found
+// here, on a copy scaled down to at most trimSampleSize pixels a side.
+func trimImage(img []byte, position string, tolerance int) ([]byte, error) {
+	size, err := bimg.Size(img)
+	if err != nil {
+		return nil, err
+	}
+	full := image.Pt(size.Width, size.Height)
+	sample := img
+	if w, h := fitInSize(size.Width, size.Height, trimSampleSize, trimSampleSize); w != size.Width || h != size.Height {
+		if sample, err = intermediatePass(img, bimg.Options{Width: w, Height: h, Force: true}); err != nil {
+			return nil, err
+		}
+	} else if bimg.DetermineImageType(img) != bimg.PNG {
+		if sample, err = intermediatePass(img, bimg.Options{}); err != nil {
+			return nil, err
+		}
+	}
+	decoded, err := png.Decode(bytes.NewReader(sample))
+	if err != nil {
+		return nil, err
+	}
+	r := trimBounds(decoded, position, tolerance)
+	if r.Empty() {
+		return img, nil
+	}
+	r = scaleTrimBounds(r.Sub(decoded.Bounds().Min), decoded.Bounds().Size(), full)
+	if r == (image.Rectangle{Max: full}) {
+		return img, nil
+	}
+	return intermediatePass(img, bimg.Options{Left: r.Min.X, Top: r.Min.Y, AreaWidth: r.Dx(), AreaHeight: r.Dy()})
+}
+
+// scaleTrimBounds maps r, found on a sample of an image, onto the image of
+// the given size. Scaling blends the edges of the content into the border
+// around it, so r is widened by a pixel of the sample on each side to keep
+// all of the content.
+func scaleTrimBounds(r image.Rectangle, sample, size image.Point) image.Rectangle {
+	if sample == size {
+		return r
+	}
+	r = r.Inset(-1).Intersect(image.Rectangle{Max: sample})
+	return image.Rect(
+		r.Min.X*size.X/sample.X, r.Min.Y*size.Y/sample.Y,
+		(r.Max.X*size.X+sample.X-1)/sample.X, (r.Max.Y*size.Y+sample.Y-1)/sample.Y,
+	)
+}
+
+// trimBounds returns the smallest rectangle holding every pixel of img whose
+// color is further than tolerance from that of the reference pixel, in
+// euclidean RGBA distance with 8 bits per channel. Fully transparent pixels
+// all have the same color. The rectangle is empty if no pixel differs.
+func trimBounds(img image.Image, position string, tolerance int) image.Rectangle {
+	b := img.Bounds()
+	ref := b.Min
+	if position == "bottom-right" {
+		ref = b.Max.Sub(image.Pt(1, 1))
+	}
+	rc := color.NRGBAModel.Convert(img.At(ref.X, ref.Y)).(color.NRGBA)
+
+	var r image.Rectangle
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if colorDistance(c, rc) > float64(tolerance) {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+func colorDistance(a, b color.NRGBA) float64 {
+	if a.A == 0 && b.A == 0 {
+		return 0
+	}
+	dr, dg, db, da := float64(a.R)-float64(b.R), float64(a.G)-float64(b.G), float64(a.B)-float64(b.B), float64(a.A)-float64(b.A)
+	return math.Sqrt(dr*dr + dg*dg + db*db + da*da)
+}
+
+// defaultOutputType returns the output format used for a source of type t
+// when none was requested or negotiated. Formats that may carry
+// transparency are kept lossless, and GIFs become PNGs since libvips cannot
+// write GIF. Not every client can show WebP, so WebP sources are only
+// served as WebP when negotiated and otherwise become PNGs if they have an
+// alpha channel and JPEGs if not.
+func defaultOutputType(t bimg.ImageType, alpha bool) bimg.ImageType {
+	switch t {
+	case bimg.PNG, bimg.GIF:
+		return bimg.PNG
+	case bimg.WEBP:
+		if alpha {
+			return bimg.PNG
+		}
+	}
+	return bimg.JPEG
+}
+
+func hasAlpha(img []byte) bool {
+	meta, err := bimg.Metadata(img)
+	return err == nil && meta.Alpha
+}
+
+// contentType returns the MIME type for an output format.
+func contentType(t bimg.ImageType) string {
+	switch t {
+	case bimg.PNG:
+		return "image/png"
+	case bimg.WEBP:
+		return "image/webp"
+	case bimg.AVIF:
+		return "image/avif"
+	case bimg.TIFF:
+		return "image/tiff"
+	}
+	return "image/jpeg"
+}
+
+// negotiateFormat picks the output format for a request without a format
+// filter from autoFormats, by its Accept header. The result depends on the
+// header whether or not one of them is picked, so the response varies by
+// it.
+func negotiateFormat(h http.Header, req *http.Request, opts *imageOptions) {
+	if len(autoFormats) == 0 || opts.HasFormat() {
+		return
+	}
+	h.Set("Vary", "Accept")
+	for _, t := range autoFormats {
+		if accepts(req, contentType(t)) {
+			opts.Filters = append(opts.Filters, formatFilter{t})
+			return
+		}
+	}
+}
+
+// accepts reports whether the request's Accept header explicitly lists
+// mediaType. Wildcards don't count, since browsers send */* whatever they
+// support.
+func accepts(req *http.Request, mediaType string) bool {
+	for _, accept := range req.Header["Accept"] {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			fields := strings.Split(mediaRange, ";")
+			if !strings.EqualFold(strings.TrimSpace(fields[0]), mediaType) {
+				continue
+			}
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "q=") {
+					continue
+				}
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gravity maps the alignment options onto the closest bimg gravity. bimg has
+// no corner gravities, so vertical alignment wins over horizontal. bimg
+// flips images before cropping them, so the gravity is mirrored along with
+// the image to keep the side that was asked for.
+func gravity(opts *imageOptions) bimg.Gravity {
+	top, bottom, left, right := bimg.GravityNorth, bimg.GravitySouth, bimg.GravityWest, bimg.GravityEast
+	if opts.FlipVertical {
+		top, bottom = bottom, top
+	}
+	if opts.FlipHorizontal {
+		left, right = right, left
+	}
+	switch {
+	case opts.Smart:
+		return bimg.GravitySmart
+	case opts.VAlign == "top":
+		return top
+	case opts.VAlign == "bottom":
+		return bottom
+	case opts.HAlign == "left":
+		return left
+	case opts.HAlign == "right":
+		return right
+	}
+	return bimg.GravityCentre
+}
+
+// fitInSize returns the largest size with the aspect ratio of inWidth x
+// inHeight that fits within width x height without enlarging the image.
+func fitInSize(inWidth, inHeight, width, height int) (int, int) {
+	if inWidth <= width && inHeight <= height {
+		return inWidth, inHeight
+	}
+	if inWidth*height > inHeight*width {
+		return width, maxInt(1, inHeight*width/inWidth)
+	}
+	return maxInt(1, inWidth*height/inHeight), height
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
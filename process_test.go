@@ -0,0 +1,297 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// grid is a small image whose cells are numbered, to check orientations
+// against.
+type grid [][]int
+
+func newGrid(width, height int) grid {
+	g := make(grid, height)
+	for y := range g {
+		g[y] = make([]int, width)
+		for x := range g[y] {
+			g[y][x] = y*width + x
+		}
+	}
+	return g
+}
+
+func (g grid) turnClockwise() grid {
+	h, w := len(g), len(g[0])
+	out := make(grid, w)
+	for y := range out {
+		out[y] = make([]int, h)
+		for x := range out[y] {
+			out[y][x] = g[h-1-x][y]
+		}
+	}
+	return out
+}
+
+func (g grid) flip() grid {
+	out := make(grid, len(g))
+	for y := range g {
+		out[y] = make([]int, len(g[y]))
+		for x := range g[y] {
+			out[y][x] = g[y][len(g[y])-1-x]
+		}
+	}
+	return out
+}
+
+// apply turns and flips g the way bimg applies Rotate and Flip.
+func (o orientation) apply(g grid) grid {
+	for a := 0; a < o.angle; a += 90 {
+		g = g.turnClockwise()
+	}
+	if o.flip {
+		g = g.flip()
+	}
+	return g
+}
+
+func allOrientations() []orientation {
+	var all []orientation
+	for _, flip := range []bool{false, true} {
+		for angle := 0; angle < 360; angle += 90 {
+			all = append(all, orientation{angle, flip})
+		}
+	}
+	return all
+}
+
+func TestOrientationThen(t *testing.T) {
+	g := newGrid(3, 2)
+	for _, a := range allOrientations() {
+		for _, b := range allOrientations() {
+			want := b.apply(a.apply(g))
+			if got := a.then(b).apply(g); !reflect.DeepEqual(got, want) {
+				t.Errorf("%+v then %+v = %+v, which gives %v, want %v", a, b, a.then(b), got, want)
+			}
+		}
+	}
+}
+
+func TestFlips(t *testing.T) {
+	g := newGrid(3, 2)
+	vertical := grid{g[1], g[0]}
+	cases := []struct {
+		opts imageOptions
+		want grid
+	}{
+		{imageOptions{}, g},
+		{imageOptions{FlipHorizontal: true}, g.flip()},
+		{imageOptions{FlipVertical: true}, vertical},
+		{imageOptions{FlipHorizontal: true, FlipVertical: true}, vertical.flip()},
+	}
+	for _, c := range cases {
+		if got := c.opts.flips().apply(g); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("flips of %+v give %v, want %v", c.opts, got, c.want)
+		}
+	}
+}
+
+// TestExifOrientations checks that each orientation turns an image stored
+// with that EXIF tag upright. The tags describe how the stored image was
+// transformed from the upright one.
+func TestExifOrientations(t *testing.T) {
+	upright := newGrid(3, 2)
+	stored := map[int]grid{
+		2: upright.flip(),
+		3: upright.turnClockwise().turnClockwise(),
+		4: upright.turnClockwise().turnClockwise().flip(),
+		5: upright.turnClockwise().flip(),
+		6: upright.turnClockwise().turnClockwise().turnClockwise(),
+		7: upright.turnClockwise().turnClockwise().turnClockwise().flip(),
+		8: upright.turnClockwise(),
+	}
+	for tag, g := range stored {
+		if got := exifOrientations[tag].apply(g); !reflect.DeepEqual(got, upright) {
+			t.Errorf("orientation %d turns %v into %v, want %v", tag, g, got, upright)
+		}
+	}
+}
+
+func TestGravity(t *testing.T) {
+	cases := []struct {
+		opts imageOptions
+		want bimg.Gravity
+	}{
+		{imageOptions{}, bimg.GravityCentre},
+		{imageOptions{HAlign: "left"}, bimg.GravityWest},
+		{imageOptions{HAlign: "right", VAlign: "top"}, bimg.GravityNorth},
+		{imageOptions{VAlign: "bottom"}, bimg.GravitySouth},
+		{imageOptions{HAlign: "left", Smart: true}, bimg.GravitySmart},
+		{imageOptions{HAlign: "left", FlipHorizontal: true}, bimg.GravityEast},
+		{imageOptions{HAlign: "left", FlipVertical: true}, bimg.GravityWest},
+		{imageOptions{VAlign: "top", FlipVertical: true}, bimg.GravitySouth},
+		{imageOptions{VAlign: "bottom", FlipHorizontal: true, FlipVertical: true}, bimg.GravityNorth},
+	}
+	for _, c := range cases {
+		if got := gravity(&c.opts); got != c.want {
+			t.Errorf("gravity(%+v) = %v, want %v", c.opts, got, c.want)
+		}
+	}
+}
+
+func TestFitInSize(t *testing.T) {
+	cases := []struct{ inW, inH, w, h, wantW, wantH int }{
+		{1000, 500, 300, 300, 300, 150},
+		{500, 1000, 300, 300, 150, 300},
+		{100, 50, 300, 300, 100, 50},
+		{1000, 1, 300, 300, 300, 1},
+	}
+	for _, c := range cases {
+		if w, h := fitInSize(c.inW, c.inH, c.w, c.h); w != c.wantW || h != c.wantH {
+			t.Errorf("fitInSize(%d, %d, %d, %d) = %d, %d, want %d, %d", c.inW, c.inH, c.w, c.h, w, h, c.wantW, c.wantH)
+		}
+	}
+}
+
+func TestTrimBounds(t *testing.T) {
+	white := color.NRGBA{255, 255, 255, 255}
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 10; x++ {
+			img.Set(x, y, white)
+		}
+	}
+	for y := 3; y < 6; y++ {
+		for x := 2; x < 5; x++ {
+			img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	img.Set(9, 7, color.NRGBA{250, 250, 250, 255}) // near white, bottom-right
+
+	cases := []struct {
+		position  string
+		tolerance int
+		want      image.Rectangle
+	}{
+		{"top-left", 0, image.Rect(2, 3, 10, 8)},
+		{"top-left", 10, image.Rect(2, 3, 5, 6)},
+		{"bottom-right", 0, image.Rect(0, 0, 10, 8)},
+		{"bottom-right", 10, image.Rect(2, 3, 5, 6)},
+		{"top-left", 500, image.Rectangle{}},
+	}
+	for _, c := range cases {
+		if got := trimBounds(img, c.position, c.tolerance); got != c.want {
+			t.Errorf("trimBounds(%s, %d) = %v, want %v", c.position, c.tolerance, got, c.want)
+		}
+	}
+
+	// Transparent borders are trimmed whatever their color channels hold.
+	clear := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	clear.Set(3, 0, color.NRGBA{255, 0, 0, 0})
+	clear.Set(1, 2, color.NRGBA{0, 0, 0, 255})
+	if got, want := trimBounds(clear, "top-left", 0), image.Rect(1, 2, 2, 3); got != want {
+		t.Errorf("trimBounds of a transparent border = %v, want %v", got, want)
+	}
+}
+
+func TestScaleTrimBounds(t *testing.T) {
+	cases := []struct {
+		r, want      image.Rectangle
+		sample, size image.Point
+	}{
+		{image.Rect(10, 10, 20, 20), image.Rect(10, 10, 20, 20), image.Pt(100, 100), image.Pt(100, 100)},
+		{image.Rect(10, 10, 20, 20), image.Rect(90, 90, 210, 210), image.Pt(100, 100), image.Pt(1000, 1000)},
+		{image.Rect(0, 5, 100, 50), image.Rect(0, 10, 300, 128), image.Pt(100, 50), image.Pt(300, 128)},
+	}
+	for _, c := range cases {
+		if got := scaleTrimBounds(c.r, c.sample, c.size); got != c.want {
+			t.Errorf("scaleTrimBounds(%v, %v, %v) = %v, want %v", c.r, c.sample, c.size, got, c.want)
+		}
+	}
+}
+
+func TestDefaultOutputType(t *testing.T) {
+	cases := []struct {
+		source bimg.ImageType
+		alpha  bool
+		want   bimg.ImageType
+	}{
+		{bimg.JPEG, false, bimg.JPEG},
+		{bimg.PNG, false, bimg.PNG},
+		{bimg.GIF, true, bimg.PNG},
+		{bimg.TIFF, false, bimg.JPEG},
+		{bimg.WEBP, false, bimg.JPEG},
+		{bimg.WEBP, true, bimg.PNG},
+		{bimg.PDF, false, bimg.JPEG},
+	}
+	for _, c := range cases {
+		if got := defaultOutputType(c.source, c.alpha); got != c.want {
+			t.Errorf("defaultOutputType(%s, %v) = %s, want %s", bimg.ImageTypeName(c.source), c.alpha, bimg.ImageTypeName(got), bimg.ImageTypeName(c.want))
+		}
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	cases := []struct {
+		accept    []string
+		mediaType string
+		want      bool
+	}{
+		{nil, "image/webp", false},
+		{[]string{"image/webp,*/*"}, "image/webp", true},
+		{[]string{"text/html", "image/avif, image/webp;q=0.8"}, "image/webp", true},
+		{[]string{"IMAGE/WEBP"}, "image/webp", true},
+		{[]string{"image/webp;q=0"}, "image/webp", false},
+		{[]string{"image/webp; q=0.0"}, "image/webp", false},
+		{[]string{"image/*,*/*;q=0.8"}, "image/webp", false},
+		{[]string{"image/avif,image/webp"}, "image/avif", true},
+		{[]string{"image/avifs"}, "image/avif", false},
+	}
+	for _, c := range cases {
+		req := &http.Request{Header: http.Header{"Accept": c.accept}}
+		if got := accepts(req, c.mediaType); got != c.want {
+			t.Errorf("accepts(%q, %s) = %v, want %v", c.accept, c.mediaType, got, c.want)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	defer func(f []bimg.ImageType) { autoFormats = f }(autoFormats)
+
+	const chrome = "image/avif,image/webp,image/apng,image/*,*/*;q=0.8"
+	cases := []struct {
+		auto   []bimg.ImageType
+		accept string
+		path   string
+		vary   bool
+		want   string
+	}{
+		{nil, chrome, "300x200/a.webp", false, "300x200/a.webp"},
+		{[]bimg.ImageType{bimg.WEBP}, chrome, "300x200/a.jpg", true, "300x200/filters:format(webp)/a.jpg"},
+		{[]bimg.ImageType{bimg.AVIF, bimg.WEBP}, chrome, "300x200/a.jpg", true, "300x200/filters:format(avif)/a.jpg"},
+		{[]bimg.ImageType{bimg.AVIF, bimg.WEBP}, "image/webp,*/*", "300x200/a.jpg", true, "300x200/filters:format(webp)/a.jpg"},
+		{[]bimg.ImageType{bimg.AVIF, bimg.WEBP}, "*/*", "300x200/a.webp", true, "300x200/a.webp"},
+		// An explicit format is served to every client alike.
+		{[]bimg.ImageType{bimg.WEBP}, chrome, "300x200/filters:format(png)/a.jpg", false, "300x200/filters:format(png)/a.jpg"},
+	}
+	for _, c := range cases {
+		autoFormats = c.auto
+		opts, err := parseImageOptions(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &http.Request{Header: http.Header{"Accept": {c.accept}}}
+		h := http.Header{}
+		negotiateFormat(h, req, opts)
+		if got := opts.String(); got != c.want {
+			t.Errorf("%v, %s, %s: negotiated %s, want %s", c.auto, c.accept, c.path, got, c.want)
+		}
+		if vary := h.Get("Vary") == "Accept"; vary != c.vary {
+			t.Errorf("%v, %s, %s: Vary %q, want Accept %v", c.auto, c.accept, c.path, h.Get("Vary"), c.vary)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// adminKey is the bearer token admin endpoints require. They are
+	// disabled when it is empty.
+	adminKey string
+	// cdnPurger is told about purges so that they can be forwarded to a CDN
+	// in front of gothumb. It is nil when no hook is configured.
+	cdnPurger purgeHook
+)
+
+var purgedResults = newCounterVec("gothumb_purged_results_total",
+	"Results purged, by how they were selected: path, source or prefix.", "by")
+
+// purgeRequest selects the results to purge. Paths are result paths as
+// stored, e.g. /300x200/smart/https:/example.com/a.jpg, sources are source
+// URLs whose results are found through the source index, and prefixes
+// select every result path that starts with them.
+type purgeRequest struct {
+	Paths    []string `json:"paths,omitempty"`
+	Sources  []string `json:"sources,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+type purgeResponse struct {
+	Purged []string `json:"purged"`
+	Errors []string `json:"errors,omitempty"`
+
+	// requestPaths are the paths the purged results were requested at,
+	// which are what a CDN caches them under.
+	requestPaths []string
+}
+
+// A purgeHook is told about each purge once the results are deleted, e.g. to
+// invalidate the same results in a CDN. It gets the purge request along with
+// the request paths the purged results were served at.
+type purgeHook interface {
+	Purge(req *purgeRequest, requestPaths []string) error
+}
+
+// webhookPurgeHook posts each purge as JSON to a URL, which can translate
+// the request paths into a CDN's invalidation API, or forward the purge
+// request to other instances.
+type webhookPurgeHook struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookPurgeHook(target string) *webhookPurgeHook {
+	return &webhookPurgeHook{url: target, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (h *webhookPurgeHook) Purge(req *purgeRequest, requestPaths []string) error {
+	if requestPaths == nil {
+		requestPaths = []string{}
+	}
+	body, err := json.Marshal(struct {
+		*purgeRequest
+		RequestPaths []string `json:"request_paths"`
+	}{req, requestPaths})
+	if err != nil {
+		return err
+	}
+	res, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("purge webhook responded with %d", res.StatusCode)
+	}
+	return nil
+}
+
+// sourceIndexPrefix returns the path beneath which the results rendered from
+// source are indexed. Each result has a marker there holding its path, so
+// that a source's results can be listed without reading every result.
+func sourceIndexPrefix(source string) string {
+	return indexPrefix("/.index/", source)
+}
+
+// requestIndexPrefix returns the path beneath which the request paths the
+// result at rpath was served at are indexed, each in a marker holding it.
+func requestIndexPrefix(rpath string) string {
+	return indexPrefix("/.requests/", rpath)
+}
+
+func indexPrefix(root, s string) string {
+	sum := sha256.Sum256([]byte(s))
+	h := hex.EncodeToString(sum[:])
+	return root + h[:2] + "/" + h + "/"
+}
+
+// indexResult records in result storage that the result at rpath was
+// rendered from source. Results are indexed whether or not purging is
+// enabled, so that results stored before it was enabled can be purged.
+func indexResult(source, rpath string) error {
+	if resultStorage == nil || source == "" {
+		return nil
+	}
+	marker := sourceIndexPrefix(source) + computeHexMD5([]byte(rpath))
+	return resultStorage.Put(marker, []byte(rpath), &ResultMeta{ContentType: "text/plain"})
+}
+
+// maxIndexedRequests bounds indexedRequests.
+const maxIndexedRequests = 100000
+
+// indexedRequests holds the requests this process has indexed, by request
+// path and the time their result was created, so that each request path is
+// written once per rendering of its result rather than on every hit. It is
+// emptied when full, which only costs writing markers again.
+var indexedRequests = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// indexRequest records in result storage, in the background, that res was
+// served at reqPath, so that purging res can tell a CDN to invalidate it.
+func indexRequest(l *logger, reqPath string, res *result) {
+	store := resultStorage
+	if store == nil {
+		return
+	}
+	id := reqPath + " " + res.Created.Format(time.RFC3339Nano)
+	indexedRequests.Lock()
+	if indexedRequests.seen[id] {
+		indexedRequests.Unlock()
+		return
+	}
+	if len(indexedRequests.seen) >= maxIndexedRequests {
+		indexedRequests.seen = make(map[string]bool)
+	}
+	indexedRequests.seen[id] = true
+	indexedRequests.Unlock()
+
+	marker := requestIndexPrefix(res.Path) + computeHexMD5([]byte(reqPath))
+	pendingStores.Go(marker, func() {
+		if err := store.Put(marker, []byte(reqPath), &ResultMeta{ContentType: "text/plain"}); err != nil {
+			l.Error("indexing request", "result_path", res.Path, "error", err)
+			indexedRequests.Lock()
+			delete(indexedRequests.seen, id)
+			indexedRequests.Unlock()
+		}
+	})
+}
+
+// normalizeSource returns source as handleResize writes it, which is how
+// results are indexed.
+func normalizeSource(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme == "" {
+		return "", fmt.Errorf("invalid source URL %q", source)
+	}
+	return u.String(), nil
+}
+
+// normalizePrefix cleans a path prefix the way result paths are cleaned,
+// keeping a trailing slash so that /300x200/ doesn't match /300x2000/.
+func normalizePrefix(prefix string) string {
+	p := normalizePath("/" + prefix)
+	if strings.HasSuffix(prefix, "/") && p != "/" {
+		p += "/"
+	}
+	return p
+}
+
+// purgeResults deletes the results req selects from result storage and the
+// in-memory cache, along with cached copies of the sources it names.
+// Failures are reported in the response rather than stopping the purge.
+//
+// Result storage is usually shared, but the in-memory result cache and the
+// memory source cache belong to this process. Other instances keep serving
+// the results they cached until result_cache_ttl and source_cache_ttl run
+// out, unless the purge webhook forwards the purge to each of them.
+func purgeResults(req *purgeRequest) *purgeResponse {
+	resp := &purgeResponse{Purged: []string{}}
+	lister, _ := resultStorage.(ResultLister)
+	list := func(prefix string, fn func(path string) error) error {
+		if resultStorage == nil {
+			return nil
+		}
+		if lister == nil {
+			return errListUnsupported
+		}
+		return lister.List(prefix, fn)
+	}
+	purged := make(map[string]bool)
+	requested := make(map[string]bool)
+	purge := func(p, by string) {
+		if purged[p] {
+			return
+		}
+		if resultStorage != nil {
+			if err := resultStorage.Delete(p); err != nil {
+				resp.Errors = append(resp.Errors, fmt.Sprintf("deleting %s: %s", p, err))
+				return
+			}
+		}
+		cachedResults.Remove(p)
+		purged[p] = true
+		resp.Purged = append(resp.Purged, p)
+		purgedResults.Inc(by)
+
+		err := list(requestIndexPrefix(p), func(marker string) error {
+			reqPath, err := readIndexMarker(marker)
+			if err != nil {
+				return err
+			}
+			if reqPath != "" && !requested[reqPath] {
+				requested[reqPath] = true
+				resp.requestPaths = append(resp.requestPaths, reqPath)
+			}
+			return resultStorage.Delete(marker)
+		})
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("reading the request paths of %s: %s", p, err))
+		}
+	}
+
+	for _, p := range req.Paths {
+		purge(normalizePath("/"+p), "path")
+	}
+
+	for _, source := range req.Sources {
+		cachedSources.remove(source)
+		for _, p := range cachedResults.RemoveMatching(func(res *result) bool { return res.Source == source }) {
+			purge(p, "source")
+		}
+		err := list(sourceIndexPrefix(source), func(marker string) error {
+			p, err := readIndexMarker(marker)
+			if err != nil {
+				return err
+			}
+			if p != "" {
+				purge(p, "source")
+				if !purged[p] {
+					return nil // keep the marker so that the purge can be retried
+				}
+			}
+			return resultStorage.Delete(marker)
+		})
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("purging results of %s: %s", source, err))
+		}
+	}
+
+	for _, prefix := range req.Prefixes {
+		prefix = normalizePrefix(prefix)
+		for _, p := range cachedResults.RemoveMatching(func(res *result) bool { return strings.HasPrefix(res.Path, prefix) }) {
+			purge(p, "prefix")
+		}
+		err := list(prefix, func(p string) error {
+			// Skip the index and cached sources, which aren't results.
+			if !strings.HasPrefix(p, "/.") {
+				purge(p, "prefix")
+			}
+			return nil
+		})
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("purging %s: %s", prefix, err))
+		}
+	}
+	return resp
+}
+
+// readIndexMarker returns the result path a source index marker holds, or
+// "" if the marker has already been deleted.
+func readIndexMarker(marker string) (string, error) {
+	r, _, err := resultStorage.Get(marker)
+	if err == errResultNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	p, err := ioutil.ReadAll(r)
+	return string(p), err
+}
+
+// adminOnly serves h only when an admin key is configured, and only to
+// requests that give it as a bearer token.
+func adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if adminKey == "" {
+			http.NotFound(w, req)
+			return
+		}
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(adminKey)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gothumb"`)
+			http.Error(w, "invalid admin key", 401)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// handlePurge implements POST /admin/purge, which takes a JSON purgeRequest
+// and responds with the purged result paths. It is served behind adminOnly.
+// Only this instance's in-memory caches are purged; see purgeResults.
+func handlePurge(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "purge requests must be POSTed", 405)
+		return
+	}
+
+	var pr purgeRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, int64(1*MB))).Decode(&pr); err != nil {
+		http.Error(w, fmt.Sprintf("invalid purge request: %s", err), 400)
+		return
+	}
+	if len(pr.Paths)+len(pr.Sources)+len(pr.Prefixes) == 0 {
+		http.Error(w, "nothing to purge: give paths, sources or prefixes", 400)
+		return
+	}
+	// Hashed keys can't be listed by prefix. Refuse before anything is
+	// purged, rather than purging the paths and sources and then failing.
+	if len(pr.Prefixes) > 0 && resultStorage != nil && resultLayout.hashed {
+		http.Error(w, "prefixes can't be purged with the hashed storage layout; purge by path or source instead", 400)
+		return
+	}
+	for i, source := range pr.Sources {
+		var err error
+		if pr.Sources[i], err = normalizeSource(source); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	resp := purgeResults(&pr)
+	if cdnPurger != nil {
+		if err := cdnPurger.Purge(&pr, resp.requestPaths); err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("purge hook: %s", err))
+		}
+	}
+	l := rootLogger.With("request_id", requestID(req))
+	if len(resp.Errors) > 0 {
+		l.Error("purge", "purged", len(resp.Purged), "errors", strings.Join(resp.Errors, "; "))
+		writeJSON(w, 500, resp)
+		return
+	}
+	l.Info("purge", "paths", len(pr.Paths), "sources", len(pr.Sources), "prefixes", len(pr.Prefixes), "purged", len(resp.Purged))
+	writeJSON(w, 200, resp)
+}
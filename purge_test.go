@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usePurgeSettings installs result storage in layout, a result cache and an
+// admin key for a test, and returns the underlying storage along with a
+// func that restores the previous settings.
+func usePurgeSettings(t *testing.T, layout string) (*memoryResultStorage, func()) {
+	s, l, cache, key, hook := resultStorage, resultLayout, cachedResults, adminKey, cdnPurger
+	store := newMemoryResultStorage()
+	var err error
+	if resultLayout, err = newKeyLayout(layout, ""); err != nil {
+		t.Fatal(err)
+	}
+	resultStorage = layoutStorage{store, resultLayout}
+	cachedResults = newResultCache(1<<20, 0)
+	adminKey, cdnPurger = "admin", nil
+	return store, func() {
+		resultStorage, resultLayout, cachedResults, adminKey, cdnPurger = s, l, cache, key, hook
+	}
+}
+
+// storeTestResult stores and indexes a result rendered from source, and
+// caches it in memory.
+func storeTestResult(t *testing.T, rpath, source string) {
+	if err := resultStorage.Put(rpath, []byte(rpath), &ResultMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexResult(source, rpath); err != nil {
+		t.Fatal(err)
+	}
+	cachedResults.Add(&result{Path: rpath, Source: source, Data: []byte(rpath)})
+}
+
+func postPurge(body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/admin/purge", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	adminOnly(http.HandlerFunc(handlePurge)).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPurge(t *testing.T) {
+	_, restore := usePurgeSettings(t, "raw")
+	defer restore()
+	const a, b = "https://example.com/a.jpg", "https://example.com/b.jpg"
+	paths := map[string]string{
+		"/300x200/https:/example.com/a.jpg":      a,
+		"/100x100/https:/example.com/a.jpg":      a,
+		"/300x200/https:/example.com/b.jpg":      b,
+		"/300x2000/https:/example.com/b.jpg":     b,
+		"/fit-in/50x50/https:/example.com/b.jpg": b,
+	}
+
+	cases := []struct {
+		name, body string
+		purged     []string
+	}{
+		{"path", `{"paths": ["300x200/https://example.com/b.jpg"]}`, []string{"/300x200/https:/example.com/b.jpg"}},
+		{"source", `{"sources": ["` + a + `"]}`, []string{"/100x100/https:/example.com/a.jpg", "/300x200/https:/example.com/a.jpg"}},
+		{"prefix", `{"prefixes": ["/300x200/"]}`, []string{"/300x200/https:/example.com/a.jpg", "/300x200/https:/example.com/b.jpg"}},
+		{"all at once", `{"paths": ["/300x200/https:/example.com/a.jpg"], "sources": ["` + a + `"], "prefixes": ["fit-in"]}`,
+			[]string{"/100x100/https:/example.com/a.jpg", "/300x200/https:/example.com/a.jpg", "/fit-in/50x50/https:/example.com/b.jpg"}},
+	}
+	for _, c := range cases {
+		for p, source := range paths {
+			storeTestResult(t, p, source)
+		}
+		rec := postPurge(c.body)
+		var resp purgeResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); rec.Code != 200 || err != nil {
+			t.Errorf("%s: %d %s", c.name, rec.Code, rec.Body.String())
+			continue
+		}
+		sort.Strings(resp.Purged)
+		if !reflect.DeepEqual(resp.Purged, c.purged) {
+			t.Errorf("%s: purged %v, want %v", c.name, resp.Purged, c.purged)
+		}
+		purged := make(map[string]bool)
+		for _, p := range c.purged {
+			purged[p] = true
+		}
+		for p := range paths {
+			_, err := resultStorage.Head(p)
+			_, cached := cachedResults.Get(p)
+			if stored := err == nil; stored == purged[p] || cached == purged[p] {
+				t.Errorf("%s: %s stored %v, cached %v", c.name, p, stored, cached)
+			}
+		}
+	}
+
+	// A source's index markers are removed with its results.
+	postPurge(`{"sources": ["` + b + `"]}`)
+	var markers []string
+	resultStorage.(ResultLister).List(sourceIndexPrefix(b), func(p string) error {
+		markers = append(markers, p)
+		return nil
+	})
+	if len(markers) != 0 {
+		t.Errorf("index markers left after purging %s: %v", b, markers)
+	}
+}
+
+func TestPurgeHashedLayout(t *testing.T) {
+	store, restore := usePurgeSettings(t, "hashed")
+	defer restore()
+	const source = "https://example.com/a.jpg"
+	storeTestResult(t, "/300x200/https:/example.com/a.jpg", source)
+
+	rec := postPurge(`{"paths": ["/300x200/https:/example.com/a.jpg"], "prefixes": ["/300x200/"]}`)
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "hashed storage layout") {
+		t.Errorf("prefix purge with the hashed layout = %d %s, want a 400", rec.Code, rec.Body.String())
+	}
+	if _, err := resultStorage.Head("/300x200/https:/example.com/a.jpg"); err != nil {
+		t.Errorf("a rejected purge deleted the result: %v", err)
+	}
+
+	rec = postPurge(`{"sources": ["` + source + `"]}`)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "/300x200/https:/example.com/a.jpg") {
+		t.Errorf("source purge with the hashed layout = %d %s", rec.Code, rec.Body.String())
+	}
+	if len(store.results) != 0 {
+		t.Errorf("%d objects left in storage after the purge", len(store.results))
+	}
+}
+
+func TestPurgeRequests(t *testing.T) {
+	_, restore := usePurgeSettings(t, "raw")
+	defer restore()
+
+	cases := []struct {
+		method, auth, body string
+		code               int
+	}{
+		{"POST", "Bearer wrong", `{"paths": ["/a"]}`, 401},
+		{"POST", "", `{"paths": ["/a"]}`, 401},
+		{"GET", "Bearer admin", "", 405},
+		{"POST", "Bearer admin", `{"paths": `, 400},
+		{"POST", "Bearer admin", `{}`, 400},
+		{"POST", "Bearer admin", `{"sources": ["not a URL"]}`, 400},
+		{"POST", "Bearer admin", `{"paths": ["/a"]}`, 200},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/admin/purge", strings.NewReader(c.body))
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		rec := httptest.NewRecorder()
+		adminOnly(http.HandlerFunc(handlePurge)).ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("%s %q with %q: %d %s, want %d", c.method, c.body, c.auth, rec.Code, rec.Body.String(), c.code)
+		}
+	}
+}
+
+func TestPurgeWebhook(t *testing.T) {
+	_, restore := usePurgeSettings(t, "raw")
+	defer restore()
+	defer func(tr *workTracker) { pendingStores = tr }(pendingStores)
+	var received struct {
+		Paths        []string `json:"paths"`
+		RequestPaths []string `json:"request_paths"`
+	}
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&received)
+		if fail {
+			w.WriteHeader(503)
+		}
+	}))
+	defer srv.Close()
+	cdnPurger = newWebhookPurgeHook(srv.URL)
+	cdnPurger.(*webhookPurgeHook).client.Timeout = time.Second
+
+	// The result is served at two request paths, which are indexed once
+	// each however often they are requested.
+	storeTestResult(t, "/300x200/a.jpg", "")
+	res := &result{Path: "/300x200/a.jpg", Created: time.Now()}
+	pendingStores = newWorkTracker()
+	for _, reqPath := range []string{"/sig1/300x200/a.jpg", "/sig2/300x200/a.jpg", "/sig1/300x200/a.jpg"} {
+		indexRequest(rootLogger, reqPath, res)
+	}
+	if abandoned := pendingStores.Wait(time.Now().Add(time.Second)); abandoned != nil {
+		t.Fatalf("indexing didn't finish: %v", abandoned)
+	}
+
+	if rec := postPurge(`{"paths": ["/300x200/a.jpg"]}`); rec.Code != 200 {
+		t.Errorf("purge = %d %s", rec.Code, rec.Body.String())
+	}
+	sort.Strings(received.RequestPaths)
+	if !reflect.DeepEqual(received.Paths, []string{"/300x200/a.jpg"}) || !reflect.DeepEqual(received.RequestPaths, []string{"/sig1/300x200/a.jpg", "/sig2/300x200/a.jpg"}) {
+		t.Errorf("webhook received %+v", received)
+	}
+	var markers []string
+	resultStorage.(ResultLister).List(requestIndexPrefix("/300x200/a.jpg"), func(p string) error {
+		markers = append(markers, p)
+		return nil
+	})
+	if len(markers) != 0 {
+		t.Errorf("request markers left after the purge: %v", markers)
+	}
+
+	fail = true
+	rec := postPurge(`{"paths": ["/300x200/a.jpg"]}`)
+	if rec.Code != 500 || !strings.Contains(rec.Body.String(), "purge webhook responded with 503") {
+		t.Errorf("purge with a failing webhook = %d %s, want a 500", rec.Code, rec.Body.String())
+	}
+	if received.RequestPaths == nil || len(received.RequestPaths) != 0 {
+		t.Errorf("webhook received request paths %#v for a result that was already purged, want []", received.RequestPaths)
+	}
+}
+
+// TestIndexResultWithoutAdminKey checks that results are indexed even while
+// purging is disabled, so that they can be purged once it is enabled.
+func TestIndexResultWithoutAdminKey(t *testing.T) {
+	_, restore := usePurgeSettings(t, "raw")
+	defer restore()
+	adminKey = ""
+	const source = "https://example.com/a.jpg"
+	storeTestResult(t, "/300x200/https:/example.com/a.jpg", source)
+
+	adminKey = "admin"
+	rec := postPurge(`{"sources": ["` + source + `"]}`)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "/300x200/https:/example.com/a.jpg") {
+		t.Errorf("purging a result indexed without an admin key = %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	cases := map[string]string{
+		"300x200/":           "/300x200/",
+		"/300x200":           "/300x200",
+		"fit-in//300x200/./": "/fit-in/300x200/",
+		"/":                  "/",
+		"":                   "/",
+	}
+	for prefix, want := range cases {
+		if got := normalizePrefix(prefix); got != want {
+			t.Errorf("normalizePrefix(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cachedResults holds recently served results in memory, in front of result
+// storage. It is nil when disabled.
+var cachedResults *resultCache
+
+var (
+	resultCacheLookups = newCounterVec("gothumb_result_cache_lookups_total",
+		"In-memory result cache lookups by outcome (hit or miss).", "outcome")
+	resultCacheRemovals = newCounterVec("gothumb_result_cache_evictions_total",
+		"Results dropped from the in-memory cache by reason (size or expired).", "reason")
+)
+
+// resultCache is an LRU cache of results bounded by the total size of their
+// data. Entries also expire ttl after they were added, so that results
+// replaced in storage are eventually picked up, or sooner if they go stale.
+type resultCache struct {
+	maxBytes int64
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List // of *resultCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type resultCacheEntry struct {
+	res     *result
+	expires time.Time // zero if the entry doesn't expire
+}
+
+func (e *resultCacheEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// newResultCache returns a cache holding up to maxBytes of result data,
+// each for at most ttl, or indefinitely when ttl is 0.
+func newResultCache(maxBytes int64, ttl time.Duration) *resultCache {
+	return &resultCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the result cached for path. A nil cache never has results.
+func (c *resultCache) Get(path string) (*result, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[path]
+	if ok && el.Value.(*resultCacheEntry).expired(time.Now()) {
+		c.remove(el)
+		resultCacheRemovals.Inc("expired")
+		ok = false
+	}
+	if !ok {
+		resultCacheLookups.Inc("miss")
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	resultCacheLookups.Inc("hit")
+	return el.Value.(*resultCacheEntry).res, true
+}
+
+// Add caches res, which must not be modified afterwards, evicting the least
+// recently used results to make room. Results larger than the whole cache,
+// and stale results, are not cached; others expire when they go stale if
+// that is before the cache's ttl.
+func (c *resultCache) Add(res *result) {
+	if c == nil || int64(len(res.Data)) > c.maxBytes {
+		return
+	}
+	now := time.Now()
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = now.Add(c.ttl)
+	}
+	if stale := freshUntil(res); !stale.IsZero() && (expires.IsZero() || stale.Before(expires)) {
+		expires = stale
+	}
+	entry := &resultCacheEntry{res: res, expires: expires}
+	if entry.expired(now) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[res.Path]; ok {
+		c.remove(el)
+	}
+	c.entries[res.Path] = c.lru.PushFront(entry)
+	c.bytes += int64(len(res.Data))
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		resultCacheRemovals.Inc("size")
+	}
+}
+
+// Remove drops the result cached for path, if any.
+func (c *resultCache) Remove(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		c.remove(el)
+	}
+}
+
+// RemoveMatching drops the cached results match selects, returning their
+// paths.
+func (c *resultCache) RemoveMatching(match func(res *result) bool) []string {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var removed []string
+	for p, el := range c.entries {
+		if match(el.Value.(*resultCacheEntry).res) {
+			c.remove(el)
+			removed = append(removed, p)
+		}
+	}
+	return removed
+}
+
+func (c *resultCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*resultCacheEntry)
+	delete(c.entries, entry.res.Path)
+	c.bytes -= int64(len(entry.res.Data))
+}
+
+// Size returns the total size of the cached results and how many there are.
+// A nil cache is empty.
+func (c *resultCache) Size() (bytes int64, entries int) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes, c.lru.Len()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cachedResult(p string, size int) *result {
+	return &result{Path: p, Data: make([]byte, size), Created: time.Now()}
+}
+
+// cachedPaths returns the paths in c, most recently used first.
+func cachedPaths(c *resultCache) []string {
+	var paths []string
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		paths = append(paths, el.Value.(*resultCacheEntry).res.Path)
+	}
+	return paths
+}
+
+func TestResultCacheLRU(t *testing.T) {
+	c := newResultCache(30, 0)
+	c.Add(cachedResult("/a", 10))
+	c.Add(cachedResult("/b", 10))
+	c.Add(cachedResult("/c", 10))
+	if _, ok := c.Get("/a"); !ok {
+		t.Fatal("/a isn't cached")
+	}
+	c.Add(cachedResult("/d", 10))
+	if want := []string{"/d", "/a", "/c"}; !reflect.DeepEqual(cachedPaths(c), want) {
+		t.Errorf("cached %v, want %v with /b evicted as least recently used", cachedPaths(c), want)
+	}
+
+	// One large result evicts as many as it needs to.
+	c.Add(cachedResult("/e", 25))
+	if want := []string{"/e"}; !reflect.DeepEqual(cachedPaths(c), want) || c.bytes != 25 {
+		t.Errorf("cached %v in %d bytes, want %v in 25", cachedPaths(c), c.bytes, want)
+	}
+
+	// Replacing a result doesn't count its old data.
+	c.Add(cachedResult("/e", 5))
+	if bytes, entries := c.Size(); bytes != 5 || entries != 1 {
+		t.Errorf("after replacing /e: %d bytes in %d entries, want 5 in 1", bytes, entries)
+	}
+
+	// Results larger than the cache aren't cached and evict nothing.
+	c.Add(cachedResult("/huge", 31))
+	if _, ok := c.Get("/huge"); ok {
+		t.Error("a result larger than the cache was cached")
+	}
+	if _, ok := c.Get("/e"); !ok {
+		t.Error("adding a result larger than the cache evicted /e")
+	}
+}
+
+func TestResultCacheTTL(t *testing.T) {
+	defer func(ttl time.Duration) { resultTTL = ttl }(resultTTL)
+	resultTTL = 0
+
+	c := newResultCache(100, 20*time.Millisecond)
+	c.Add(cachedResult("/a", 10))
+	if _, ok := c.Get("/a"); !ok {
+		t.Fatal("/a isn't cached")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("/a"); ok {
+		t.Error("/a is still cached after the ttl")
+	}
+	if c.bytes != 0 || len(c.entries) != 0 || c.lru.Len() != 0 {
+		t.Errorf("expired entry left %d bytes, %d entries", c.bytes, len(c.entries))
+	}
+
+	// Without a ttl entries stay until they go stale.
+	c = newResultCache(100, 0)
+	c.Add(cachedResult("/a", 10))
+	if e := c.entries["/a"].Value.(*resultCacheEntry); !e.expires.IsZero() {
+		t.Errorf("entry expires at %v without a ttl or result ttl", e.expires)
+	}
+
+	resultTTL = time.Minute
+	c = newResultCache(100, time.Hour)
+	fresh := cachedResult("/fresh", 10)
+	c.Add(fresh)
+	if e := c.entries["/fresh"].Value.(*resultCacheEntry); !e.expires.Equal(fresh.Created.Add(time.Minute)) {
+		t.Errorf("entry expires at %v, want when the result goes stale, %v", e.expires, fresh.Created.Add(time.Minute))
+	}
+	stale := cachedResult("/stale", 10)
+	stale.Created = time.Now().Add(-2 * time.Minute)
+	c.Add(stale)
+	if _, ok := c.Get("/stale"); ok {
+		t.Error("a stale result was cached")
+	}
+}
+
+func TestResultCacheRemove(t *testing.T) {
+	c := newResultCache(100, 0)
+	for _, p := range []string{"/300x200/a.jpg", "/100x100/a.jpg", "/300x200/b.jpg"} {
+		c.Add(cachedResult(p, 10))
+	}
+	c.Remove("/100x100/a.jpg")
+	c.Remove("/missing")
+	removed := c.RemoveMatching(func(res *result) bool { return strings.HasPrefix(res.Path, "/300x200/") })
+	sort.Strings(removed)
+	if want := []string{"/300x200/a.jpg", "/300x200/b.jpg"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("RemoveMatching removed %v, want %v", removed, want)
+	}
+	if c.bytes != 0 || len(c.entries) != 0 {
+		t.Errorf("%d bytes in %d entries left", c.bytes, len(c.entries))
+	}
+
+	// A nil cache is disabled.
+	var disabled *resultCache
+	disabled.Add(cachedResult("/a", 1))
+	disabled.Remove("/a")
+	if _, ok := disabled.Get("/a"); ok || disabled.RemoveMatching(func(*result) bool { return true }) != nil {
+		t.Error("a nil cache holds results")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	shutdownTimeout time.Duration
+
+	// activeRequests and pendingStores track work that shutdown waits for:
+	// image requests being served and results being written to storage in
+	// the background after the response has gone out.
+	activeRequests = newWorkTracker()
+	pendingStores  = newWorkTracker()
+)
+
+// workTracker counts running pieces of work by name, so that shutdown can
+// wait for them and report the ones it gave up on. Once shutdown starts
+// waiting no new work is accepted, so that nothing starts behind its back.
+type workTracker struct {
+	mu      sync.Mutex
+	running map[string]int
+	count   int
+	closed  bool
+	idle    chan struct{} // closed once count drops to zero, while waited on
+}
+
+func newWorkTracker() *workTracker {
+	return &workTracker{running: make(map[string]int)}
+}
+
+// Start records that work called name has started. The returned func must
+// be called when it finishes. Once Wait has been called Start refuses new
+// work by returning false, and the work should not be done.
+func (t *workTracker) Start(name string) (done func(), ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, false
+	}
+	t.count++
+	t.running[name]++
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.running[name]--; t.running[name] == 0 {
+			delete(t.running, name)
+		}
+		if t.count--; t.count == 0 && t.idle != nil {
+			close(t.idle)
+			t.idle = nil
+		}
+	}, true
+}
+
+// Go runs fn in the background as work called name. It returns false
+// without running fn once Wait has been called.
+func (t *workTracker) Go(name string, fn func()) bool {
+	done, ok := t.Start(name)
+	if !ok {
+		return false
+	}
+	go func() {
+		defer done()
+		fn()
+	}()
+	return true
+}
+
+// Wait stops new work from starting and waits until all running work has
+// finished or the deadline passes, returning the names of the work still
+// running.
+func (t *workTracker) Wait(deadline time.Time) []string {
+	t.mu.Lock()
+	t.closed = true
+	if t.count == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return nil
+	case <-timer.C:
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var names []string
+	for name := range t.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serve runs srv until SIGTERM or SIGINT, then stops accepting connections
+// and waits up to shutdownTimeout for in-flight requests and background
+// result stores to finish.
+func serve(srv *http.Server) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigc:
+		rootLogger.Info("shutting down", "signal", sig.String(), "timeout_ms", shutdownTimeout)
+	}
+
+	deadline := time.Now().Add(shutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		rootLogger.Error("stopping server", "error", err)
+	}
+	for _, path := range activeRequests.Wait(deadline) {
+		rootLogger.Error("abandoned request", "path", path)
+	}
+	for _, path := range pendingStores.Wait(deadline) {
+		rootLogger.Error("abandoned result store", "result_path", path)
+	}
+	rootLogger.Info("shutdown complete")
+	return nil
+}
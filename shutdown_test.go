@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkTrackerWaits(t *testing.T) {
+	tr := newWorkTracker()
+	release := make(chan struct{})
+	for _, name := range []string{"/a.jpg", "/b.jpg"} {
+		if !tr.Go(name, func() { <-release }) {
+			t.Fatalf("Go(%s) refused work before shutdown", name)
+		}
+	}
+	time.AfterFunc(10*time.Millisecond, func() { close(release) })
+	if abandoned := tr.Wait(time.Now().Add(time.Minute)); abandoned != nil {
+		t.Errorf("Wait abandoned %v, want nothing", abandoned)
+	}
+}
+
+func TestWorkTrackerDeadline(t *testing.T) {
+	tr := newWorkTracker()
+	finished, _ := tr.Start("/done.jpg")
+	finished()
+	var stuck []func()
+	for _, name := range []string{"/b.jpg", "/a.jpg", "/b.jpg"} {
+		done, _ := tr.Start(name)
+		stuck = append(stuck, done)
+	}
+	abandoned := tr.Wait(time.Now().Add(10 * time.Millisecond))
+	if want := []string{"/a.jpg", "/b.jpg"}; !reflect.DeepEqual(abandoned, want) {
+		t.Errorf("Wait abandoned %v, want %v", abandoned, want)
+	}
+	for _, done := range stuck {
+		done()
+	}
+	if abandoned = tr.Wait(time.Now().Add(time.Minute)); abandoned != nil {
+		t.Errorf("Wait after the work finished abandoned %v", abandoned)
+	}
+}
+
+func TestWorkTrackerRefusesAfterWait(t *testing.T) {
+	tr := newWorkTracker()
+	if abandoned := tr.Wait(time.Now()); abandoned != nil {
+		t.Errorf("Wait with no work abandoned %v", abandoned)
+	}
+	if done, ok := tr.Start("/late.jpg"); ok || done != nil {
+		t.Error("Start accepted work after Wait")
+	}
+	ran := false
+	if tr.Go("/late.jpg", func() { ran = true }) || ran {
+		t.Error("Go ran work after Wait")
+	}
+}
+
+// TestWorkTrackerRace starts and finishes work while Wait runs, which the
+// race detector checks.
+func TestWorkTrackerRace(t *testing.T) {
+	tr := newWorkTracker()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr.Go("/a.jpg", func() { time.Sleep(time.Millisecond) })
+		}()
+	}
+	abandoned := tr.Wait(time.Now().Add(time.Minute))
+	wg.Wait()
+	if abandoned != nil {
+		t.Errorf("Wait abandoned %v", abandoned)
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.count != 0 {
+		t.Errorf("%d pieces of work still counted after Wait", tr.count)
+	}
+}
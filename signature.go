@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opendoor-labs/gothumb/urlbuilder"
+)
+
+// securityKeys are the keys URL signatures are checked against. The first is
+// the primary key, which new URLs should be signed with; the rest are older
+// keys that are still accepted so that URLs signed with them keep working
+// while they are rotated out.
+var securityKeys []*signingKey
+
+var (
+	// acceptedAlgorithms are the HMAC algorithms signatures are accepted
+	// with, and signingAlgorithm the one new URLs are signed with.
+	acceptedAlgorithms map[string]bool
+	signingAlgorithm   string
+)
+
+// algorithmForSignature returns the algorithm whose signatures are as long
+// as sig, or "" if there is none. Recognizing the algorithm by length means
+// URLs need no marker, and SHA-1 URLs signed before other algorithms were
+// supported keep working.
+func algorithmForSignature(sig string) string {
+	for _, a := range urlbuilder.Algorithms {
+		if len(sig) == a.SignatureLen() {
+			return string(a)
+		}
+	}
+	return ""
+}
+
+func parseSignatureAlgorithms(names []string) (map[string]bool, error) {
+	algorithms := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if urlbuilder.Algorithm(name).SignatureLen() == 0 {
+			return nil, fmt.Errorf("unknown signature algorithm %q, expected one of sha1, sha256, sha512", name)
+		}
+		algorithms[name] = true
+	}
+	return algorithms, nil
+}
+
+var (
+	signatureMatches = newCounterVec("gothumb_signature_matches_total",
+		"Valid URL signatures by the key and algorithm that matched.", "key", "algorithm")
+	signatureFailures = newCounterVec("gothumb_signature_failures_total",
+		"Invalid URL signatures by reason.", "reason")
+)
+
+// keyIDPattern is what a key id must look like. A URL separates the id from
+// its signature with a dot, so ids may not contain one.
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// signingKey is a secret URLs are signed with. A key may have an id, which a
+// URL can put in front of its signature, as in /<id>.<signature>/..., so that
+// only that key is tried.
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+// name identifies the key in logs and metrics without revealing it.
+func (k *signingKey) name() string {
+	if k.id != "" {
+		return k.id
+	}
+	sum := sha256.Sum256(k.secret)
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// sign returns the signature of pathPart, the part of a URL after the
+// signature segment, using the named algorithm.
+func (k *signingKey) sign(algorithm, pathPart string) string {
+	sig, _ := urlbuilder.Sign(urlbuilder.Algorithm(algorithm), k.secret, pathPart)
+	return sig
+}
+
+// splitKeyEntry splits a security_keys entry of the form id=secret. The
+// entry is only split when the part before the first = is a valid key id
+// and a secret follows it, so that a bare secret containing : or ending in
+// base64 = padding is never mistaken for an id.
+func splitKeyEntry(entry string) (id, secret string) {
+	i := strings.Index(entry, "=")
+	if i > 0 && strings.Trim(entry[i:], "=") != "" && keyIDPattern.MatchString(entry[:i]) {
+		return entry[:i], entry[i+1:]
+	}
+	return "", entry
+}
+
+// parseSecurityKeys builds the key list from the primary security_key and
+// the security_keys entries, each either a bare secret or id=secret. When
+// primary is empty the first entry is the primary key.
+func parseSecurityKeys(primary string, entries []string) ([]*signingKey, error) {
+	var keys []*signingKey
+	if primary != "" {
+		keys = append(keys, &signingKey{secret: []byte(primary)})
+	}
+	ids := make(map[string]bool)
+	for _, entry := range entries {
+		if entry == "" {
+			return nil, errors.New("security_keys has an empty key")
+		}
+		id, secret := splitKeyEntry(entry)
+		if id != "" {
+			if ids[id] {
+				return nil, fmt.Errorf("security key id %q is used twice", id)
+			}
+			ids[id] = true
+		}
+		keys = append(keys, &signingKey{id: id, secret: []byte(secret)})
+	}
+	return keys, nil
+}
+
+// validateSignature checks sig, the first segment of a request path,
+// against pathPart, the rest of the path, and returns the key and algorithm
+// that signed it. The key is nil for /unsafe URLs.
+func validateSignature(sig, pathPart string) (key *signingKey, algorithm string, err error) {
+	if unsafeMode && sig == "unsafe" {
+		return nil, "", nil
+	}
+
+	candidates := securityKeys
+	if i := strings.LastIndex(sig, "."); i >= 0 {
+		id := sig[:i]
+		sig = sig[i+1:]
+		candidates = nil
+		for _, k := range securityKeys {
+			if k.id == id {
+				candidates = []*signingKey{k}
+				break
+			}
+		}
+		if candidates == nil {
+			signatureFailures.Inc("unknown_key")
+			return nil, "", fmt.Errorf("unknown key id %q", id)
+		}
+	}
+
+	algorithm = algorithmForSignature(sig)
+	if algorithm == "" {
+		signatureFailures.Inc("malformed")
+		return nil, "", errors.New("malformed signature")
+	}
+	if !acceptedAlgorithms[algorithm] {
+		signatureFailures.Inc("algorithm_not_accepted")
+		return nil, "", fmt.Errorf("%s signatures are not accepted", algorithm)
+	}
+
+	for _, k := range candidates {
+		// constant-time string comparison
+		if subtle.ConstantTimeCompare([]byte(sig), []byte(k.sign(algorithm, pathPart))) == 1 {
+			signatureMatches.Inc(k.name(), algorithm)
+			return k, algorithm, nil
+		}
+	}
+	signatureFailures.Inc("mismatch")
+	return nil, "", errors.New("signature mismatch")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSecurityKeys(t *testing.T) {
+	cases := []struct {
+		name    string
+		primary string
+		entries []string
+		ids     []string
+		secrets []string
+	}{
+		{"primary only", "main", nil, []string{""}, []string{"main"}},
+		{"bare secrets", "", []string{"one", "two"}, []string{"", ""}, []string{"one", "two"}},
+		{"ids", "main", []string{"v1=old", "v_2-b=older"}, []string{"", "v1", "v_2-b"}, []string{"main", "old", "older"}},
+		{"secret with colons", "", []string{"v1:not-an-id", "https://x"}, []string{"", ""}, []string{"v1:not-an-id", "https://x"}},
+		{"base64 padding", "", []string{"c2VjcmV0==", "YWJjZA="}, []string{"", ""}, []string{"c2VjcmV0==", "YWJjZA="}},
+		{"invalid id", "", []string{"not an id=secret", "a.b=secret"}, []string{"", ""}, []string{"not an id=secret", "a.b=secret"}},
+		{"only the first = splits", "", []string{"v1=a=b"}, []string{"v1"}, []string{"a=b"}},
+	}
+	for _, c := range cases {
+		keys, err := parseSecurityKeys(c.primary, c.entries)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if len(keys) != len(c.ids) {
+			t.Errorf("%s: got %d keys, want %d", c.name, len(keys), len(c.ids))
+			continue
+		}
+		for i, k := range keys {
+			if k.id != c.ids[i] || string(k.secret) != c.secrets[i] {
+				t.Errorf("%s: key %d = %q/%q, want %q/%q", c.name, i, k.id, k.secret, c.ids[i], c.secrets[i])
+			}
+		}
+	}
+}
+
+func TestParseSecurityKeysErrors(t *testing.T) {
+	cases := []struct {
+		entries []string
+		err     string
+	}{
+		{[]string{"v1=a", "v1=b"}, `security key id "v1" is used twice`},
+		{[]string{"a", ""}, "security_keys has an empty key"},
+	}
+	for _, c := range cases {
+		keys, err := parseSecurityKeys("", c.entries)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: got %v, %v, want error %q", c.entries, keys, err, c.err)
+		}
+	}
+}
+
+func TestValidateSignatureKeyIDs(t *testing.T) {
+	defer func(keys []*signingKey, algorithms map[string]bool) {
+		securityKeys, acceptedAlgorithms = keys, algorithms
+	}(securityKeys, acceptedAlgorithms)
+	acceptedAlgorithms = map[string]bool{"sha256": true}
+	var err error
+	if securityKeys, err = parseSecurityKeys("current", []string{"v1=old", "legacy:secret"}); err != nil {
+		t.Fatal(err)
+	}
+	current, old, legacy := securityKeys[0], securityKeys[1], securityKeys[2]
+	const path = "300x200/https://example.com/a.jpg"
+
+	cases := []struct {
+		name string
+		sig  string
+		want *signingKey
+		err  string
+	}{
+		{"primary key", current.sign("sha256", path), current, ""},
+		{"older key without its id", old.sign("sha256", path), old, ""},
+		{"older key with its id", "v1." + old.sign("sha256", path), old, ""},
+		{"bare secret with a colon", legacy.sign("sha256", path), legacy, ""},
+		{"id of another key", "v1." + current.sign("sha256", path), nil, "signature mismatch"},
+		{"unknown id", "v2." + old.sign("sha256", path), nil, `unknown key id "v2"`},
+		{"colon secret's prefix is no id", "legacy." + legacy.sign("sha256", path), nil, `unknown key id "legacy"`},
+	}
+	for _, c := range cases {
+		key, _, err := validateSignature(c.sig, path)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil || key != c.want {
+			t.Errorf("%s: matched %v (%v), want %v", c.name, key, err, c.want)
+		}
+	}
+}
+
+func TestAlgorithmForSignature(t *testing.T) {
+	cases := map[int]string{28: "sha1", 27: "", 44: "sha256", 88: "sha512", 0: "", 43: "", 64: ""}
+	for n, want := range cases {
+		if got := algorithmForSignature(strings.Repeat("a", n)); got != want {
+			t.Errorf("algorithmForSignature of %d characters = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestParseSignatureAlgorithms(t *testing.T) {
+	got, err := parseSignatureAlgorithms([]string{" SHA256", "sha512"})
+	if err != nil || len(got) != 2 || !got["sha256"] || !got["sha512"] {
+		t.Errorf("parseSignatureAlgorithms = %v, %v, want sha256 and sha512", got, err)
+	}
+	if _, err := parseSignatureAlgorithms([]string{"sha1", "md5"}); err == nil || !strings.Contains(err.Error(), `"md5"`) {
+		t.Errorf("parseSignatureAlgorithms with md5: %v", err)
+	}
+}
+
+func TestValidateSignatureAlgorithms(t *testing.T) {
+	defer func(keys []*signingKey, algorithms map[string]bool, unsafe bool) {
+		securityKeys, acceptedAlgorithms, unsafeMode = keys, algorithms, unsafe
+	}(securityKeys, acceptedAlgorithms, unsafeMode)
+	key := &signingKey{secret: []byte("secret")}
+	securityKeys = []*signingKey{key}
+	acceptedAlgorithms = map[string]bool{"sha256": true, "sha512": true}
+	const path = "expires:1893456000/300x200/a.jpg"
+
+	for _, algorithm := range []string{"sha256", "sha512"} {
+		k, got, err := validateSignature(key.sign(algorithm, path), path)
+		if err != nil || k != key || got != algorithm {
+			t.Errorf("%s signature: got %v/%q, %v", algorithm, k, got, err)
+		}
+	}
+
+	cases := []struct {
+		name, sig, path, err string
+	}{
+		{"algorithm not accepted", key.sign("sha1", path), path, "sha1 signatures are not accepted"},
+		{"malformed", "abc", path, "malformed signature"},
+		{"unsafe when not allowed", "unsafe", path, "malformed signature"},
+		{"expiry changed", key.sign("sha256", path), "expires:1993456000/300x200/a.jpg", "signature mismatch"},
+		{"expiry removed", key.sign("sha256", path), "300x200/a.jpg", "signature mismatch"},
+	}
+	for _, c := range cases {
+		k, algorithm, err := validateSignature(c.sig, c.path)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%s: got %v/%q, %v, want error %q", c.name, k, algorithm, err, c.err)
+		}
+	}
+
+	unsafeMode = true
+	if k, algorithm, err := validateSignature("unsafe", path); k != nil || algorithm != "" || err != nil {
+		t.Errorf("unsafe URL: got %v/%q, %v", k, algorithm, err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cachedSources keeps fetched source images so that rendering several sizes
+// of one image downloads it once. It is nil when disabled.
+var cachedSources *sourceCache
+
+var sourceCacheLookups = newCounterVec("gothumb_source_cache_lookups_total",
+	"Source cache lookups by outcome: hit, revalidated (unchanged at the origin), changed or miss.", "outcome")
+
+// sourceCache stores sources in a ResultStorage along with the validators
+// the origin sent. Sources are used for ttl after they were fetched or last
+// revalidated, and are then revalidated with a conditional request.
+type sourceCache struct {
+	store ResultStorage
+	ttl   time.Duration
+}
+
+// cachedSource is a source image read from the cache.
+type cachedSource struct {
+	data []byte
+	meta *ResultMeta
+}
+
+// newSourceCache builds the source cache selected by the source_cache
+// setting, which keeps sources in memory, in files or in result storage.
+func newSourceCache(c *Config, results ResultStorage) (*sourceCache, error) {
+	var store ResultStorage
+	switch c.SourceCache {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		store = newBoundedStorage(newMemoryResultStorage(), c.SourceCacheBytes)
+	case "file":
+		fs, err := newFileResultStorage(c.SourceCachePath)
+		if err != nil {
+			return nil, err
+		}
+		bounded := newBoundedStorage(fs, c.SourceCacheBytes)
+		if err = bounded.trackFiles(fs); err != nil {
+			return nil, err
+		}
+		store = bounded
+	case "storage":
+		if results == nil {
+			return nil, fmt.Errorf("source_cache storage requires result storage")
+		}
+		store = results
+	default:
+		return nil, fmt.Errorf("unknown source cache %q", c.SourceCache)
+	}
+	return &sourceCache{store: store, ttl: time.Duration(c.SourceCacheTTL)}, nil
+}
+
+// sourceCacheKey returns the storage path for a source URL. Sources are
+// kept under /.sources so that they can share a bucket with results.
+func sourceCacheKey(sourceURL string) string {
+	sum := sha256.Sum256([]byte(sourceURL))
+	h := hex.EncodeToString(sum[:])
+	return "/.sources/" + h[:2] + "/" + h
+}
+
+// get returns the cached copy of sourceURL, or nil if there is none.
+func (c *sourceCache) get(sourceURL string) *cachedSource {
+	if c == nil {
+		return nil
+	}
+	r, meta, err := c.store.Get(sourceCacheKey(sourceURL))
+	if err != nil {
+		if err != errResultNotFound {
+			rootLogger.Error("reading cached source", "source", sourceURL, "error", err)
+		}
+		return nil
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		rootLogger.Error("reading cached source", "source", sourceURL, "error", err)
+		return nil
+	}
+	return &cachedSource{data: data, meta: meta}
+}
+
+// fresh reports whether s may be used without revalidating it. The time a
+// source was stored is its LastModified.
+func (c *sourceCache) fresh(s *cachedSource) bool {
+	return time.Since(s.meta.LastModified) < c.ttl
+}
+
+// put caches data fetched from sourceURL with the validators in h. Sources
+// the origin marks no-store, and sources that could never be revalidated or
+// reused, are not cached.
+func (c *sourceCache) put(sourceURL string, data []byte, contentType string, h http.Header) {
+	if c == nil || noStore(h) {
+		return
+	}
+	meta := &ResultMeta{
+		ContentType:        contentType,
+		SourceETag:         h.Get("ETag"),
+		SourceLastModified: h.Get("Last-Modified"),
+	}
+	if c.ttl <= 0 && meta.SourceETag == "" && meta.SourceLastModified == "" {
+		return
+	}
+	key := sourceCacheKey(sourceURL)
+	pendingStores.Go(key, func() {
+		if err := c.store.Put(key, data, meta); err != nil {
+			rootLogger.Error("caching source", "source", sourceURL, "error", err)
+		}
+	})
+}
+
+// refresh records that the origin confirmed s is still current, with the
+// validators in h from its 304, restarting its ttl without storing its data
+// again. With a store that can't update metadata, s stays stale and is
+// revalidated again when next used.
+func (c *sourceCache) refresh(sourceURL string, s *cachedSource, h http.Header) {
+	if c == nil || noStore(h) {
+		return
+	}
+	updater, ok := c.store.(MetaUpdater)
+	if !ok {
+		return
+	}
+	meta := *s.meta
+	meta.SourceETag = h.Get("ETag")
+	meta.SourceLastModified = h.Get("Last-Modified")
+	key := sourceCacheKey(sourceURL)
+	pendingStores.Go(key, func() {
+		err := updater.UpdateMeta(key, &meta)
+		if err != nil && err != errResultNotFound && err != errMetaUpdateUnsupported {
+			rootLogger.Error("refreshing cached source", "source", sourceURL, "error", err)
+		}
+	})
+}
+
+func noStore(h http.Header) bool {
+	return strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-store")
+}
+
+// remove drops the cached copy of sourceURL, so that it is fetched again.
+func (c *sourceCache) remove(sourceURL string) {
+	if c == nil {
+		return
+	}
+	if err := c.store.Delete(sourceCacheKey(sourceURL)); err != nil {
+		rootLogger.Error("removing cached source", "source", sourceURL, "error", err)
+	}
+}
+
+// setValidators makes req conditional on the source not having changed
+// since s was cached.
+func (s *cachedSource) setValidators(req *http.Request) {
+	if s.meta.SourceETag != "" {
+		req.Header.Set("If-None-Match", s.meta.SourceETag)
+	}
+	if s.meta.SourceLastModified != "" {
+		req.Header.Set("If-Modified-Since", s.meta.SourceLastModified)
+	}
+}
+
+// validators returns the headers to cache s again with after a 304, which
+// may carry updated validators.
+func (s *cachedSource) validators(notModified http.Header) http.Header {
+	h := make(http.Header)
+	h.Set("ETag", s.meta.SourceETag)
+	h.Set("Last-Modified", s.meta.SourceLastModified)
+	for _, name := range []string{"ETag", "Last-Modified", "Cache-Control"} {
+		if v := notModified.Get(name); v != "" {
+			h.Set(name, v)
+		}
+	}
+	return h
+}
+
+// source returns s with the validators it was cached with.
+func (s *cachedSource) source() *sourceImage {
+	return &sourceImage{Data: s.data, ETag: s.meta.SourceETag, LastModified: s.meta.SourceLastModified}
+}
+
+// check applies the limits fetchSource enforces to a cached source, since
+// they may have changed since it was cached.
+func (s *cachedSource) check() error {
+	if maxSourceBytes > 0 && int64(len(s.data)) > maxSourceBytes {
+		return sourceTooLargeError()
+	}
+	if !genericContentTypes[s.meta.ContentType] && !allowedSourceType(s.meta.ContentType) {
+		return &statusError{Code: 415, Message: fmt.Sprintf("source content type %q is not allowed", s.meta.ContentType)}
+	}
+	if genericContentTypes[s.meta.ContentType] {
+		return checkSourceType(s.data)
+	}
+	return nil
+}
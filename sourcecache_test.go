@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewSourceCache(t *testing.T) {
+	cases := []struct {
+		cache   string
+		results ResultStorage
+		err     string
+	}{
+		{"none", nil, ""},
+		{"memory", nil, ""},
+		{"storage", newMemoryResultStorage(), ""},
+		{"storage", nil, "source_cache storage requires result storage"},
+		{"redis", nil, `unknown source cache "redis"`},
+	}
+	for _, c := range cases {
+		conf := defaultConfig()
+		conf.SourceCache = c.cache
+		sc, err := newSourceCache(conf, c.results)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s: error %v, want %q", c.cache, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.cache, err)
+			continue
+		}
+		if (sc == nil) != (c.cache == "none") {
+			t.Errorf("%s: got cache %v", c.cache, sc)
+		}
+	}
+}
+
+func TestSourceCacheKey(t *testing.T) {
+	pattern := regexp.MustCompile(`^/\.sources/([0-9a-f]{2})/([0-9a-f]{64})$`)
+	a, b := sourceCacheKey("https://example.com/a.jpg"), sourceCacheKey("https://example.com/b.jpg")
+	for _, key := range []string{a, b} {
+		if m := pattern.FindStringSubmatch(key); m == nil || !strings.HasPrefix(m[2], m[1]) {
+			t.Errorf("sourceCacheKey = %s, want /.sources/<first two of hash>/<sha-256 hash>", key)
+		}
+	}
+	if a == b {
+		t.Errorf("two sources share the key %s", a)
+	}
+}
+
+// TestFetchSourceCached checks that cached sources are used while fresh,
+// revalidated once stale and fetched again when they change.
+func TestFetchSourceCached(t *testing.T) {
+	version, requests, conditional := "v1", 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Header.Get("If-None-Match") != "" {
+			conditional++
+		}
+		if req.URL.Path == "/no-store.jpg" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Header().Set("ETag", `"`+version+`"`)
+		if req.Header.Get("If-None-Match") == `"`+version+`"` {
+			w.WriteHeader(304)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(append(jpegData, version...))
+	}))
+	defer srv.Close()
+	defer useSourceSettings(1000, time.Second)()
+	defer func(tr *workTracker) { pendingStores = tr }(pendingStores)
+	// fetch fetches a source and waits for it to be cached.
+	fetch := func(p string) string {
+		pendingStores = newWorkTracker()
+		src, err := fetchSource(srv.URL + p)
+		if abandoned := pendingStores.Wait(time.Now().Add(time.Second)); abandoned != nil {
+			t.Fatalf("caching %s didn't finish", p)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		return strings.TrimPrefix(string(src.Data), string(jpegData))
+	}
+
+	store := &putCountingStorage{memoryResultStorage: newMemoryResultStorage()}
+	cachedSources = &sourceCache{store: store, ttl: time.Hour}
+	fetch("/a.jpg")
+	version = "v2"
+	if got := fetch("/a.jpg"); got != "v1" || requests != 1 {
+		t.Errorf("fresh cached source: got %s after %d requests, want v1 after 1", got, requests)
+	}
+
+	// Once stale, the cached copy is revalidated and used while unchanged.
+	cachedSources.ttl = 0
+	requests = 0
+	version = "v1"
+	if got := fetch("/a.jpg"); got != "v1" || requests != 1 || conditional != 1 {
+		t.Errorf("unchanged source: got %s after %d requests, %d conditional", got, requests, conditional)
+	}
+	// Revalidating refreshes the cached copy's metadata, restarting its ttl,
+	// without storing the unchanged data again.
+	if store.puts != 1 {
+		t.Errorf("source stored %d times, want once before it was revalidated", store.puts)
+	}
+	cachedSources.ttl = time.Hour
+	if got := fetch("/a.jpg"); got != "v1" || requests != 1 {
+		t.Errorf("revalidated source: got %s after %d requests, want it fresh again", got, requests)
+	}
+	cachedSources.ttl = 0
+	version = "v2"
+	if got := fetch("/a.jpg"); got != "v2" || conditional != 2 {
+		t.Errorf("changed source: got %s, %d conditional requests", got, conditional)
+	}
+	if cached := cachedSources.get(srv.URL + "/a.jpg"); cached == nil || cached.meta.SourceETag != `"v2"` {
+		t.Errorf("the changed source wasn't cached: %+v", cached)
+	}
+
+	// Limits lowered since a source was cached still apply.
+	cachedSources.ttl = time.Hour
+	maxSourceBytes = 5
+	if _, err := fetchSource(srv.URL + "/a.jpg"); err == nil || err.(*statusError).Code != 413 {
+		t.Errorf("cached source over max_source_bytes: %v, want a 413", err)
+	}
+	maxSourceBytes = 1000
+
+	fetch("/no-store.jpg")
+	if cachedSources.get(srv.URL+"/no-store.jpg") != nil {
+		t.Error("a no-store source was cached")
+	}
+	cachedSources.remove(srv.URL + "/a.jpg")
+	if cachedSources.get(srv.URL+"/a.jpg") != nil {
+		t.Error("a removed source is still cached")
+	}
+}
+
+// putCountingStorage counts the results stored in it.
+type putCountingStorage struct {
+	*memoryResultStorage
+	puts int
+}
+
+func (s *putCountingStorage) Put(path string, data []byte, meta *ResultMeta) error {
+	s.puts++
+	return s.memoryResultStorage.Put(path, data, meta)
+}
+
+// TestFetchSourceCoalesced checks that concurrent fetches of one source
+// share a single download.
+func TestFetchSourceCoalesced(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(jpegData)
+	}))
+	defer srv.Close()
+	defer useSourceSettings(0, 5*time.Second)()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src, err := fetchSource(srv.URL + "/a.jpg")
+			if err == nil && string(src.Data) != string(jpegData) {
+				err = fmt.Errorf("fetched %q", src.Data)
+			}
+			errs <- err
+		}()
+	}
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // let the other fetches join
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("%d requests for one source fetched concurrently, want 1", n)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	allowedSourceHosts  []string
+	allowPrivateSources bool
+)
+
+// blockedSourceError is returned when a source's host is not allowed or
+// resolves to an address gothumb refuses to connect to.
+type blockedSourceError struct {
+	msg string
+}
+
+func (e *blockedSourceError) Error() string { return e.msg }
+
+// privateNetworks are the ranges sources may not resolve to unless
+// -allow-private-sources is set: loopback, RFC 1918 and RFC 4193 private,
+// link-local (which includes the EC2 metadata endpoint), carrier-grade NAT,
+// the IETF protocol assignments, documentation and benchmarking ranges,
+// multicast, reserved and unspecified addresses, and the IPv4-compatible,
+// NAT64 and 6to4 prefixes, which embed an IPv4 address that may be any of
+// them.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/96",
+	"::1/128",
+	"64:ff9b::/96",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAllowedSourceHosts parses a comma-separated list of host patterns as
+// understood by path.Match, e.g. "photos.example.com,*.cdn.example.com".
+func parseAllowedSourceHosts(hosts []string) ([]string, error) {
+	var patterns []string
+	for _, p := range hosts {
+		if p = strings.ToLower(strings.TrimSpace(p)); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid source host pattern %q", p)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// checkSourceHost returns a *blockedSourceError unless u's host matches
+// allowedSourceHosts. An empty allowlist allows every host.
+func checkSourceHost(u *url.URL) error {
+	if len(allowedSourceHosts) == 0 {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, p := range allowedSourceHosts {
+		if ok, _ := path.Match(p, host); ok {
+			return nil
+		}
+	}
+	return &blockedSourceError{fmt.Sprintf("source host %q is not allowed", host)}
+}
+
+// checkSourceRedirect applies the host allowlist to every redirect a source
+// fetch follows.
+func checkSourceRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	return checkSourceHost(req.URL)
+}
+
+// guardedDialer resolves hosts itself so that it can refuse private
+// addresses before connecting, rather than trusting the name it was given.
+// Private addresses are allowed if allowPrivateSources was set when it was
+// made.
+type guardedDialer struct {
+	net.Dialer
+	allowPrivate bool
+}
+
+func (d *guardedDialer) Dial(network, addr string) (net.Conn, error) {
+	if d.allowPrivate {
+		return d.Dialer.Dial(network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			lastErr = &blockedSourceError{fmt.Sprintf("source host %q resolves to private address %s", host, ip)}
+			continue
+		}
+		conn, err := d.Dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses found for %q", host)
+	}
+	return nil, lastErr
+}
+
+// lookupIP resolves host, giving up after the connect timeout so that a slow
+// DNS server can't hold a fetch past it.
+func (d *guardedDialer) lookupIP(host string) ([]net.IP, error) {
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+func newGuardedDialer(connectTimeout time.Duration) *guardedDialer {
+	return &guardedDialer{
+		Dialer: net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		},
+		allowPrivate: allowPrivateSources,
+	}
+}
+
+// asBlockedSourceError digs a *blockedSourceError out of the errors
+// net/http wraps dial and redirect failures in.
+func asBlockedSourceError(err error) (*blockedSourceError, bool) {
+	for {
+		switch e := err.(type) {
+		case *blockedSourceError:
+			return e, true
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"0.0.0.0", true},
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.127.255.255", true},
+		{"100.128.0.1", false},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.0.0.8", true},
+		{"192.0.2.1", true},
+		{"192.0.3.1", false},
+		{"192.168.1.1", true},
+		{"198.18.0.1", true},
+		{"198.19.255.255", true},
+		{"198.20.0.1", false},
+		{"198.51.100.7", true},
+		{"203.0.113.7", true},
+		{"224.0.0.1", true},
+		{"239.255.255.250", true},
+		{"240.0.0.1", true},
+		{"255.255.255.255", true},
+		{"8.8.8.8", false},
+		{"93.184.216.34", false},
+		{"::", true},
+		{"::1", true},
+		{"::7f00:1", true},
+		{"::a9fe:a9fe", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b::808:808", true},
+		{"2002:a9fe:a9fe::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+	}
+	for _, c := range cases {
+		if got := isPrivateIP(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", c.ip, got, c.want)
+		}
+	}
+}
+
+func TestGuardedDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	defer func(allow bool) { allowPrivateSources = allow }(allowPrivateSources)
+
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		addr := net.JoinHostPort(host, port)
+		allowPrivateSources = false
+		d := newGuardedDialer(time.Second)
+		conn, err := d.Dial("tcp", addr)
+		if _, ok := err.(*blockedSourceError); !ok {
+			t.Errorf("Dial %s = %v, want a blockedSourceError", addr, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+
+		allowPrivateSources = true
+		d = newGuardedDialer(time.Second)
+		if conn, err = d.Dial("tcp", addr); err != nil {
+			t.Errorf("Dial %s with private sources allowed: %v", addr, err)
+		} else {
+			conn.Close()
+		}
+	}
+}
+
+func TestGuardedDialerLookupTimeout(t *testing.T) {
+	defer func(allow bool) { allowPrivateSources = allow }(allowPrivateSources)
+	allowPrivateSources = false
+	d := newGuardedDialer(20 * time.Millisecond)
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	start := time.Now()
+	if _, err := d.Dial("tcp", "slow.example.com:80"); err == nil {
+		t.Error("Dial succeeded without resolving the host")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Dial took %s, want it to give up after the 20ms connect timeout", took)
+	}
+}
+
+func TestAsBlockedSourceError(t *testing.T) {
+	blocked := &blockedSourceError{"blocked"}
+	wrapped := &url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "dial", Err: blocked}}
+	if got, ok := asBlockedSourceError(wrapped); !ok || got != blocked {
+		t.Errorf("asBlockedSourceError(%v) = %v, %v", wrapped, got, ok)
+	}
+	if _, ok := asBlockedSourceError(&url.Error{Op: "Get", Err: net.UnknownNetworkError("x")}); ok {
+		t.Error("asBlockedSourceError found a blockedSourceError that isn't there")
+	}
+}
+
+func TestCheckSourceHost(t *testing.T) {
+	defer func(hosts []string) { allowedSourceHosts = hosts }(allowedSourceHosts)
+	var err error
+	if allowedSourceHosts, err = parseAllowedSourceHosts([]string{" Photos.example.com ", "*.cdn.example.com", ""}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		url  string
+		want bool
+	}{
+		{"https://photos.example.com/a.jpg", true},
+		{"https://PHOTOS.example.com:8443/a.jpg", true},
+		{"https://eu.cdn.example.com/a.jpg", true},
+		{"https://cdn.example.com/a.jpg", false},
+		{"https://example.com/a.jpg", false},
+		{"https://photos.example.com.evil.com/a.jpg", false},
+	}
+	for _, c := range cases {
+		u, _ := url.Parse(c.url)
+		if err := checkSourceHost(u); (err == nil) != c.want {
+			t.Errorf("checkSourceHost(%s) = %v, want allowed %v", c.url, err, c.want)
+		}
+		req := &http.Request{URL: u}
+		if err := checkSourceRedirect(req, nil); (err == nil) != c.want {
+			t.Errorf("checkSourceRedirect(%s) = %v, want allowed %v", c.url, err, c.want)
+		}
+	}
+
+	if _, err := parseAllowedSourceHosts([]string{"[bad"}); err == nil {
+		t.Error("parseAllowedSourceHosts accepted an invalid pattern")
+	}
+}
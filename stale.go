@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"time"
+)
+
+var (
+	// resultTTL is how long a stored result is fresh after it was created.
+	// Stored results never go stale when it is 0.
+	resultTTL time.Duration
+	// staleWhileRevalidate and staleIfError are how long past its freshness
+	// a stored result may be served while it is refreshed in the background,
+	// and when refreshing it fails. Both are also sent in Cache-Control.
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+)
+
+var staleResults = newCounterVec("gothumb_stale_results_total",
+	"Stale stored results served, by reason: revalidating (refreshed in the background) or error (refreshing failed).", "reason")
+
+// freshUntil returns when res goes stale, or the zero time if it never does.
+// Results stored before creation times were recorded are aged from their
+// modification time.
+func freshUntil(res *result) time.Time {
+	if resultTTL <= 0 {
+		return time.Time{}
+	}
+	created := res.Created
+	if created.IsZero() {
+		created = res.LastModified
+	}
+	return created.Add(resultTTL)
+}
+
+// staleFor returns how long res has been stale at now, which is 0 while it
+// is fresh.
+func staleFor(res *result, now time.Time) time.Duration {
+	until := freshUntil(res)
+	if until.IsZero() || now.Before(until) {
+		return 0
+	}
+	return now.Sub(until)
+}
+
+// revalidateResult refreshes a stale stored result in the background while
+// the stale copy is served. Refreshes are coalesced with renders of the same
+// result.
+func revalidateResult(l *logger, rpath string, opts *imageOptions, stored *ResultMeta) {
+	pendingStores.Go(rpath, func() {
+		thumbnailFlights.Do(rpath, coalesceTimeout, func() (*result, error) {
+			return renderThumbnail(l, rpath, opts, stored)
+		})
+	})
+}
+
+// readStoredResult reads back the result stored at rpath, so that it can be
+// stored again as current when its source hasn't changed. It returns nil if
+// the result can't be read.
+func readStoredResult(l *logger, rpath string) *result {
+	r, meta, err := resultStorage.Get(rpath)
+	if err != nil {
+		l.Error("reading stored result to refresh", "error", err)
+		return nil
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		l.Error("reading stored result to refresh", "error", err)
+		return nil
+	}
+	return &result{
+		Data:          data,
+		ContentType:   meta.ContentType,
+		ContentLength: len(data),
+		ETag:          meta.ETag,
+		LastModified:  meta.LastModified,
+		Path:          rpath,
+	}
+}
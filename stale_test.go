@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFreshUntil(t *testing.T) {
+	defer func(ttl time.Duration) { resultTTL = ttl }(resultTTL)
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	modified := created.Add(-time.Hour)
+
+	cases := []struct {
+		ttl  time.Duration
+		res  result
+		want time.Time
+	}{
+		{0, result{Created: created}, time.Time{}},
+		{time.Hour, result{Created: created, LastModified: modified}, created.Add(time.Hour)},
+		{time.Hour, result{LastModified: modified}, modified.Add(time.Hour)},
+	}
+	for _, c := range cases {
+		resultTTL = c.ttl
+		if got := freshUntil(&c.res); !got.Equal(c.want) {
+			t.Errorf("freshUntil(%+v) with ttl %v = %v, want %v", c.res, c.ttl, got, c.want)
+		}
+	}
+}
+
+func TestStaleFor(t *testing.T) {
+	defer func(ttl time.Duration) { resultTTL = ttl }(resultTTL)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cases := []struct {
+		ttl     time.Duration
+		created time.Time
+		want    time.Duration
+	}{
+		{0, now.Add(-24 * time.Hour), 0},
+		{time.Hour, now, 0},
+		{time.Hour, now.Add(-time.Hour + time.Second), 0},
+		{time.Hour, now.Add(-time.Hour), 0},
+		{time.Hour, now.Add(-time.Hour - 90*time.Second), 90 * time.Second},
+	}
+	for _, c := range cases {
+		resultTTL = c.ttl
+		if got := staleFor(&result{Created: c.created}, now); got != c.want {
+			t.Errorf("staleFor(created %v) with ttl %v = %v, want %v", c.created, c.ttl, got, c.want)
+		}
+	}
+}
+
+// TestStaleWindows checks what is served for a stored result at each point
+// past its freshness, when refreshing it fails and when its source is
+// unchanged.
+func TestStaleWindows(t *testing.T) {
+	failing := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if failing {
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(jpegData)
+	}))
+	defer srv.Close()
+
+	c := defaultConfig()
+	c.Unsafe = true
+	defer useURLSettings(t, c)()
+	defer useSourceSettings(0, time.Second)()
+	defer func(s ResultStorage, cache *resultCache, p *workerPool, tr *workTracker, ttl, swr, sie time.Duration) {
+		resultStorage, cachedResults, processingPool, pendingStores = s, cache, p, tr
+		resultTTL, staleWhileRevalidate, staleIfError = ttl, swr, sie
+	}(resultStorage, cachedResults, processingPool, pendingStores, resultTTL, staleWhileRevalidate, staleIfError)
+	store := newMemoryResultStorage()
+	resultStorage, cachedResults = store, nil
+	processingPool = newWorkerPool(1, 1, time.Second)
+	resultTTL, staleWhileRevalidate, staleIfError = time.Hour, time.Minute, 10*time.Minute
+
+	p := "300x200/" + srv.URL + "/a.jpg"
+	opts, err := parseImageOptions(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpath := normalizePath("/" + opts.String())
+
+	cases := []struct {
+		name    string
+		stale   time.Duration
+		failing bool
+		code    int
+	}{
+		{"fresh", -time.Minute, true, 200},
+		{"revalidating", 30 * time.Second, true, 200},
+		{"refresh failed", 5 * time.Minute, true, 200},
+		{"past stale-if-error", 20 * time.Minute, true, 502},
+		{"source unchanged", 5 * time.Minute, false, 200},
+	}
+	for _, c := range cases {
+		failing = c.failing
+		created := time.Now().Add(-resultTTL - c.stale)
+		store.Put(rpath, []byte("stored"), &ResultMeta{ContentType: "image/jpeg", Created: created, SourceETag: `"v1"`})
+		pendingStores = newWorkTracker()
+
+		rec := httptest.NewRecorder()
+		newHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/unsafe/"+p, nil))
+		if abandoned := pendingStores.Wait(time.Now().Add(time.Second)); abandoned != nil {
+			t.Fatalf("%s: background work didn't finish", c.name)
+		}
+		if rec.Code != c.code {
+			t.Errorf("%s: status %d, want %d", c.name, rec.Code, c.code)
+			continue
+		}
+		if c.code == 200 && rec.Body.String() != "stored" {
+			t.Errorf("%s: served %q, want the stored result", c.name, rec.Body.String())
+		}
+
+		meta, err := store.Head(rpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refreshed := meta.Created.After(created); refreshed != !c.failing {
+			t.Errorf("%s: stored result created %v, was %v", c.name, meta.Created, created)
+		}
+	}
+}
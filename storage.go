@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// errResultNotFound is returned by a ResultStorage when nothing is stored at
+// the requested path.
+var errResultNotFound = errors.New("result not found")
+
+// errListUnsupported is returned when listing a ResultStorage that isn't a
+// ResultLister.
+var errListUnsupported = errors.New("result storage can't list results")
+
+// errMetaUpdateUnsupported is returned when updating the metadata of a
+// result in a ResultStorage that isn't a MetaUpdater.
+var errMetaUpdateUnsupported = errors.New("result storage can't update metadata")
+
+// ResultMeta describes a stored result.
+type ResultMeta struct {
+	ContentType   string
+	ContentLength int64
+	ETag          string
+	LastModified  time.Time
+
+	// Path is the result path an object stored at a hashed key was made
+	// from, which the key alone doesn't tell.
+	Path string `json:",omitempty"`
+
+	// Created is when a result was rendered, or last found to be current
+	// with its source. Stored results go stale result_ttl after it.
+	Created time.Time `json:",omitempty"`
+
+	// SourceETag and SourceLastModified are the validators an origin sent
+	// with a source image: for a cached source they are used to revalidate
+	// it, and for a result they identify the source it was rendered from.
+	SourceETag         string `json:",omitempty"`
+	SourceLastModified string `json:",omitempty"`
+}
+
+// ResultStorage persists generated results so that they can be served again
+// without fetching and resizing the source. Implementations must be safe for
+// concurrent use.
+type ResultStorage interface {
+	// Get returns the result stored at path along with its metadata. The
+	// caller is responsible for closing the returned ReadCloser.
+	Get(path string) (io.ReadCloser, *ResultMeta, error)
+	// Head returns the metadata of the result stored at path.
+	Head(path string) (*ResultMeta, error)
+	// Put stores data at path. The stored ContentLength is that of data, and
+	// the ETag is computed from data when meta.ETag is unset.
+	Put(path string, data []byte, meta *ResultMeta) error
+	// Delete removes the result stored at path. Deleting a missing result is
+	// not an error.
+	Delete(path string) error
+}
+
+// A MetaUpdater is a ResultStorage that can replace the metadata of what it
+// stores without writing the data again, which refreshing a revalidated
+// source uses.
+type MetaUpdater interface {
+	// UpdateMeta replaces the metadata of the result stored at path with
+	// meta. The stored ContentLength and ETag are kept, since the data is
+	// unchanged, and LastModified becomes the time of the update.
+	UpdateMeta(path string, meta *ResultMeta) error
+}
+
+// A ResultLister is a ResultStorage that can list the paths it stores, which
+// purging by source or prefix requires.
+type ResultLister interface {
+	// List calls fn with each stored path that starts with prefix, stopping
+	// at the first error fn returns.
+	List(prefix string, fn func(path string) error) error
+}
+
+// newResultStorage builds the ResultStorage selected by the result_storage
+// setting. A nil ResultStorage is returned when no storage is configured.
+func newResultStorage(c *Config) (ResultStorage, error) {
+	switch c.ResultStorage {
+	case "", "none":
+		return nil, nil
+	case "s3":
+		return newS3ResultStorage(c.ResultStorageBucket, c.UseRRS)
+	case "file":
+		return newFileResultStorage(c.ResultStoragePath)
+	case "memory":
+		return newMemoryResultStorage(), nil
+	}
+	return nil, fmt.Errorf("unknown result storage %q", c.ResultStorage)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"sort"
+	"sync"
+)
+
+// boundedStorage wraps a ResultStorage, deleting the least recently used
+// entries once the data it holds exceeds maxBytes. Entries are tracked in
+// memory, so only entries written or read since startup count towards the
+// limit unless they are registered with trackFiles.
+type boundedStorage struct {
+	ResultStorage
+	maxBytes int64
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List // of *boundedEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type boundedEntry struct {
+	path string
+	size int64
+}
+
+func newBoundedStorage(s ResultStorage, maxBytes int64) *boundedStorage {
+	return &boundedStorage{
+		ResultStorage: s,
+		maxBytes:      maxBytes,
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+}
+
+func (s *boundedStorage) Get(p string) (io.ReadCloser, *ResultMeta, error) {
+	r, meta, err := s.ResultStorage.Get(p)
+	s.update(p, meta, err)
+	return r, meta, err
+}
+
+func (s *boundedStorage) Head(p string) (*ResultMeta, error) {
+	meta, err := s.ResultStorage.Head(p)
+	s.update(p, meta, err)
+	return meta, err
+}
+
+// Put stores data unless it is larger than the whole limit, and evicts
+// other entries to make room for it.
+func (s *boundedStorage) Put(p string, data []byte, meta *ResultMeta) error {
+	if int64(len(data)) > s.maxBytes {
+		return nil
+	}
+	if err := s.ResultStorage.Put(p, data, meta); err != nil {
+		return err
+	}
+	s.track(p, int64(len(data)))
+	return nil
+}
+
+// UpdateMeta leaves the size of an entry alone, but marks it as recently
+// used.
+func (s *boundedStorage) UpdateMeta(p string, meta *ResultMeta) error {
+	updater, ok := s.ResultStorage.(MetaUpdater)
+	if !ok {
+		return errMetaUpdateUnsupported
+	}
+	err := updater.UpdateMeta(p, meta)
+	if err == nil {
+		s.touch(p)
+	}
+	return err
+}
+
+func (s *boundedStorage) Delete(p string) error {
+	s.untrack(p)
+	return s.ResultStorage.Delete(p)
+}
+
+func (s *boundedStorage) update(p string, meta *ResultMeta, err error) {
+	switch {
+	case err == errResultNotFound:
+		s.untrack(p)
+	case err == nil:
+		s.track(p, meta.ContentLength)
+	}
+}
+
+// track records that p holds size bytes and marks it as the most recently
+// used entry, evicting others while over the limit.
+func (s *boundedStorage) track(p string, size int64) {
+	s.mu.Lock()
+	if el, ok := s.entries[p]; ok {
+		s.bytes -= s.lru.Remove(el).(*boundedEntry).size
+	}
+	s.entries[p] = s.lru.PushFront(&boundedEntry{path: p, size: size})
+	s.bytes += size
+	var evicted []string
+	for s.bytes > s.maxBytes && s.lru.Len() > 1 {
+		entry := s.lru.Remove(s.lru.Back()).(*boundedEntry)
+		delete(s.entries, entry.path)
+		s.bytes -= entry.size
+		evicted = append(evicted, entry.path)
+	}
+	s.mu.Unlock()
+
+	for _, e := range evicted {
+		if err := s.ResultStorage.Delete(e); err != nil {
+			rootLogger.Error("evicting entry", "path", e, "error", err)
+		}
+	}
+}
+
+// touch marks p as the most recently used entry, if it is tracked.
+func (s *boundedStorage) touch(p string) {
+	s.mu.Lock()
+	if el, ok := s.entries[p]; ok {
+		s.lru.MoveToFront(el)
+	}
+	s.mu.Unlock()
+}
+
+func (s *boundedStorage) untrack(p string) {
+	s.mu.Lock()
+	if el, ok := s.entries[p]; ok {
+		s.bytes -= s.lru.Remove(el).(*boundedEntry).size
+		delete(s.entries, p)
+	}
+	s.mu.Unlock()
+}
+
+// trackFiles registers the entries already stored by file storage, oldest
+// first, so that they count towards the limit after a restart.
+func (s *boundedStorage) trackFiles(fs *fileResultStorage) error {
+	var entries []*fileMeta
+	err := fs.walk(func(fm *fileMeta) error {
+		entries = append(entries, fm)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastModified.Before(entries[j].LastModified) })
+	for _, e := range entries {
+		s.track(e.Key, e.ContentLength)
+	}
+	return nil
+}
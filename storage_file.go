@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileResultStorage stores results on the local filesystem beneath root.
+// Each result is stored at <h[:2]>/<h>, where h is the SHA-256 of its key,
+// so that no key can collide with another or be too long for a file name.
+// The file starts with a line of JSON holding the key and metadata, which
+// is followed by the result, so that both are replaced by a single rename.
+type fileResultStorage struct {
+	root string
+}
+
+// fileMeta is the content of a sidecar file.
+type fileMeta struct {
+	Key string
+	ResultMeta
+}
+
+func newFileResultStorage(root string) (*fileResultStorage, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &fileResultStorage{root: root}, nil
+}
+
+func (s *fileResultStorage) filename(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(s.root, h[:2], h)
+}
+
+func (s *fileResultStorage) Get(p string) (io.ReadCloser, *ResultMeta, error) {
+	f, fm, err := s.open(s.filename(p))
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, &fm.ResultMeta, nil
+}
+
+func (s *fileResultStorage) Head(p string) (*ResultMeta, error) {
+	fm, err := s.readMeta(s.filename(p))
+	if err != nil {
+		return nil, err
+	}
+	return &fm.ResultMeta, nil
+}
+
+// readMeta reads the metadata of the result stored in the file name.
+func (s *fileResultStorage) readMeta(name string) (*fileMeta, error) {
+	f, fm, err := s.open(name)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return fm, nil
+}
+
+// open opens the result stored in the file name, and returns it positioned
+// at the start of the result along with its metadata. The content length
+// and, for results stored without one, the modification time come from
+// the file itself.
+func (s *fileResultStorage) open(name string) (*os.File, *fileMeta, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil, errResultNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	fm, err := readFileMeta(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("reading %s: %s", name, err)
+	}
+	return f, fm, nil
+}
+
+// readFileMeta reads the metadata line at the start of f and leaves f
+// positioned after it.
+func readFileMeta(f *os.File) (*fileMeta, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %s", err)
+	}
+	fm := new(fileMeta)
+	if err = json.Unmarshal(line, fm); err != nil {
+		return nil, fmt.Errorf("metadata: %s", err)
+	}
+	if _, err = f.Seek(int64(len(line)), io.SeekStart); err != nil {
+		return nil, err
+	}
+	fm.ContentLength = fi.Size() - int64(len(line))
+	if fm.LastModified.IsZero() {
+		fm.LastModified = fi.ModTime().UTC()
+	}
+	return fm, nil
+}
+
+// walk calls fn with the metadata of each stored result.
+func (s *fileResultStorage) walk(fn func(fm *fileMeta) error) error {
+	return filepath.Walk(s.root, func(name string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil // fn deleted it
+		}
+		if err != nil {
+			return err
+		}
+		base := filepath.Base(name)
+		if fi.IsDir() || strings.HasPrefix(base, ".tmp-") {
+			return nil
+		}
+		fm, err := s.readMeta(name)
+		if err == errResultNotFound {
+			return nil // being written or deleted
+		}
+		if err != nil {
+			return err
+		}
+		return fn(fm)
+	})
+}
+
+func (s *fileResultStorage) Put(p string, data []byte, meta *ResultMeta) error {
+	name := s.filename(p)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	metaJSON, err := json.Marshal(fileMeta{Key: p, ResultMeta: fillResultMeta(data, meta)})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, append(metaJSON, '\n'), bytes.NewReader(data))
+}
+
+// UpdateMeta rewrites the file with the new metadata line, copying the
+// result over on disk.
+func (s *fileResultStorage) UpdateMeta(p string, meta *ResultMeta) error {
+	name := s.filename(p)
+	f, fm, err := s.open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	metaJSON, err := json.Marshal(fileMeta{Key: p, ResultMeta: updatedMeta(fm.ResultMeta, meta)})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, append(metaJSON, '\n'), f)
+}
+
+func (s *fileResultStorage) Delete(p string) error {
+	if err := os.Remove(s.filename(p)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes header followed by the content of r to a temporary
+// file in the same directory as name and renames it into place so readers
+// never observe a partial write.
+func writeFileAtomic(name string, header []byte, r io.Reader) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(header); err == nil {
+		_, err = io.Copy(f, r)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// List reads the key of every stored result from its sidecar, so it takes
+// time in proportion to the number of results stored.
+func (s *fileResultStorage) List(prefix string, fn func(path string) error) error {
+	return s.walk(func(fm *fileMeta) error {
+		if strings.HasPrefix(fm.Key, prefix) {
+			return fn(fm.Key)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// keyLayout maps result paths onto storage keys beneath root. The raw
+// layout uses result paths as they are, which keeps keys readable but makes
+// them as long as the source URLs they contain. The hashed layout uses
+// /<h[:2]>/<h>, where h is the SHA-256 of the path, which keeps keys short
+// and spreads them evenly. Paths starting with /., such as cached sources
+// and the source index, are already hashed and are never hashed again.
+type keyLayout struct {
+	root   string // empty, or a path with a leading slash and no trailing one
+	hashed bool
+}
+
+// resultLayout is the layout result storage uses, which decides whether
+// results can be listed, and so purged, by prefix.
+var resultLayout keyLayout
+
+var hashedKeyPattern = regexp.MustCompile(`^/[0-9a-f]{2}/[0-9a-f]{64}$`)
+
+// newKeyLayout returns the layout called name, which is raw or hashed, with
+// the given root.
+func newKeyLayout(name, root string) (keyLayout, error) {
+	l := keyLayout{root: normalizeStorageRoot(root)}
+	switch name {
+	case "", "raw":
+	case "hashed":
+		l.hashed = true
+	default:
+		return l, fmt.Errorf("unknown storage layout %q", name)
+	}
+	return l, nil
+}
+
+func normalizeStorageRoot(root string) string {
+	if root = strings.Trim(root, "/"); root == "" {
+		return ""
+	}
+	return normalizePath("/" + root)
+}
+
+func (l keyLayout) String() string {
+	name := "raw"
+	if l.hashed {
+		name = "hashed"
+	}
+	if l.root == "" {
+		return name + " layout"
+	}
+	return name + " layout under " + l.root
+}
+
+// key returns the storage key for result path p.
+func (l keyLayout) key(p string) string {
+	if l.hashed && !strings.HasPrefix(p, "/.") {
+		sum := sha256.Sum256([]byte(p))
+		h := hex.EncodeToString(sum[:])
+		p = "/" + h[:2] + "/" + h
+	}
+	return l.root + p
+}
+
+// owns reports whether key could have been made by l, and returns key
+// relative to l's root. Raw keys never look like hashed ones, so that both
+// layouts can share a root while migrating between them.
+func (l keyLayout) owns(key string) (string, bool) {
+	if !strings.HasPrefix(key, l.root+"/") {
+		return "", false
+	}
+	rel := key[len(l.root):]
+	if strings.HasPrefix(rel, "/.") {
+		return rel, true
+	}
+	return rel, hashedKeyPattern.MatchString(rel) == l.hashed
+}
+
+// layoutStorage stores results in a ResultStorage at the keys a keyLayout
+// gives for their paths. Hashed results record their path in their
+// metadata, so that they can be migrated back to the raw layout.
+type layoutStorage struct {
+	ResultStorage
+	layout keyLayout
+}
+
+func (s layoutStorage) Get(p string) (io.ReadCloser, *ResultMeta, error) {
+	return s.ResultStorage.Get(s.layout.key(p))
+}
+
+func (s layoutStorage) Head(p string) (*ResultMeta, error) {
+	return s.ResultStorage.Head(s.layout.key(p))
+}
+
+func (s layoutStorage) Put(p string, data []byte, meta *ResultMeta) error {
+	key := s.layout.key(p)
+	if key != s.layout.root+p {
+		m := *meta
+		m.Path = p
+		meta = &m
+	}
+	return s.ResultStorage.Put(key, data, meta)
+}
+
+func (s layoutStorage) UpdateMeta(p string, meta *ResultMeta) error {
+	updater, ok := s.ResultStorage.(MetaUpdater)
+	if !ok {
+		return errMetaUpdateUnsupported
+	}
+	key := s.layout.key(p)
+	if key != s.layout.root+p {
+		m := *meta
+		m.Path = p
+		meta = &m
+	}
+	return updater.UpdateMeta(key, meta)
+}
+
+func (s layoutStorage) Delete(p string) error {
+	return s.ResultStorage.Delete(s.layout.key(p))
+}
+
+// List lists result paths by prefix, which the hashed layout only allows
+// for the paths it doesn't hash.
+func (s layoutStorage) List(prefix string, fn func(path string) error) error {
+	lister, ok := s.ResultStorage.(ResultLister)
+	if !ok {
+		return errListUnsupported
+	}
+	if s.layout.hashed && !strings.HasPrefix(prefix, "/.") {
+		return errors.New("results can't be listed by prefix with the hashed storage layout")
+	}
+	return lister.List(s.layout.root+prefix, func(key string) error {
+		if rel, ok := s.layout.owns(key); ok {
+			return fn(rel)
+		}
+		return nil
+	})
+}
+
+// migrateResults copies every object stored in the from layout to the key
+// the to layout gives it, calling report for each. Objects that already
+// exist at their new key are left alone, so that an interrupted migration
+// can be resumed.
+func migrateResults(store ResultStorage, from, to keyLayout, dryRun bool, report func(oldKey, newKey string)) (copied, skipped int, err error) {
+	lister, ok := store.(ResultLister)
+	if !ok {
+		return 0, 0, errListUnsupported
+	}
+	// When the new root is inside the old one, the copies are listed too.
+	nested := to.root != from.root && strings.HasPrefix(to.root+"/", from.root+"/")
+
+	err = lister.List(from.root+"/", func(key string) (err error) {
+		rel, ok := from.owns(key)
+		if !ok {
+			return nil
+		}
+		if _, ok := to.owns(key); ok && nested {
+			return nil
+		}
+		var r io.ReadCloser
+		var meta *ResultMeta
+		if dryRun {
+			meta, err = store.Head(key)
+		} else {
+			r, meta, err = store.Get(key)
+		}
+		if err == errResultNotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %s", key, err)
+		}
+		if r != nil {
+			defer r.Close()
+		}
+
+		p := rel
+		if from.hashed && !strings.HasPrefix(rel, "/.") {
+			if p = meta.Path; p == "" {
+				rootLogger.Error("skipping hashed result without a recorded path", "key", key)
+				skipped++
+				return nil
+			}
+		}
+		newKey := to.key(p)
+		if newKey == key {
+			return nil
+		}
+		if _, err = store.Head(newKey); err == nil {
+			return nil
+		}
+		report(key, newKey)
+		if dryRun {
+			copied++
+			return nil
+		}
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("reading %s: %s", key, err)
+		}
+		m := *meta
+		m.Path = ""
+		if err = (layoutStorage{store, to}).Put(p, data, &m); err != nil {
+			return fmt.Errorf("writing %s: %s", newKey, err)
+		}
+		copied++
+		return nil
+	})
+	return copied, skipped, err
+}
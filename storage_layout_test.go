@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNewKeyLayout(t *testing.T) {
+	cases := []struct {
+		name, root string
+		want       keyLayout
+		str        string
+	}{
+		{"", "", keyLayout{}, "raw layout"},
+		{"raw", "/", keyLayout{}, "raw layout"},
+		{"hashed", "thumbs/", keyLayout{root: "/thumbs", hashed: true}, "hashed layout under /thumbs"},
+		{"raw", "//a//b/", keyLayout{root: "/a/b"}, "raw layout under /a/b"},
+	}
+	for _, c := range cases {
+		got, err := newKeyLayout(c.name, c.root)
+		if err != nil || got != c.want || got.String() != c.str {
+			t.Errorf("newKeyLayout(%q, %q) = %+v (%s), %v, want %+v (%s)", c.name, c.root, got, got, err, c.want, c.str)
+		}
+	}
+	if _, err := newKeyLayout("sharded", ""); err == nil {
+		t.Error("newKeyLayout accepted an unknown layout")
+	}
+}
+
+func TestKeyLayoutKey(t *testing.T) {
+	const p = "/300x200/https:/example.com/a.jpg"
+	const hash = "/c4/c4b6d7bb8ac4a6a3eb2e1f5a6be14b5ce3d2e62e8c3bd14c5be1cf8b90d4e2a9"
+	raw := keyLayout{root: "/thumbs"}
+	hashed := keyLayout{root: "/thumbs", hashed: true}
+
+	if got := raw.key(p); got != "/thumbs"+p {
+		t.Errorf("raw key = %s", got)
+	}
+	key := hashed.key(p)
+	if !hashedKeyPattern.MatchString(strings.TrimPrefix(key, "/thumbs")) || !strings.HasPrefix(key, "/thumbs/") {
+		t.Errorf("hashed key = %s, want /thumbs/<h[:2]>/<h>", key)
+	}
+	if hashed.key(p) != key || hashed.key(p+"x") == key {
+		t.Error("hashed keys aren't stable and distinct")
+	}
+	for _, p := range []string{"/.sources/ab/abcd", "/.index/ab/abcd/ef"} {
+		if got := hashed.key(p); got != "/thumbs"+p {
+			t.Errorf("hashed key of %s = %s, want it unhashed", p, got)
+		}
+	}
+
+	cases := []struct {
+		layout keyLayout
+		key    string
+		rel    string
+		owns   bool
+	}{
+		{raw, "/thumbs" + p, p, true},
+		{raw, "/thumbs" + hash, hash, false},
+		{hashed, "/thumbs" + hash, hash, true},
+		{hashed, "/thumbs" + p, p, false},
+		{raw, "/thumbs/.index/ab/x", "/.index/ab/x", true},
+		{hashed, "/thumbs/.index/ab/x", "/.index/ab/x", true},
+		{raw, "/other" + p, "", false},
+		{raw, "/thumbsx" + p, "", false},
+		{keyLayout{}, p, p, true},
+	}
+	for _, c := range cases {
+		rel, owns := c.layout.owns(c.key)
+		if owns != c.owns || (owns && rel != c.rel) {
+			t.Errorf("%s owns(%s) = %q, %v, want %q, %v", c.layout, c.key, rel, owns, c.rel, c.owns)
+		}
+	}
+}
+
+func TestLayoutStorage(t *testing.T) {
+	testResultStorage(t, layoutStorage{newMemoryResultStorage(), keyLayout{root: "/thumbs"}})
+
+	store := newMemoryResultStorage()
+	hashed := layoutStorage{store, keyLayout{root: "/thumbs", hashed: true}}
+	const p = "/300x200/a.jpg"
+	if err := hashed.Put(p, []byte("x"), &ResultMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.Head(hashed.layout.key(p))
+	if err != nil || meta.Path != p {
+		t.Errorf("hashed result stored with path %q, %v, want %s", meta.Path, err, p)
+	}
+	if _, err := hashed.Head(p); err != nil {
+		t.Errorf("Head through the layout: %v", err)
+	}
+	if err := hashed.List("/300x200/", func(string) error { return nil }); err == nil {
+		t.Error("the hashed layout listed results by prefix")
+	}
+	if err := hashed.List("/.index/", func(string) error { return nil }); err != nil {
+		t.Errorf("the hashed layout can't list the index: %v", err)
+	}
+}
+
+// storedKeys returns the keys in s, sorted.
+func storedKeys(s *memoryResultStorage) []string {
+	var keys []string
+	for key := range s.results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestMigrateResults(t *testing.T) {
+	store := newMemoryResultStorage()
+	raw := keyLayout{root: "/thumbs"}
+	hashed := keyLayout{root: "/thumbs", hashed: true}
+	moved := keyLayout{root: "/v2"}
+	results := map[string]string{
+		"/300x200/https:/example.com/a.jpg": "a",
+		"/100x100/https:/example.com/b.jpg": "b",
+		"/.index/ab/abcd/ef":                "/300x200/https:/example.com/a.jpg",
+	}
+	for p, data := range results {
+		if err := (layoutStorage{store, raw}).Put(p, []byte(data), &ResultMeta{ContentType: "image/jpeg"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	original := storedKeys(store)
+
+	var reported []string
+	report := func(oldKey, newKey string) { reported = append(reported, oldKey+" -> "+newKey) }
+	copied, skipped, err := migrateResults(store, raw, hashed, true, report)
+	if err != nil || copied != 2 || skipped != 0 || len(reported) != 2 {
+		t.Errorf("dry run: copied %d, skipped %d, reported %v, %v", copied, skipped, reported, err)
+	}
+	if !reflect.DeepEqual(storedKeys(store), original) {
+		t.Errorf("dry run changed storage: %v", storedKeys(store))
+	}
+
+	// raw -> hashed -> raw under another root, after which every result
+	// reads back the same through each layout.
+	steps := []struct {
+		from, to keyLayout
+		copied   int
+	}{
+		{raw, hashed, 2},
+		{raw, hashed, 0}, // resumed: everything is already there
+		{hashed, moved, 3},
+	}
+	for _, s := range steps {
+		copied, skipped, err := migrateResults(store, s.from, s.to, false, func(string, string) {})
+		if err != nil || copied != s.copied || skipped != 0 {
+			t.Errorf("%s to %s: copied %d, skipped %d, %v, want %d copied", s.from, s.to, copied, skipped, err, s.copied)
+		}
+	}
+	for _, layout := range []keyLayout{raw, hashed, moved} {
+		for p, data := range results {
+			if layout.hashed && strings.HasPrefix(p, "/.") {
+				continue // the index is shared with the raw layout under the same root
+			}
+			r, meta, err := (layoutStorage{store, layout}).Get(p)
+			if err != nil {
+				t.Errorf("%s: %s: %v", layout, p, err)
+				continue
+			}
+			got, _ := ioutil.ReadAll(r)
+			r.Close()
+			if string(got) != data || meta.ContentType != "image/jpeg" {
+				t.Errorf("%s: %s = %q (%s), want %q", layout, p, got, meta.ContentType, data)
+			}
+			if layout == moved && meta.Path != "" {
+				t.Errorf("%s: %s keeps the path %q recorded by the hashed layout", layout, p, meta.Path)
+			}
+		}
+	}
+
+	// Hashed objects without a recorded path can't be moved.
+	store.Put(hashed.key("/lost.jpg"), []byte("x"), &ResultMeta{})
+	if _, skipped, err := migrateResults(store, hashed, moved, false, func(string, string) {}); err != nil || skipped != 1 {
+		t.Errorf("skipped %d, %v, want the hashed object without a path skipped", skipped, err)
+	}
+}
+
+func TestMigrateResultsNestedRoot(t *testing.T) {
+	store := newMemoryResultStorage()
+	from := keyLayout{}
+	to := keyLayout{root: "/v2"}
+	(layoutStorage{store, from}).Put("/300x200/a.jpg", []byte("a"), &ResultMeta{})
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := migrateResults(store, from, to, false, func(string, string) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"/300x200/a.jpg", "/v2/300x200/a.jpg"}; !reflect.DeepEqual(storedKeys(store), want) {
+		t.Errorf("stored %v, want %v without copies of copies", storedKeys(store), want)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryResultStorage keeps results in process memory. It is unbounded and
+// intended for development and tests.
+type memoryResultStorage struct {
+	mu      sync.RWMutex
+	results map[string]memoryResult
+}
+
+type memoryResult struct {
+	data []byte
+	meta ResultMeta
+}
+
+func newMemoryResultStorage() *memoryResultStorage {
+	return &memoryResultStorage{results: make(map[string]memoryResult)}
+}
+
+func (s *memoryResultStorage) Get(path string) (io.ReadCloser, *ResultMeta, error) {
+	s.mu.RLock()
+	res, ok := s.results[path]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, nil, errResultNotFound
+	}
+	meta := res.meta
+	return ioutil.NopCloser(bytes.NewReader(res.data)), &meta, nil
+}
+
+func (s *memoryResultStorage) Head(path string) (*ResultMeta, error) {
+	s.mu.RLock()
+	res, ok := s.results[path]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, errResultNotFound
+	}
+	meta := res.meta
+	return &meta, nil
+}
+
+func (s *memoryResultStorage) Put(path string, data []byte, meta *ResultMeta) error {
+	res := memoryResult{
+		data: append([]byte(nil), data...),
+		meta: fillResultMeta(data, meta),
+	}
+	s.mu.Lock()
+	s.results[path] = res
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryResultStorage) UpdateMeta(path string, meta *ResultMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, ok := s.results[path]
+	if !ok {
+		return errResultNotFound
+	}
+	res.meta = updatedMeta(res.meta, meta)
+	s.results[path] = res
+	return nil
+}
+
+func (s *memoryResultStorage) Delete(path string) error {
+	s.mu.Lock()
+	delete(s.results, path)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryResultStorage) List(prefix string, fn func(path string) error) error {
+	s.mu.RLock()
+	var paths []string
+	for p := range s.results {
+		if strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillResultMeta returns a copy of meta with the length, ETag and
+// modification time derived from data where they are unset.
+func fillResultMeta(data []byte, meta *ResultMeta) ResultMeta {
+	m := *meta
+	m.ContentLength = int64(len(data))
+	if m.ETag == "" {
+		m.ETag = computeHexMD5(data)
+	}
+	if m.LastModified.IsZero() {
+		m.LastModified = time.Now().UTC().Truncate(time.Second)
+	}
+	return m
+}
+
+// updatedMeta returns meta as UpdateMeta stores it over stored: with the
+// length and ETag of the stored data and the current time.
+func updatedMeta(stored ResultMeta, meta *ResultMeta) ResultMeta {
+	m := *meta
+	m.ContentLength = stored.ContentLength
+	m.ETag = stored.ETag
+	m.LastModified = time.Now().UTC().Truncate(time.Second)
+	return m
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+// s3ResultStorage stores results in an S3 bucket.
+type s3ResultStorage struct {
+	bucket *s3gof3r.Bucket
+	useRRS bool
+}
+
+func newS3ResultStorage(bucketName string, useRRS bool) (*s3ResultStorage, error) {
+	bucket, err := newS3Bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return &s3ResultStorage{bucket: bucket, useRRS: useRRS}, nil
+}
+
+// newS3Bucket returns a bucket authenticated with the AWS keys from the
+// environment and tuned for the small objects gothumb deals with.
+func newS3Bucket(name string) (*s3gof3r.Bucket, error) {
+	keys, err := s3gof3r.EnvKeys()
+	if err != nil {
+		return nil, err
+	}
+	bucket := s3gof3r.New(s3gof3r.DefaultDomain, keys).Bucket(name)
+	bucket.Concurrency = 4
+	bucket.PartSize = int64(2 * MB)
+	bucket.Md5Check = false
+	return bucket, nil
+}
+
+func (s *s3ResultStorage) Get(path string) (io.ReadCloser, *ResultMeta, error) {
+	r, h, err := s.bucket.GetReader(path, nil)
+	if err != nil {
+		if rerr, ok := err.(*s3gof3r.RespError); ok && rerr.StatusCode == 404 {
+			return nil, nil, errResultNotFound
+		}
+		return nil, nil, err
+	}
+	meta, err := s3ResultMeta(h)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return r, meta, nil
+}
+
+func (s *s3ResultStorage) Head(path string) (*ResultMeta, error) {
+	s3URL := fmt.Sprintf("https://%s.s3.amazonaws.com%s", s.bucket.Name, path)
+	req, err := http.NewRequest("HEAD", s3URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.bucket.Sign(req)
+	res, err := s.bucket.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, errResultNotFound
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	res.Header.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	return s3ResultMeta(res.Header)
+}
+
+// Put records the result's ETag in its metadata, since the ETag S3 computes
+// for a multipart upload isn't the MD5 of the data.
+func (s *s3ResultStorage) Put(path string, data []byte, meta *ResultMeta) error {
+	w, err := s.bucket.PutWriter(path, s.headers(fillResultMeta(data, meta)), nil)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// UpdateMeta copies the object onto itself with the new metadata, which S3
+// does without the data leaving the bucket.
+func (s *s3ResultStorage) UpdateMeta(path string, meta *ResultMeta) error {
+	stored, err := s.Head(path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("https://%s.s3.amazonaws.com%s", s.bucket.Name, path), nil)
+	if err != nil {
+		return err
+	}
+	req.Header = s.headers(updatedMeta(*stored, meta))
+	req.Header.Set("x-amz-copy-source", "/"+s.bucket.Name+(&url.URL{Path: path}).EscapedPath())
+	req.Header.Set("x-amz-metadata-directive", "REPLACE")
+	s.bucket.Sign(req)
+	res, err := s.bucket.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// A copy can fail after S3 has answered 200, in which case the body is
+	// an error document rather than a CopyObjectResult.
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == 404 {
+		return errResultNotFound
+	}
+	if res.StatusCode != 200 || bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("unexpected response updating metadata: %d %s", res.StatusCode, body)
+	}
+	return nil
+}
+
+// headers returns the headers that store m with an object.
+func (s *s3ResultStorage) headers(m ResultMeta) http.Header {
+	h := make(http.Header)
+	h.Set("Content-Type", m.ContentType)
+	h.Set("x-amz-meta-etag", m.ETag)
+	if m.Path != "" {
+		h.Set("x-amz-meta-path", m.Path)
+	}
+	if !m.Created.IsZero() {
+		h.Set("x-amz-meta-created", m.Created.UTC().Format(time.RFC3339))
+	}
+	if m.SourceETag != "" {
+		h.Set("x-amz-meta-source-etag", m.SourceETag)
+	}
+	if m.SourceLastModified != "" {
+		h.Set("x-amz-meta-source-last-modified", m.SourceLastModified)
+	}
+	if s.useRRS {
+		h.Set("x-amz-storage-class", "REDUCED_REDUNDANCY")
+	}
+	return h
+}
+
+func (s *s3ResultStorage) Delete(path string) error {
+	return s.bucket.Delete(path)
+}
+
+// List pages through the bucket with ListObjectsV2.
+func (s *s3ResultStorage) List(prefix string, fn func(path string) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {strings.TrimPrefix(prefix, "/")}}
+	for {
+		req, err := http.NewRequest("GET", fmt.Sprintf("https://%s.s3.amazonaws.com/?%s", s.bucket.Name, query.Encode()), nil)
+		if err != nil {
+			return err
+		}
+		s.bucket.Sign(req)
+		res, err := s.bucket.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if res.StatusCode != 200 {
+			err = fmt.Errorf("unexpected status code %d listing results", res.StatusCode)
+		} else {
+			err = xml.NewDecoder(res.Body).Decode(&page)
+		}
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if err = fn("/" + obj.Key); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// s3ResultMeta reads a result's metadata from the headers S3 sent with it.
+// The ETag recorded by Put is preferred to S3's own.
+func s3ResultMeta(h http.Header) (*ResultMeta, error) {
+	length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid result content-length: %s", err)
+	}
+	meta := &ResultMeta{
+		ContentType:   h.Get("Content-Type"),
+		ContentLength: length,
+		ETag:          h.Get("X-Amz-Meta-Etag"),
+
+		Path:               h.Get("X-Amz-Meta-Path"),
+		SourceETag:         h.Get("X-Amz-Meta-Source-Etag"),
+		SourceLastModified: h.Get("X-Amz-Meta-Source-Last-Modified"),
+	}
+	if meta.ETag == "" {
+		meta.ETag = strings.Trim(h.Get("Etag"), `"`)
+	}
+	if lm, err := time.Parse(http.TimeFormat, h.Get("Last-Modified")); err == nil {
+		meta.LastModified = lm
+	}
+	if created, err := time.Parse(time.RFC3339, h.Get("X-Amz-Meta-Created")); err == nil {
+		meta.Created = created
+	}
+	return meta, nil
+}
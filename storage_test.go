@@ -0,0 +1,289 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testResultStorage checks the behavior every ResultStorage shares.
+func testResultStorage(t *testing.T, s ResultStorage) {
+	if _, _, err := s.Get("/missing.jpg"); err != errResultNotFound {
+		t.Errorf("Get of a missing result: %v, want errResultNotFound", err)
+	}
+	if _, err := s.Head("/missing.jpg"); err != errResultNotFound {
+		t.Errorf("Head of a missing result: %v, want errResultNotFound", err)
+	}
+	if err := s.Delete("/missing.jpg"); err != nil {
+		t.Errorf("Delete of a missing result: %v", err)
+	}
+
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := map[string]string{
+		"/a/b.jpg":       "outer",
+		"/a/b.jpg/x.jpg": "inner",
+		"/a/c.jpg":       "sibling",
+	}
+	for p, d := range data {
+		meta := &ResultMeta{ContentType: "image/jpeg", Created: created, SourceETag: `"v1"`}
+		if err := s.Put(p, []byte(d), meta); err != nil {
+			t.Fatalf("Put %s: %v", p, err)
+		}
+	}
+	for p, d := range data {
+		r, meta, err := s.Get(p)
+		if err != nil {
+			t.Errorf("Get %s: %v", p, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(got) != d {
+			t.Errorf("Get %s = %q, %v, want %q", p, got, err, d)
+		}
+		if meta.ContentLength != int64(len(d)) || meta.ETag != computeHexMD5([]byte(d)) || meta.ContentType != "image/jpeg" {
+			t.Errorf("Get %s meta = %+v", p, meta)
+		}
+		if !meta.Created.Equal(created) || meta.SourceETag != `"v1"` || meta.LastModified.IsZero() {
+			t.Errorf("Get %s meta = %+v, want Created, SourceETag and LastModified kept", p, meta)
+		}
+	}
+
+	if lister, ok := s.(ResultLister); ok {
+		var listed []string
+		err := lister.List("/a/b.jpg", func(p string) error {
+			listed = append(listed, p)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("List: %v", err)
+		}
+		want := map[string]bool{"/a/b.jpg": true, "/a/b.jpg/x.jpg": true}
+		got := make(map[string]bool)
+		for _, p := range listed {
+			got[p] = true
+		}
+		if !reflect.DeepEqual(got, want) || len(listed) != len(want) {
+			t.Errorf("List /a/b.jpg = %v, want %v", listed, want)
+		}
+	}
+
+	if updater, ok := s.(MetaUpdater); ok {
+		if err := updater.UpdateMeta("/missing.jpg", &ResultMeta{}); err != errResultNotFound {
+			t.Errorf("UpdateMeta of a missing result: %v, want errResultNotFound", err)
+		}
+		err := updater.UpdateMeta("/a/c.jpg", &ResultMeta{ContentType: "image/jpeg", ContentLength: 1, ETag: "ignored", SourceETag: `"v2"`})
+		if err != nil {
+			t.Errorf("UpdateMeta: %v", err)
+		}
+		r, meta, err := s.Get("/a/c.jpg")
+		if err != nil {
+			t.Fatalf("Get after UpdateMeta: %v", err)
+		}
+		got, _ := ioutil.ReadAll(r)
+		r.Close()
+		d := data["/a/c.jpg"]
+		if string(got) != d || meta.ContentLength != int64(len(d)) || meta.ETag != computeHexMD5([]byte(d)) || meta.SourceETag != `"v2"` {
+			t.Errorf("Get after UpdateMeta = %q, %+v, want the data kept and the new SourceETag", got, meta)
+		}
+	}
+
+	if err := s.Delete("/a/b.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Head("/a/b.jpg"); err != errResultNotFound {
+		t.Errorf("Head after Delete: %v, want errResultNotFound", err)
+	}
+	if _, err := s.Head("/a/b.jpg/x.jpg"); err != nil {
+		t.Errorf("deleting /a/b.jpg affected /a/b.jpg/x.jpg: %v", err)
+	}
+}
+
+func TestMemoryResultStorage(t *testing.T) {
+	testResultStorage(t, newMemoryResultStorage())
+}
+
+func TestFileResultStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gothumb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newFileResultStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResultStorage(t, s)
+
+	// A result and its metadata live in one file, so that replacing a
+	// result never pairs the new data with the old metadata.
+	for _, v := range []struct{ data, contentType string }{{"first", "image/jpeg"}, {"second!", "image/webp"}} {
+		if err := s.Put("/a.jpg", []byte(v.data), &ResultMeta{ContentType: v.contentType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, meta, err := s.Get("/a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "second!" || meta.ContentType != "image/webp" || meta.ContentLength != 7 || meta.ETag != computeHexMD5(data) {
+		t.Errorf("Get after replacing = %q, %+v", data, meta)
+	}
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(s.filename("/a.jpg")), "*"))
+	if len(files) != 1 {
+		t.Errorf("result stored as %v, want one file", files)
+	}
+}
+
+func TestFileResultStorageLongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gothumb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newFileResultStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := "/300x200/https:/example.com/"
+	for len(long) < 1000 {
+		long += "long-path-segment/"
+	}
+	if err := s.Put(long+"a.jpg", []byte("x"), &ResultMeta{}); err != nil {
+		t.Fatalf("Put of a long key: %v", err)
+	}
+	if _, err := s.Head(long + "a.jpg"); err != nil {
+		t.Errorf("Head of a long key: %v", err)
+	}
+}
+
+func TestS3ResultMeta(t *testing.T) {
+	h := http.Header{
+		"Content-Length":         {"42"},
+		"Content-Type":           {"image/webp"},
+		"Etag":                   {`"0123456789abcdef-2"`},
+		"Last-Modified":          {"Fri, 02 Jan 2026 15:04:05 GMT"},
+		"X-Amz-Meta-Etag":        {"d41d8cd98f00b204e9800998ecf8427e"},
+		"X-Amz-Meta-Created":     {"2026-01-02T15:04:05Z"},
+		"X-Amz-Meta-Path":        {"/300x200/a.jpg"},
+		"X-Amz-Meta-Source-Etag": {`"src"`},
+	}
+	meta, err := s3ResultMeta(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ResultMeta{
+		ContentType:   "image/webp",
+		ContentLength: 42,
+		ETag:          "d41d8cd98f00b204e9800998ecf8427e",
+		LastModified:  time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+		Path:          "/300x200/a.jpg",
+		Created:       time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+		SourceETag:    `"src"`,
+	}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("s3ResultMeta =\n%+v\nwant\n%+v", meta, want)
+	}
+
+	// Objects stored before the ETag was recorded fall back to S3's.
+	h.Del("X-Amz-Meta-Etag")
+	if meta, err = s3ResultMeta(h); err != nil || meta.ETag != "0123456789abcdef-2" {
+		t.Errorf("s3ResultMeta without a recorded ETag = %q, %v", meta.ETag, err)
+	}
+
+	h.Del("Content-Length")
+	if _, err = s3ResultMeta(h); err == nil {
+		t.Error("s3ResultMeta accepted a missing Content-Length")
+	}
+}
+
+func TestBoundedStorage(t *testing.T) {
+	testResultStorage(t, newBoundedStorage(newMemoryResultStorage(), 1<<20))
+
+	inner := newMemoryResultStorage()
+	s := newBoundedStorage(inner, 30)
+	for _, p := range []string{"/a", "/b", "/c"} {
+		if err := s.Put(p, make([]byte, 10), &ResultMeta{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Head("/a"); err != nil {
+		t.Fatal(err)
+	}
+	s.Put("/d", make([]byte, 10), &ResultMeta{})
+	if _, err := inner.Head("/b"); err != errResultNotFound {
+		t.Errorf("/b, the least recently used, wasn't evicted: %v", err)
+	}
+	for _, p := range []string{"/a", "/c", "/d"} {
+		if _, err := inner.Head(p); err != nil {
+			t.Errorf("%s was evicted: %v", p, err)
+		}
+	}
+	if s.bytes != 30 {
+		t.Errorf("tracking %d bytes, want 30", s.bytes)
+	}
+
+	// Entries larger than the limit aren't stored.
+	if err := s.Put("/huge", make([]byte, 31), &ResultMeta{}); err != nil {
+		t.Errorf("Put of an entry larger than the limit: %v", err)
+	}
+	if _, err := inner.Head("/huge"); err != errResultNotFound {
+		t.Errorf("an entry larger than the limit was stored: %v", err)
+	}
+
+	// Deleted entries, and entries found missing, stop counting.
+	s.Delete("/a")
+	inner.Delete("/c")
+	s.Get("/c")
+	if s.bytes != 10 || len(s.entries) != 1 {
+		t.Errorf("tracking %d bytes in %d entries, want 10 in 1", s.bytes, len(s.entries))
+	}
+
+	// Entries stored before startup count once read.
+	inner.Put("/old", make([]byte, 25), &ResultMeta{})
+	s.Get("/old")
+	if _, err := inner.Head("/d"); err != errResultNotFound || s.bytes != 25 {
+		t.Errorf("reading /old left %d bytes tracked and /d (%v)", s.bytes, err)
+	}
+}
+
+func TestBoundedStorageTrackFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gothumb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := newFileResultStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, p := range []string{"/new", "/oldest", "/old"} {
+		modified := now.Add(-time.Duration([]int{1, 3, 2}[i]) * time.Hour)
+		if err := fs.Put(p, make([]byte, 10), &ResultMeta{LastModified: modified}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newBoundedStorage(fs, 20)
+	if err = s.trackFiles(fs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Head("/oldest"); err != errResultNotFound {
+		t.Errorf("the oldest file wasn't evicted: %v", err)
+	}
+	for _, p := range []string{"/old", "/new"} {
+		if _, err := fs.Head(p); err != nil {
+			t.Errorf("%s was evicted: %v", p, err)
+		}
+	}
+	if s.bytes != 20 {
+		t.Errorf("tracking %d bytes, want 20", s.bytes)
+	}
+}
@@ -0,0 +1,287 @@
+// Package urlbuilder builds and signs gothumb URLs.
+//
+// Paths are built in the canonical form the server uses for its result keys
+// and signed exactly as the server verifies them, so equivalent options
+// always produce the same URL:
+//
+//	b := &urlbuilder.Builder{Key: []byte(os.Getenv("SECURITY_KEY"))}
+//	p, err := b.Path("https://example.com/photo.jpg", urlbuilder.Options{Width: 300, Height: 200})
+//	// p == "/<signature>/300x200/https://example.com/photo.jpg"
+package urlbuilder
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Algorithm is an HMAC algorithm URLs can be signed with.
+type Algorithm string
+
+const (
+	SHA1   Algorithm = "sha1"
+	SHA256 Algorithm = "sha256"
+	SHA512 Algorithm = "sha512"
+)
+
+// Algorithms lists every supported Algorithm.
+var Algorithms = []Algorithm{SHA1, SHA256, SHA512}
+
+func (a Algorithm) newHash() func() hash.Hash {
+	switch a {
+	case SHA1:
+		return sha1.New
+	case SHA256:
+		return sha256.New
+	case SHA512:
+		return sha512.New
+	}
+	return nil
+}
+
+// SignatureLen returns the length of a signature made with a, or 0 for an
+// unknown algorithm. gothumb tells algorithms apart by this length.
+func (a Algorithm) SignatureLen() int {
+	newHash := a.newHash()
+	if newHash == nil {
+		return 0
+	}
+	return base64.URLEncoding.EncodedLen(newHash().Size())
+}
+
+// Sign returns the signature of path, the escaped part of a URL after the
+// signature segment, made with key.
+func Sign(a Algorithm, key []byte, path string) (string, error) {
+	newHash := a.newHash()
+	if newHash == nil {
+		return "", fmt.Errorf("unknown signature algorithm %q", a)
+	}
+	h := hmac.New(newHash, key)
+	h.Write([]byte(path))
+	return base64.URLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// Filter is a single name(args) filter call.
+type Filter struct {
+	Name string
+	Args []string
+}
+
+// NewFilter returns the filter name with args formatted with fmt.Sprint.
+func NewFilter(name string, args ...interface{}) Filter {
+	f := Filter{Name: name}
+	for _, arg := range args {
+		f.Args = append(f.Args, fmt.Sprint(arg))
+	}
+	return f
+}
+
+func (f Filter) String() string {
+	return f.Name + "(" + strings.Join(f.Args, ",") + ")"
+}
+
+// Options are the processing options of a URL. The zero value requests the
+// source at its original size.
+type Options struct {
+	// Expires and NotBefore bound when a signed URL is valid. Zero values
+	// leave the URL valid indefinitely.
+	Expires, NotBefore time.Time
+
+	// Preset names a preset configured on the server to use instead of the
+	// processing options below, which must then be left unset.
+	Preset string
+
+	Trim          bool
+	TrimPosition  string // "top-left" (the default) or "bottom-right"
+	TrimTolerance int
+
+	// Manual crop rectangle in source pixels, applied before resizing.
+	CropLeft, CropTop, CropRight, CropBottom int
+
+	FitIn          bool
+	Width, Height  int
+	FlipHorizontal bool
+	FlipVertical   bool
+
+	// Without FitIn, giving an alignment or Smart crops the image to fill
+	// Width x Height, as Thumbor does. Without any of them the image is
+	// scaled to exactly that size, as gothumb always has.
+	HAlign string // "left", "center" or "right"
+	VAlign string // "top", "middle" or "bottom"
+	Smart  bool
+
+	// Filters are passed through as given. The server validates them and
+	// normalizes their arguments in its result keys.
+	Filters []Filter
+}
+
+// UnsignedPath returns the escaped path for source with opts, without a
+// leading slash or signature.
+func UnsignedPath(source string, opts Options) (string, error) {
+	if source == "" {
+		return "", errors.New("source must be set")
+	}
+	var validity []string
+	if !opts.Expires.IsZero() {
+		validity = append(validity, "expires:"+strconv.FormatInt(opts.Expires.Unix(), 10))
+	}
+	if !opts.NotBefore.IsZero() {
+		validity = append(validity, "not-before:"+strconv.FormatInt(opts.NotBefore.Unix(), 10))
+	}
+
+	var segments []string
+
+	if opts.Trim {
+		trim := "trim"
+		switch opts.TrimPosition {
+		case "", "top-left":
+		case "bottom-right":
+			trim += ":bottom-right"
+		default:
+			return "", fmt.Errorf("invalid trim position %q", opts.TrimPosition)
+		}
+		if opts.TrimTolerance < 0 {
+			return "", errors.New("trim tolerance must not be negative")
+		}
+		if opts.TrimTolerance > 0 {
+			trim += ":" + strconv.Itoa(opts.TrimTolerance)
+		}
+		segments = append(segments, trim)
+	}
+
+	if opts.CropLeft != 0 || opts.CropTop != 0 || opts.CropRight != 0 || opts.CropBottom != 0 {
+		if opts.CropLeft < 0 || opts.CropTop < 0 || opts.CropRight <= opts.CropLeft || opts.CropBottom <= opts.CropTop {
+			return "", errors.New("invalid crop rectangle")
+		}
+		segments = append(segments, fmt.Sprintf("%dx%d:%dx%d", opts.CropLeft, opts.CropTop, opts.CropRight, opts.CropBottom))
+	}
+	if opts.FitIn {
+		segments = append(segments, "fit-in")
+	}
+
+	if opts.Width < 0 || opts.Height < 0 {
+		return "", errors.New("width and height must not be negative")
+	}
+	size := ""
+	if opts.FlipHorizontal {
+		size += "-"
+	}
+	size += strconv.Itoa(opts.Width) + "x"
+	if opts.FlipVertical {
+		size += "-"
+	}
+	size += strconv.Itoa(opts.Height)
+	segments = append(segments, size)
+
+	switch opts.HAlign {
+	case "":
+	case "left", "center", "right":
+		segments = append(segments, opts.HAlign)
+	default:
+		return "", fmt.Errorf("invalid horizontal alignment %q", opts.HAlign)
+	}
+	switch opts.VAlign {
+	case "":
+	case "top", "middle", "bottom":
+		segments = append(segments, opts.VAlign)
+	default:
+		return "", fmt.Errorf("invalid vertical alignment %q", opts.VAlign)
+	}
+	if opts.Smart {
+		segments = append(segments, "smart")
+	}
+	if len(opts.Filters) > 0 {
+		names := make([]string, len(opts.Filters))
+		for i, f := range opts.Filters {
+			names[i] = f.String()
+		}
+		segments = append(segments, "filters:"+strings.Join(names, ":"))
+	}
+
+	if opts.Preset != "" {
+		if len(segments) != 1 || segments[0] != "0x0" {
+			return "", errors.New("a preset can't be combined with other processing options")
+		}
+		segments = []string{"preset:" + opts.Preset}
+	}
+
+	segments = append(append(validity, segments...), source)
+	return EscapePath(strings.Join(segments, "/")), nil
+}
+
+// EscapePath percent-encodes the bytes of p that may not appear as-is in a
+// URL path, for signing paths built by hand. The server verifies signatures
+// against the path as sent, so everything a path allows, such as the
+// parentheses of filters, is left alone to match URLs signed by other
+// clients.
+func EscapePath(p string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~!$&'()*+,;=:@/", c) >= 0 {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// Builder builds signed gothumb paths.
+type Builder struct {
+	// Key is the security key URLs are signed with.
+	Key []byte
+	// KeyID, if set, is put in front of the signature so that the server
+	// only checks the key with that id.
+	KeyID string
+	// Algorithm defaults to SHA256.
+	Algorithm Algorithm
+	// Unsafe builds /unsafe/ URLs instead of signing them, for servers
+	// running with -unsafe.
+	Unsafe bool
+}
+
+// Path returns the signed path for source with opts, starting with "/".
+func (b *Builder) Path(source string, opts Options) (string, error) {
+	unsigned, err := UnsignedPath(source, opts)
+	if err != nil {
+		return "", err
+	}
+	if b.Unsafe {
+		return "/unsafe/" + unsigned, nil
+	}
+	if len(b.Key) == 0 {
+		return "", errors.New("a key is required to sign URLs")
+	}
+	algorithm := b.Algorithm
+	if algorithm == "" {
+		algorithm = SHA256
+	}
+	sig, err := Sign(algorithm, b.Key, unsigned)
+	if err != nil {
+		return "", err
+	}
+	if b.KeyID != "" {
+		sig = b.KeyID + "." + sig
+	}
+	return "/" + sig + "/" + unsigned, nil
+}
+
+// URL returns the signed URL for source with opts on the gothumb server at
+// base, e.g. https://thumbs.example.com.
+func (b *Builder) URL(base, source string, opts Options) (string, error) {
+	p, err := b.Path(source, opts)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(base, "/") + p, nil
+}
@@ -0,0 +1,95 @@
+package urlbuilder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+// goldenCase is a URL built from known options. The same cases are checked
+// against the server's parser in the gothumb package, so that URLs built
+// here are the ones the server verifies and renders.
+type goldenCase struct {
+	Name      string  `json:"name"`
+	Source    string  `json:"source"`
+	Options   Options `json:"options"`
+	Key       string  `json:"key"`
+	KeyID     string  `json:"key_id"`
+	Algorithm string  `json:"algorithm"`
+	Unsafe    bool    `json:"unsafe"`
+	Path      string  `json:"path"`
+}
+
+func loadGolden(t *testing.T) []goldenCase {
+	data, err := ioutil.ReadFile("testdata/golden.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []goldenCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+	return cases
+}
+
+func TestBuilderGolden(t *testing.T) {
+	for _, c := range loadGolden(t) {
+		b := &Builder{Key: []byte(c.Key), KeyID: c.KeyID, Algorithm: Algorithm(c.Algorithm), Unsafe: c.Unsafe}
+		p, err := b.Path(c.Source, c.Options)
+		if err != nil {
+			t.Errorf("%s: %v", c.Name, err)
+			continue
+		}
+		if p != c.Path {
+			t.Errorf("%s:\n got %s\nwant %s", c.Name, p, c.Path)
+		}
+	}
+}
+
+func TestBuilderDefaultAlgorithm(t *testing.T) {
+	p1, err := (&Builder{Key: []byte("secret")}).Path("https://example.com/photo.jpg", Options{Width: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := (&Builder{Key: []byte("secret"), Algorithm: SHA256}).Path("https://example.com/photo.jpg", Options{Width: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p1 != p2 {
+		t.Errorf("default algorithm path %s, want %s", p1, p2)
+	}
+}
+
+func TestBuilderURL(t *testing.T) {
+	b := &Builder{Unsafe: true}
+	u, err := b.URL("https://thumbs.example.com/", "https://example.com/photo.jpg", Options{Width: 10, Height: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://thumbs.example.com/unsafe/10x20/https://example.com/photo.jpg"; u != want {
+		t.Errorf("got %s, want %s", u, want)
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder Builder
+		source  string
+		opts    Options
+	}{
+		{"no source", Builder{Key: []byte("k")}, "", Options{}},
+		{"no key", Builder{}, "https://example.com/a.jpg", Options{}},
+		{"unknown algorithm", Builder{Key: []byte("k"), Algorithm: "md5"}, "https://example.com/a.jpg", Options{}},
+		{"negative size", Builder{Key: []byte("k")}, "https://example.com/a.jpg", Options{Width: -1}},
+		{"bad crop", Builder{Key: []byte("k")}, "https://example.com/a.jpg", Options{CropLeft: 10, CropRight: 5, CropBottom: 5}},
+		{"bad trim position", Builder{Key: []byte("k")}, "https://example.com/a.jpg", Options{Trim: true, TrimPosition: "middle"}},
+		{"bad alignment", Builder{Key: []byte("k")}, "https://example.com/a.jpg", Options{HAlign: "top"}},
+		{"preset with options", Builder{Key: []byte("k")}, "https://example.com/a.jpg", Options{Preset: "card", Width: 10}},
+	}
+	for _, tt := range tests {
+		if p, err := tt.builder.Path(tt.source, tt.opts); err == nil {
+			t.Errorf("%s: got %s, want an error", tt.name, p)
+		}
+	}
+}
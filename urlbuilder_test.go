@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/opendoor-labs/gothumb/urlbuilder"
+)
+
+// TestURLBuilderGolden checks that the URLs in the urlbuilder golden file
+// route, verify and parse on the server to the expected result keys.
+func TestURLBuilderGolden(t *testing.T) {
+	data, err := ioutil.ReadFile("urlbuilder/testdata/golden.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []struct {
+		Name      string             `json:"name"`
+		Options   urlbuilder.Options `json:"options"`
+		Presets   map[string]string  `json:"presets"`
+		Key       string             `json:"key"`
+		KeyID     string             `json:"key_id"`
+		Algorithm string             `json:"algorithm"`
+		Unsafe    bool               `json:"unsafe"`
+		Path      string             `json:"path"`
+		ResultKey string             `json:"result_key"`
+	}
+	if err := json.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(keys []*signingKey, algorithms map[string]bool, unsafe bool, p map[string]*imageOptions) {
+		securityKeys, acceptedAlgorithms, unsafeMode, presets = keys, algorithms, unsafe, p
+	}(securityKeys, acceptedAlgorithms, unsafeMode, presets)
+	acceptedAlgorithms = map[string]bool{"sha1": true, "sha256": true, "sha512": true}
+
+	for _, c := range cases {
+		securityKeys = []*signingKey{{id: c.KeyID, secret: []byte(c.Key)}}
+		unsafeMode = c.Unsafe
+		if presets, err = parsePresets(c.Presets); err != nil {
+			t.Fatalf("%s: %v", c.Name, err)
+		}
+
+		var params httprouter.Params
+		router := httprouter.New()
+		router.GET("/:signature/*path", func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+			params = p
+		})
+		req := httptest.NewRequest("GET", c.Path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		if params == nil {
+			t.Errorf("%s: %s did not route", c.Name, c.Path)
+			continue
+		}
+
+		sig := params.ByName("signature")
+		key, algorithm, err := validateSignature(sig, strings.TrimPrefix(req.URL.EscapedPath(), "/"+sig+"/"))
+		if err != nil {
+			t.Errorf("%s: %v", c.Name, err)
+			continue
+		}
+		if !c.Unsafe && (key == nil || algorithm != c.Algorithm) {
+			t.Errorf("%s: verified with %v/%q, want the %s key", c.Name, key, algorithm, c.Algorithm)
+		}
+
+		opts, err := parseImageOptions(params.ByName("path"))
+		if err != nil {
+			t.Errorf("%s: %v", c.Name, err)
+			continue
+		}
+		if got := opts.String(); got != c.ResultKey {
+			t.Errorf("%s: result key\n got %s\nwant %s", c.Name, got, c.ResultKey)
+		}
+		if !opts.Expires.Equal(c.Options.Expires) || !opts.NotBefore.Equal(c.Options.NotBefore) {
+			t.Errorf("%s: validity %v-%v, want %v-%v", c.Name, opts.NotBefore, opts.Expires, c.Options.NotBefore, c.Options.Expires)
+		}
+	}
+}
+
+func TestURLBuilderSignatureMismatch(t *testing.T) {
+	defer func(keys []*signingKey, algorithms map[string]bool) {
+		securityKeys, acceptedAlgorithms = keys, algorithms
+	}(securityKeys, acceptedAlgorithms)
+	securityKeys = []*signingKey{{secret: []byte("secret")}}
+	acceptedAlgorithms = map[string]bool{"sha256": true}
+
+	b := &urlbuilder.Builder{Key: []byte("other")}
+	p, err := b.Path("https://example.com/photo.jpg", urlbuilder.Options{Expires: time.Unix(1893456000, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	if _, _, err := validateSignature(parts[0], parts[1]); err == nil {
+		t.Error("signature made with another key was accepted")
+	}
+}